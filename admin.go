@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// adminListLimit is the default page size of the admin list endpoint.
+const adminListLimit = 100
+
+// RegisterAdmin registers the admin endpoints of the manager in the group,
+// which should be protected by an authorization middleware:
+//
+//	GET    /records?prefix=&cursor=&limit=  lists the keys, see `Manager.List`
+//	GET    /records/:key                    returns the record of the key
+//	DELETE /records/:key                    invalidates the record of the key
+//
+// Keys are the stored ones returned by the list endpoint, path escaped.
+func (m *Manager) RegisterAdmin(g *echo.Group) {
+	g.GET("/records", m.adminList)
+	g.GET("/records/:key", m.adminLookup)
+	g.DELETE("/records/:key", m.adminInvalidate)
+}
+
+func (m *Manager) adminList(c echo.Context) error {
+	limit := adminListLimit
+	if v := c.QueryParam("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+	}
+
+	keys, next, err := m.List(c.Request().Context(), c.QueryParam("prefix"), c.QueryParam("cursor"), limit)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"keys": keys, "next_cursor": next})
+}
+
+func (m *Manager) adminLookup(c echo.Context) error {
+	key, err := url.PathUnescape(c.Param("key"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid key")
+	}
+
+	reqRec, err := getRecord(c.Request().Context(), m.config.Store, m.config.Codec, m.config.storedKey(key))
+	if errors.Is(err, ErrRecordLost) {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, reqRec)
+}
+
+func (m *Manager) adminInvalidate(c echo.Context) error {
+	key, err := url.PathUnescape(c.Param("key"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid key")
+	}
+
+	reqKey := m.config.storedKey(key)
+
+	keys, err := withChunks(c.Request().Context(), m.config.Store, m.config.Codec, reqKey)
+	if err != nil {
+		return err
+	}
+
+	if err := m.config.Store.Delete(c.Request().Context(), keys...); err != nil {
+		return err
+	}
+
+	m.release(reqKey)
+
+	return c.NoContent(http.StatusNoContent)
+}
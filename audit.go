@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// AuditBody defines what is stored of the request bodies for audit.
+type AuditBody int
+
+const (
+	// AuditBodyNone stores nothing of the request bodies.
+	AuditBodyNone AuditBody = iota
+
+	// AuditBodyDigest stores the SHA-256 digest of the request bodies.
+	AuditBodyDigest
+
+	// AuditBodyRedacted stores the request bodies passed through the
+	// `Redactor`, along with the digest of the original bodies.
+	AuditBodyRedacted
+)
+
+// auditRequest returns the record holding the details of the request stored
+// for audit, see `AuditRequestHeaders` and `AuditRequestBody`.
+func auditRequest(config IdempotencyConfig, req *http.Request) (ReqRecord, error) {
+	audit := ReqRecord{}
+
+	if len(config.AuditRequestHeaders) > 0 {
+		audit.RequestHeaders = auditHeaders(config, req.Header)
+	}
+
+	if config.AuditRequestBody == AuditBodyNone {
+		return audit, nil
+	}
+
+	body, truncated, err := bufferRequestBodyPrefix(req, config.AuditMaxBodySize)
+	if err != nil {
+		return audit, err
+	}
+
+	audit.RequestBodyTruncated = truncated
+
+	audit.RequestBodyDigest = bodyDigest(body)
+
+	if config.AuditRequestBody == AuditBodyRedacted {
+		// The redactor gets a copy, as the body is restored for the handler.
+		audit.RequestBody = config.Redactor(append([]byte(nil), body...))
+	}
+
+	return audit, nil
+}
+
+// auditHeaders returns the request headers allowed by `AuditRequestHeaders`
+// and not denied by `AuditExcludeRequestHeaders`.
+func auditHeaders(config IdempotencyConfig, h http.Header) map[string][]string {
+	all := containsHeader(config.AuditRequestHeaders, "*")
+
+	audited := make(map[string][]string)
+	for k, v := range h {
+		if containsHeader(config.AuditExcludeRequestHeaders, k) {
+			continue
+		}
+
+		if !all && !containsHeader(config.AuditRequestHeaders, k) {
+			continue
+		}
+
+		audited[k] = append([]string(nil), v...)
+	}
+
+	return audited
+}
+
+// bodyDigest returns the hex encoded SHA-256 digest of the body.
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+
+	return hex.EncodeToString(sum[:])
+}
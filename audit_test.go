@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestAuditBodyLimit(t *testing.T) {
+	m := NewManager(IdempotencyConfig{
+		Store:            NewMemoryStore(0),
+		Codec:            BinaryCodec{},
+		DisableScope:     true,
+		AuditRequestBody: AuditBodyRedacted,
+		AuditMaxBodySize: 4,
+		Redactor:         func(body []byte) []byte { return body },
+	})
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+
+		return c.Blob(http.StatusCreated, echo.MIMEOctetStream, body)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("123456789"))
+	req.Header.Set("X-Idempotency-Key", "key")
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Body.String() != "123456789" {
+		t.Fatalf("handler got body %q, want the whole body", rec.Body.String())
+	}
+
+	reqRec, err := m.Lookup(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(reqRec.RequestBody) != "1234" || !reqRec.RequestBodyTruncated || reqRec.RequestBodyDigest != bodyDigest([]byte("1234")) {
+		t.Fatalf("audited body %q, truncated %v, digest %s", reqRec.RequestBody, reqRec.RequestBodyTruncated, reqRec.RequestBodyDigest)
+	}
+}
@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrResponseTooLarge is returned by the response writer under the
+	// `OversizeError` policy once the body exceeds `MaxResponseBodySize`.
+	ErrResponseTooLarge = errors.New("response body exceeds the maximum size")
+
+	// ErrResponseNotReplayable is returned by `http.Hijacker.Hijack` under
+	// the `OversizeError` policy since a hijacked connection can't be
+	// replayed.
+	ErrResponseNotReplayable = errors.New("hijacked response can't be replayed")
+)
+
+// OversizePolicy defines how the responses exceeding `MaxResponseBodySize` or
+// hijacking the connection are handled.
+type OversizePolicy int
+
+const (
+	// OversizeSkipStorage sends the response as is without storing it; the
+	// next request with the key executes the handler again.
+	OversizeSkipStorage OversizePolicy = iota
+
+	// OversizeError fails the writes exceeding the limit with
+	// `ErrResponseTooLarge` and the hijacks with `ErrResponseNotReplayable`.
+	OversizeError
+
+	// OversizeTruncate stores the first `MaxResponseBodySize` bytes of the
+	// body; the replays send the truncated body.
+	OversizeTruncate
+)
+
+// chunkKey returns the store key of the nth chunk of the body of the record.
+func (config IdempotencyConfig) chunkKey(reqKey string, n int) string {
+	return config.derivedKey("chk", reqKey) + "::" + strconv.Itoa(n)
+}
+
+// withChunks returns the record keys along with the keys of the chunks of
+// their bodies, so the chunks are deleted together with the records.
+func withChunks(ctx context.Context, store Store, codec Codec, reqKeys ...string) ([]string, error) {
+	keys := append([]string{}, reqKeys...)
+
+	for _, k := range reqKeys {
+		reqData, err := store.Get(ctx, k)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// The chunks of a record the codec can't decode are left to expire.
+		reqRec := ReqRecord{}
+		if codec.Unmarshal(reqData, &reqRec) == nil {
+			keys = append(keys, reqRec.BodyChunks...)
+		}
+	}
+
+	return keys, nil
+}
+
+// storeChunks moves the body of the record to chunks of `ResponseChunkSize`
+// bytes when it is larger than that, so no single value holds a large body.
+// The chunks are written before the record referencing them.
+func storeChunks(ctx context.Context, config IdempotencyConfig, reqKey string, reqRec *ReqRecord, ttl time.Duration) error {
+	if config.ResponseChunkSize <= 0 || len(reqRec.ResponseBody) <= config.ResponseChunkSize {
+		return nil
+	}
+
+	body := reqRec.ResponseBody
+	chunks := make([]string, 0, len(body)/config.ResponseChunkSize+1)
+
+	for n := 0; len(body) > 0; n++ {
+		size := config.ResponseChunkSize
+		if size > len(body) {
+			size = len(body)
+		}
+
+		k := config.chunkKey(reqKey, n)
+		if err := config.Store.Set(ctx, k, body[:size], ttl); err != nil {
+			return err
+		}
+
+		chunks = append(chunks, k)
+		body = body[size:]
+	}
+
+	reqRec.ResponseBody = nil
+	reqRec.BodyChunks = chunks
+
+	return nil
+}
+
+// writeBody writes the decoded body of the record to the response, reading
+// its chunks one by one unless it is compressed.
+func writeBody(ctx context.Context, store Store, w io.Writer, reqRec ReqRecord) error {
+	if reqRec.BodyEncoding != "" {
+		body, err := readBody(ctx, store, reqRec)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(body)
+
+		return err
+	}
+
+	return copyBody(ctx, store, w, reqRec)
+}
+
+// readBody returns the decoded body of the record, joining its chunks.
+func readBody(ctx context.Context, store Store, reqRec ReqRecord) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := copyBody(ctx, store, buf, reqRec); err != nil {
+		return nil, err
+	}
+
+	return decompressBody(reqRec.BodyEncoding, buf.Bytes())
+}
+
+// copyBody writes the stored body of the record as is, reading its chunks
+// one by one.
+func copyBody(ctx context.Context, store Store, w io.Writer, reqRec ReqRecord) error {
+	if len(reqRec.BodyChunks) == 0 {
+		_, err := w.Write(reqRec.ResponseBody)
+
+		return err
+	}
+
+	for _, k := range reqRec.BodyChunks {
+		chunk, err := store.Get(ctx, k)
+		if errors.Is(err, ErrNotFound) {
+			return ErrRecordLost
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseRecord gives up the record claimed by the request without storing
+// the response: it marks the record as abandoned, so the next request with
+// the key, including the ones already waiting, takes it over and executes
+// the handler again.
+func releaseRecord(ctx context.Context, config IdempotencyConfig, state *requestState) error {
+	abandonedAt := time.Now().Add(-time.Millisecond)
+
+	reqData, err := config.Codec.Marshal(ReqRecord{LeaseExpiresAt: &abandonedAt})
+	if err != nil {
+		return err
+	}
+
+	if err := finalSet(ctx, config, state, reqData, KeepTTL); err != nil {
+		return err
+	}
+
+	if len(state.claimedKeys) > 0 {
+		if err := config.Store.Delete(ctx, state.claimedKeys...); err != nil {
+			return err
+		}
+	}
+
+	if notifier, ok := config.Store.(Notifier); ok {
+		_ = notifier.Notify(ctx, state.reqKey)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrStoreUnavailable is the internal error of the responses sent while the
+// `CircuitBreaker` skips the store, and it wraps the store errors returned by
+// `FailClosed`.
+var ErrStoreUnavailable = errors.New("idempotency store is unavailable")
+
+// StorageErrorPolicy defines how the requests are handled when the store
+// fails before their handler is executed.
+type StorageErrorPolicy int
+
+const (
+	// FailClosed responds 503 Service Unavailable, with the store error
+	// wrapped in `ErrStoreUnavailable`.
+	FailClosed StorageErrorPolicy = iota
+
+	// FailOpen logs the store error and executes the handler without
+	// idempotency.
+	FailOpen
+)
+
+// CircuitBreaker skips the store for a cooldown once it failed a number of
+// times in a row. After the cooldown a single failure opens it again, while
+// a success closes it.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failures opening the breaker.
+	// Optional. Default value 5.
+	Threshold int
+
+	// Cooldown defines how long the breaker stays open.
+	// Optional. Default value 30 seconds.
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	failures int
+	until    time.Time
+}
+
+// NewCircuitBreaker returns a `CircuitBreaker` opening after threshold
+// consecutive failures for the cooldown.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// Open reports whether the breaker currently skips the store.
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return time.Now().Before(b.until)
+}
+
+func (b *CircuitBreaker) open() bool {
+	return b != nil && b.Open()
+}
+
+func (b *CircuitBreaker) success() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+}
+
+func (b *CircuitBreaker) failure() {
+	if b == nil {
+		return
+	}
+
+	threshold := b.Threshold
+	if threshold <= 0 {
+		threshold = 5
+	}
+
+	cooldown := b.Cooldown
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures >= threshold {
+		b.until = time.Now().Add(cooldown)
+	}
+}
+
+// storageError handles a store error according to the `StorageErrorHandler`
+// or the `StorageErrorPolicy`. It returns nil when the handler should be
+// executed without idempotency.
+func storageError(config IdempotencyConfig, c echo.Context, err error) error {
+	if config.StorageErrorHandler != nil {
+		return config.StorageErrorHandler(c, err)
+	}
+
+	if config.StorageErrorPolicy == FailOpen {
+		c.Logger().Warnf("idempotency: executing the handler without idempotency due to store error: %v", err)
+
+		return nil
+	}
+
+	return err
+}
+
+// storeUnavailable returns the 503 Service Unavailable error of the store
+// error, matching both the store error and `ErrStoreUnavailable`.
+func storeUnavailable(err error) error {
+	return echo.NewHTTPError(http.StatusServiceUnavailable).SetInternal(&unavailableError{err: err})
+}
+
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return ErrStoreUnavailable.Error() + ": " + e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrStoreUnavailable
+}
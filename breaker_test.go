@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var errStoreDown = errors.New("store is down")
+
+// failingStore fails the claims of the keys.
+type failingStore struct {
+	Store
+}
+
+func (failingStore) SetNX(context.Context, string, []byte, time.Duration) (bool, error) {
+	return false, errStoreDown
+}
+
+func TestFailClosedStoreError(t *testing.T) {
+	mw, err := IdempotencyWithConfig(IdempotencyConfig{Store: failingStore{NewMemoryStore(0)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := mw(func(c echo.Context) error {
+		t.Fatal("handler executed despite FailClosed")
+
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", "key")
+
+	err = h(echo.New().NewContext(req, httptest.NewRecorder()))
+	if !errors.Is(err, ErrStoreUnavailable) || !errors.Is(err, errStoreDown) {
+		t.Fatalf("got error %v, want ErrStoreUnavailable wrapping the store error", err)
+	}
+
+	var he *echo.HTTPError
+	if !errors.As(err, &he) || he.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got error %v, want 503 Service Unavailable", err)
+	}
+}
+
+func TestIdempotencyWithConfigError(t *testing.T) {
+	var configErr *ConfigError
+	if _, err := IdempotencyWithConfig(IdempotencyConfig{}); !errors.As(err, &configErr) || configErr.Field != "Store" {
+		t.Fatalf("got error %v, want a ConfigError of Store", err)
+	}
+}
@@ -0,0 +1,254 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// ClaimStrategy coordinates the concurrent requests having the same key and
+// decides which one of them executes the handler.
+type ClaimStrategy interface {
+	// Claim claims the key by storing the placeholder record. It returns
+	// false when the key is already claimed. When claimed, the release func
+	// is called once the request finalized its record.
+	Claim(ctx context.Context, store Store, reqKey string, placeholder []byte, ttl time.Duration) (release func(), claimed bool, err error)
+}
+
+// StoreClaim is a `ClaimStrategy` that claims keys with the atomic
+// `Store.SetNX`, e.g. Redis SETNX.
+type StoreClaim struct{}
+
+// Claim implements `ClaimStrategy`.
+func (StoreClaim) Claim(ctx context.Context, store Store, reqKey string, placeholder []byte, ttl time.Duration) (func(), bool, error) {
+	setOK, err := store.SetNX(ctx, reqKey, placeholder, ttl)
+	if err != nil || !setOK {
+		return nil, false, err
+	}
+
+	return func() {}, true, nil
+}
+
+// Locker is a blocking mutual exclusion lock service, e.g. database advisory
+// locks or ZooKeeper/etcd locks. The etcd locker, built on the
+// `concurrency.Mutex` recipe, ships in the `store/etcdlock` module, so the
+// package doesn't depend on the etcd client.
+type Locker interface {
+	// Lock blocks until the lock of the name is acquired or the context is
+	// done. The returned func releases the lock.
+	Lock(ctx context.Context, name string) (unlock func(), err error)
+}
+
+// LockClaim is a `ClaimStrategy` that serializes the requests having the
+// same key with the `Locker` while records are kept in the store. The lock is
+// held until the claiming request finalized its record, so a request
+// acquiring it afterwards finds the completed record.
+type LockClaim struct {
+	Locker Locker
+}
+
+// Claim implements `ClaimStrategy`.
+func (s *LockClaim) Claim(ctx context.Context, store Store, reqKey string, placeholder []byte, ttl time.Duration) (func(), bool, error) {
+	release, _, claimed, err := s.claimSlot(ctx, store, reqKey, placeholder, ttl, func() (func(), error) { return func() {}, nil })
+
+	return release, claimed, err
+}
+
+// claimSlot implements `slotClaim`.
+func (s *LockClaim) claimSlot(ctx context.Context, store Store, reqKey string, placeholder []byte, ttl time.Duration, acquire func() (func(), error)) (func(), func(), bool, error) {
+	unlock, err := s.Locker.Lock(ctx, reqKey)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	releaseSlot, err := acquire()
+	if err != nil {
+		unlock()
+
+		return nil, nil, false, err
+	}
+
+	setOK, err := store.SetNX(ctx, reqKey, placeholder, ttl)
+	if err != nil || !setOK {
+		releaseSlot()
+		unlock()
+
+		return nil, nil, false, err
+	}
+
+	return unlock, releaseSlot, true, nil
+}
+
+// slotClaim is implemented by the claim strategies blocking until the key is
+// available, like `LockClaim`. They take the in-flight slot of the request
+// with acquire only once the key is theirs, so the duplicates blocked
+// meanwhile don't occupy the slots.
+type slotClaim interface {
+	claimSlot(ctx context.Context, store Store, reqKey string, placeholder []byte, ttl time.Duration, acquire func() (func(), error)) (release, releaseSlot func(), claimed bool, err error)
+}
+
+// claimKey claims the key with the strategy while holding the in-flight slot
+// taken by acquire. Either way the slot is taken before the placeholder is
+// stored, so a placeholder is never claimed by a request that can't execute.
+// The slot is released unless the key is claimed.
+func claimKey(ctx context.Context, strategy ClaimStrategy, store Store, reqKey string, placeholder []byte, ttl time.Duration, acquire func() (func(), error)) (release, releaseSlot func(), claimed bool, err error) {
+	if s, ok := strategy.(slotClaim); ok {
+		return s.claimSlot(ctx, store, reqKey, placeholder, ttl, acquire)
+	}
+
+	if releaseSlot, err = acquire(); err != nil {
+		return nil, nil, false, err
+	}
+
+	if release, claimed, err = strategy.Claim(ctx, store, reqKey, placeholder, ttl); err != nil || !claimed {
+		releaseSlot()
+
+		return nil, nil, false, err
+	}
+
+	return release, releaseSlot, true, nil
+}
+
+// StoreLocker is a `Locker` backed by `Store.Lock`, e.g. Redis SET NX PX
+// with an owner token. Locks expire after TTL, so the lock of a crashed
+// process is eventually released.
+type StoreLocker struct {
+	Store Store
+
+	// TTL is the expiration of the locks.
+	// Optional. Default value 30 seconds.
+	TTL time.Duration
+
+	// RetryInterval is the interval between two attempts to acquire a lock.
+	// Optional. Default value 50 milliseconds.
+	RetryInterval time.Duration
+}
+
+// Lock implements `Locker`.
+func (l *StoreLocker) Lock(ctx context.Context, name string) (func(), error) {
+	ttl := l.TTL
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+
+	interval := l.RetryInterval
+	if interval <= 0 {
+		interval = 50 * time.Millisecond
+	}
+
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+
+	key := lockKey(name)
+	for {
+		locked, err := l.Store.Lock(ctx, key, owner, ttl)
+		if err != nil {
+			return nil, err
+		}
+
+		if locked {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case <-time.After(interval):
+		}
+	}
+
+	unlock := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ttl)
+		defer cancel()
+
+		_, _ = l.Store.Unlock(ctx, key, owner)
+	}
+
+	return unlock, nil
+}
+
+// lockKey returns the store key of the lock of the name.
+func lockKey(name string) string {
+	return "lck::" + name
+}
+
+// PostgresLocker is a `Locker` using PostgreSQL session level advisory locks.
+type PostgresLocker struct {
+	DB *sql.DB
+}
+
+// Lock implements `Locker`.
+func (l *PostgresLocker) Lock(ctx context.Context, name string) (func(), error) {
+	return sqlLock(ctx, l.DB, "SELECT pg_advisory_lock($1)", "SELECT pg_advisory_unlock($1)", lockID(name), false)
+}
+
+// MySQLLocker is a `Locker` using MySQL named locks.
+type MySQLLocker struct {
+	DB *sql.DB
+}
+
+// Lock implements `Locker`.
+func (l *MySQLLocker) Lock(ctx context.Context, name string) (func(), error) {
+	// MySQL limits the lock names to 64 characters.
+	return sqlLock(ctx, l.DB, "SELECT GET_LOCK(?, -1)", "SELECT RELEASE_LOCK(?)", strconv.FormatUint(uint64(lockID(name)), 16), true)
+}
+
+// errLockNotAcquired is returned when MySQL GET_LOCK times out (0) or fails
+// (NULL).
+var errLockNotAcquired = errors.New("idempotency lock not acquired")
+
+// sqlLock acquires a session level lock on a dedicated connection, which is
+// closed on unlock; closing the session releases the lock even if the
+// unlock statement fails. With checked, the lock statement must return 1,
+// like MySQL GET_LOCK does once the lock is acquired.
+func sqlLock(ctx context.Context, db *sql.DB, lockQuery, unlockQuery string, arg interface{}, checked bool) (func(), error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockConn(ctx, conn, lockQuery, arg, checked); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	return func() {
+		_, _ = conn.ExecContext(context.Background(), unlockQuery, arg)
+		conn.Close()
+	}, nil
+}
+
+// lockConn runs the lock statement on the connection.
+func lockConn(ctx context.Context, conn *sql.Conn, lockQuery string, arg interface{}, checked bool) error {
+	if !checked {
+		_, err := conn.ExecContext(ctx, lockQuery, arg)
+
+		return err
+	}
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, lockQuery, arg).Scan(&locked); err != nil {
+		return err
+	}
+
+	if !locked.Valid || locked.Int64 != 1 {
+		return errLockNotAcquired
+	}
+
+	return nil
+}
+
+// lockID hashes the name into the int64 key space of the advisory locks.
+func lockID(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+
+	return int64(h.Sum64())
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+)
+
+// getLockDriver is a SQL driver answering every query with a single row
+// holding its DSN, e.g. the result of GET_LOCK; "NULL" answers NULL.
+type getLockDriver struct{}
+
+func (getLockDriver) Open(dsn string) (driver.Conn, error) { return getLockConn(dsn), nil }
+
+type getLockConn string
+
+func (c getLockConn) Prepare(string) (driver.Stmt, error) { return getLockStmt(c), nil }
+func (getLockConn) Close() error                          { return nil }
+func (getLockConn) Begin() (driver.Tx, error)             { return nil, errors.New("not supported") }
+
+type getLockStmt string
+
+func (getLockStmt) Close() error                               { return nil }
+func (getLockStmt) NumInput() int                              { return -1 }
+func (getLockStmt) Exec([]driver.Value) (driver.Result, error) { return driver.ResultNoRows, nil }
+func (s getLockStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &getLockRows{value: string(s)}, nil
+}
+
+type getLockRows struct {
+	value string
+	done  bool
+}
+
+func (*getLockRows) Columns() []string { return []string{"lock"} }
+func (*getLockRows) Close() error      { return nil }
+
+func (r *getLockRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+
+	r.done = true
+
+	if r.value != "NULL" {
+		dest[0] = r.value
+	}
+
+	return nil
+}
+
+func init() {
+	sql.Register("getlock", getLockDriver{})
+}
+
+func TestMySQLLockerResult(t *testing.T) {
+	tests := []struct {
+		result string
+		err    error
+	}{
+		{"1", nil},
+		{"0", errLockNotAcquired},
+		{"NULL", errLockNotAcquired},
+	}
+
+	for _, tt := range tests {
+		db, err := sql.Open("getlock", tt.result)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		unlock, err := (&MySQLLocker{DB: db}).Lock(context.Background(), "key")
+		if !errors.Is(err, tt.err) {
+			t.Errorf("GET_LOCK returning %s: got error %v, want %v", tt.result, err, tt.err)
+		}
+
+		if unlock != nil {
+			unlock()
+		}
+
+		db.Close()
+	}
+}
@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// flightGroup coalesces the concurrent duplicates of a request within the
+// process: the duplicates of a key claimed by the process skip the claim,
+// and the requests waiting for the same key share a single wait. A nil
+// group doesn't coalesce.
+type flightGroup struct {
+	mu      sync.Mutex
+	claimed map[string]int
+	flights map[string]*flight
+}
+
+// flight is a wait shared by the requests waiting for the same key.
+type flight struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	reqRec  ReqRecord
+	err     error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{claimed: make(map[string]int), flights: make(map[string]*flight)}
+}
+
+// claim marks the key as claimed by a request of the process until the
+// returned func is called.
+func (g *flightGroup) claim(reqKey string) func() {
+	if g == nil {
+		return func() {}
+	}
+
+	g.mu.Lock()
+	g.claimed[reqKey]++
+	g.mu.Unlock()
+
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if g.claimed[reqKey]--; g.claimed[reqKey] == 0 {
+			delete(g.claimed, reqKey)
+		}
+	}
+}
+
+// claimedLocally reports whether a request of the process holds the key, so
+// claiming it from the store would fail anyway.
+func (g *flightGroup) claimedLocally(reqKey string) bool {
+	if g == nil {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.claimed[reqKey] > 0
+}
+
+// wait joins the wait for the key, starting it with fn if no request of the
+// process is waiting for the key yet. The shared wait runs detached from the
+// requests and is canceled once all of them gave up; each request still
+// stops waiting when its own ctx is done.
+func (g *flightGroup) wait(ctx context.Context, reqKey string, fn func(ctx context.Context) (ReqRecord, error)) (ReqRecord, error) {
+	if g == nil {
+		return fn(ctx)
+	}
+
+	g.mu.Lock()
+	f, ok := g.flights[reqKey]
+	if !ok {
+		flightCtx, cancel := context.WithCancel(detachedContext{parent: ctx})
+
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[reqKey] = f
+
+		go func() {
+			f.reqRec, f.err = fn(flightCtx)
+
+			g.mu.Lock()
+			if g.flights[reqKey] == f {
+				delete(g.flights, reqKey)
+			}
+			g.mu.Unlock()
+
+			cancel()
+			close(f.done)
+		}()
+	}
+
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.reqRec.clone(), f.err
+
+	case <-ctx.Done():
+		g.mu.Lock()
+		if f.waiters--; f.waiters == 0 {
+			f.cancel()
+
+			if g.flights[reqKey] == f {
+				delete(g.flights, reqKey)
+			}
+		}
+		g.mu.Unlock()
+
+		return ReqRecord{}, ctx.Err()
+	}
+}
+
+// clone returns a deep copy of the record, so the requests sharing a wait
+// can't modify the record of each other, e.g. its body by a
+// `ReplayTransformer`.
+func (r ReqRecord) clone() ReqRecord {
+	r.ResponseHeaders = cloneHeaders(r.ResponseHeaders)
+	r.ResponseTrailers = cloneHeaders(r.ResponseTrailers)
+	r.RequestHeaders = cloneHeaders(r.RequestHeaders)
+	r.ResponseBody = cloneBytes(r.ResponseBody)
+	r.RequestBody = cloneBytes(r.RequestBody)
+	r.Result = cloneBytes(r.Result)
+	r.raw = cloneBytes(r.raw)
+	r.BodyChunks = cloneStrings(r.BodyChunks)
+	r.Groups = cloneStrings(r.Groups)
+	r.LeaseExpiresAt = cloneTime(r.LeaseExpiresAt)
+	r.CompletedAt = cloneTime(r.CompletedAt)
+	r.ReceivedAt = cloneTime(r.ReceivedAt)
+
+	return r
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+
+	return append([]string{}, s...)
+}
+
+func cloneTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	cloned := *t
+
+	return &cloned
+}
+
+func cloneHeaders(h map[string][]string) map[string][]string {
+	if h == nil {
+		return nil
+	}
+
+	cloned := make(map[string][]string, len(h))
+	for k, v := range h {
+		cloned[k] = append([]string(nil), v...)
+	}
+
+	return cloned
+}
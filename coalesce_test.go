@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestFlightGroupSharedWait(t *testing.T) {
+	g := newFlightGroup()
+	completedAt := time.Now()
+
+	waits := int32(0)
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (ReqRecord, error) {
+		atomic.AddInt32(&waits, 1)
+		<-release
+
+		return ReqRecord{Done: true, ResponseBody: []byte("body"), Groups: []string{"g"}, CompletedAt: &completedAt}, nil
+	}
+
+	records := make([]ReqRecord, 2)
+
+	var wg sync.WaitGroup
+	for i := range records {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			records[i], _ = g.wait(context.Background(), "key", fn)
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if waits != 1 {
+		t.Fatalf("got %d waits, want a shared one", waits)
+	}
+
+	records[0].ResponseBody[0] = 'B'
+	records[0].Groups[0] = "other"
+	*records[0].CompletedAt = time.Time{}
+
+	if string(records[1].ResponseBody) != "body" || records[1].Groups[0] != "g" || !records[1].CompletedAt.Equal(completedAt) {
+		t.Fatalf("got %+v, want the record unaffected by the other waiter", records[1])
+	}
+}
+
+func TestFlightGroupWaiterGivesUp(t *testing.T) {
+	g := newFlightGroup()
+
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) (ReqRecord, error) {
+		<-ctx.Done()
+		close(canceled)
+
+		return ReqRecord{}, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := g.wait(ctx, "key", fn); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The shared wait is canceled once its last waiter gave up.
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the shared wait isn't canceled")
+	}
+}
+
+func TestCoalescedReplayTransformer(t *testing.T) {
+	started, finish := make(chan struct{}), make(chan struct{})
+
+	// The transformer rewrites the body in place.
+	m := NewManager(IdempotencyConfig{
+		Store:            NewMemoryStore(0),
+		DisableScope:     true,
+		WaitPollInterval: 10 * time.Millisecond,
+		ReplayTransformer: func(c echo.Context, reqRec *ReqRecord) error {
+			for i := range reqRec.ResponseBody {
+				reqRec.ResponseBody[i]++
+			}
+
+			return nil
+		},
+	})
+
+	executed := int32(0)
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		if atomic.AddInt32(&executed, 1) == 1 {
+			close(started)
+			<-finish
+		}
+
+		return c.String(http.StatusCreated, "abc")
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", "key")
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	go send()
+	<-started
+
+	recs := make([]*httptest.ResponseRecorder, 3)
+
+	var wg sync.WaitGroup
+	for i := range recs {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			recs[i] = send()
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(finish)
+	wg.Wait()
+
+	for _, rec := range recs {
+		if rec.Body.String() != "bcd" {
+			t.Fatalf("got body %q, want the body transformed once", rec.Body.String())
+		}
+	}
+}
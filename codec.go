@@ -0,0 +1,435 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// bodyEncodingGzip is the `ReqRecord.BodyEncoding` of the gzip compressed
+// bodies.
+const bodyEncodingGzip = "gzip"
+
+// binaryCodecMagic prefixes the results encoded by `BinaryCodec`, and the
+// records it encoded before they were framed with their length.
+var binaryCodecMagic = []byte("IRB\x01")
+
+// binaryRecordMagic prefixes the records encoded by `BinaryCodec`. The
+// length of the record follows, so truncated records are detected.
+var binaryRecordMagic = []byte("IRB\x02")
+
+// ErrInvalidRecord is returned when decoding a malformed record.
+var ErrInvalidRecord = errors.New("invalid idempotency record encoding")
+
+// Codec encodes the records in the store.
+type Codec interface {
+	Marshal(reqRec ReqRecord) ([]byte, error)
+	Unmarshal(data []byte, reqRec *ReqRecord) error
+}
+
+// ResultCodec is implemented by the codecs encoding the results stored by
+// `SetIdempotentResult` as well; the results are encoded as JSON with the
+// other codecs.
+type ResultCodec interface {
+	MarshalResult(v interface{}) ([]byte, error)
+	UnmarshalResult(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes the records as JSON.
+type JSONCodec struct{}
+
+// Marshal implements `Codec`.
+func (JSONCodec) Marshal(reqRec ReqRecord) ([]byte, error) {
+	return json.Marshal(reqRec)
+}
+
+// Unmarshal implements `Codec`.
+func (JSONCodec) Unmarshal(data []byte, reqRec *ReqRecord) error {
+	return json.Unmarshal(data, reqRec)
+}
+
+// MarshalResult implements `ResultCodec`.
+func (JSONCodec) MarshalResult(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// UnmarshalResult implements `ResultCodec`.
+func (JSONCodec) UnmarshalResult(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// BinaryCodec encodes the records in a compact binary format storing the
+// bodies as is, without the base64 inflation of JSON, and the results with
+// encoding/gob. It decodes the JSON records and results as well, so it can
+// replace `JSONCodec` on a populated store.
+type BinaryCodec struct{}
+
+const (
+	binaryFlagDone = 1 << iota
+	binaryFlagBodyOmitted
+	binaryFlagBodyTruncated
+	binaryFlagLease
+	binaryFlagCompleted
+	binaryFlagRequestBodyTruncated
+)
+
+// Marshal implements `Codec`.
+func (BinaryCodec) Marshal(reqRec ReqRecord) ([]byte, error) {
+	w := &binaryWriter{}
+
+	var flags uint64
+	if reqRec.Done {
+		flags |= binaryFlagDone
+	}
+
+	if reqRec.BodyOmitted {
+		flags |= binaryFlagBodyOmitted
+	}
+
+	if reqRec.BodyTruncated {
+		flags |= binaryFlagBodyTruncated
+	}
+
+	if reqRec.LeaseExpiresAt != nil {
+		flags |= binaryFlagLease
+	}
+
+	if reqRec.CompletedAt != nil {
+		flags |= binaryFlagCompleted
+	}
+
+	if reqRec.RequestBodyTruncated {
+		flags |= binaryFlagRequestBodyTruncated
+	}
+
+	w.uvarint(flags)
+	w.uvarint(uint64(reqRec.ResponseCode))
+
+	w.headers(reqRec.ResponseHeaders)
+	w.bytes(reqRec.ResponseBody)
+	w.bytes([]byte(reqRec.BodyEncoding))
+	w.strings(reqRec.BodyChunks)
+	w.strings(reqRec.Groups)
+	w.bytes(reqRec.Result)
+	w.bytes([]byte(reqRec.Fingerprint))
+	w.bytes([]byte(reqRec.Owner))
+
+	if reqRec.LeaseExpiresAt != nil {
+		w.varint(reqRec.LeaseExpiresAt.UnixNano())
+	}
+
+	if reqRec.CompletedAt != nil {
+		w.varint(reqRec.CompletedAt.UnixNano())
+	}
+
+	// Fields added later follow; they are optional when decoding.
+	w.headers(reqRec.ResponseTrailers)
+	w.bytes([]byte(reqRec.Method))
+	w.bytes([]byte(reqRec.Path))
+	w.bytes([]byte(reqRec.Instance))
+
+	var receivedAt int64
+	if reqRec.ReceivedAt != nil {
+		receivedAt = reqRec.ReceivedAt.UnixNano()
+	}
+
+	w.varint(receivedAt)
+
+	w.headers(reqRec.RequestHeaders)
+	w.bytes(reqRec.RequestBody)
+	w.bytes([]byte(reqRec.RequestBodyDigest))
+	w.bytes([]byte(reqRec.ResponseBodyDigest))
+
+	framed := &binaryWriter{}
+	framed.buf.Grow(len(binaryRecordMagic) + binary.MaxVarintLen64 + w.buf.Len())
+	framed.buf.Write(binaryRecordMagic)
+	framed.bytes(w.buf.Bytes())
+
+	return framed.buf.Bytes(), nil
+}
+
+// Unmarshal implements `Codec`. The record is left as is when the data is
+// malformed.
+func (BinaryCodec) Unmarshal(data []byte, reqRec *ReqRecord) error {
+	var decoded ReqRecord
+	var err error
+
+	switch {
+	case bytes.HasPrefix(data, binaryRecordMagic):
+		err = decodeBinaryRecord(data[len(binaryRecordMagic):], &decoded, true)
+
+	case bytes.HasPrefix(data, binaryCodecMagic):
+		err = decodeBinaryRecord(data[len(binaryCodecMagic):], &decoded, false)
+
+	default:
+		err = json.Unmarshal(data, &decoded)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	*reqRec = decoded
+
+	return nil
+}
+
+// decodeBinaryRecord decodes the record encoded by `BinaryCodec`. The framed
+// records must have the length they were encoded with, and all the fields;
+// the fields added after the unframed records are optional in them. The
+// data following the fields, of the fields added later, is ignored.
+func decodeBinaryRecord(data []byte, reqRec *ReqRecord, framed bool) error {
+	r := &binaryReader{data: data}
+	if framed {
+		if n := r.uvarint(); r.err == nil && n != uint64(len(r.data)) {
+			return ErrInvalidRecord
+		}
+	}
+
+	flags := r.uvarint()
+	reqRec.Done = flags&binaryFlagDone != 0
+	reqRec.BodyOmitted = flags&binaryFlagBodyOmitted != 0
+	reqRec.BodyTruncated = flags&binaryFlagBodyTruncated != 0
+	reqRec.RequestBodyTruncated = flags&binaryFlagRequestBodyTruncated != 0
+	reqRec.ResponseCode = int(r.uvarint())
+
+	reqRec.ResponseHeaders = r.headers()
+	reqRec.ResponseBody = r.bytes()
+	reqRec.BodyEncoding = string(r.bytes())
+	reqRec.BodyChunks = r.strings()
+	reqRec.Groups = r.strings()
+	reqRec.Result = r.bytes()
+	reqRec.Fingerprint = string(r.bytes())
+	reqRec.Owner = string(r.bytes())
+
+	if flags&binaryFlagLease != 0 {
+		leaseExpiresAt := time.Unix(0, r.varint())
+		reqRec.LeaseExpiresAt = &leaseExpiresAt
+	}
+
+	if flags&binaryFlagCompleted != 0 {
+		completedAt := time.Unix(0, r.varint())
+		reqRec.CompletedAt = &completedAt
+	}
+
+	if framed || len(r.data) > 0 {
+		reqRec.ResponseTrailers = r.headers()
+	}
+
+	if framed || len(r.data) > 0 {
+		reqRec.Method = string(r.bytes())
+		reqRec.Path = string(r.bytes())
+		reqRec.Instance = string(r.bytes())
+
+		if nanos := r.varint(); nanos != 0 {
+			receivedAt := time.Unix(0, nanos)
+			reqRec.ReceivedAt = &receivedAt
+		}
+	}
+
+	if framed || len(r.data) > 0 {
+		reqRec.RequestHeaders = r.headers()
+		reqRec.RequestBody = r.bytes()
+		reqRec.RequestBodyDigest = string(r.bytes())
+		reqRec.ResponseBodyDigest = string(r.bytes())
+	}
+
+	return r.err
+}
+
+// MarshalResult implements `ResultCodec`.
+func (BinaryCodec) MarshalResult(v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(append([]byte{}, binaryCodecMagic...))
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalResult implements `ResultCodec`.
+func (BinaryCodec) UnmarshalResult(data []byte, v interface{}) error {
+	if !bytes.HasPrefix(data, binaryCodecMagic) {
+		return json.Unmarshal(data, v)
+	}
+
+	return gob.NewDecoder(bytes.NewReader(data[len(binaryCodecMagic):])).Decode(v)
+}
+
+type binaryWriter struct {
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	w.buf.Write(w.tmp[:binary.PutUvarint(w.tmp[:], v)])
+}
+
+func (w *binaryWriter) varint(v int64) {
+	w.buf.Write(w.tmp[:binary.PutVarint(w.tmp[:], v)])
+}
+
+func (w *binaryWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *binaryWriter) strings(values []string) {
+	w.uvarint(uint64(len(values)))
+	for _, v := range values {
+		w.bytes([]byte(v))
+	}
+}
+
+func (w *binaryWriter) headers(h map[string][]string) {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	w.uvarint(uint64(len(names)))
+	for _, k := range names {
+		w.bytes([]byte(k))
+		w.strings(h[k])
+	}
+}
+
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = ErrInvalidRecord
+
+		return 0
+	}
+
+	r.data = r.data[n:]
+
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = ErrInvalidRecord
+
+		return 0
+	}
+
+	r.data = r.data[n:]
+
+	return v
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil || n == 0 {
+		return nil
+	}
+
+	if n > uint64(len(r.data)) {
+		r.err = ErrInvalidRecord
+
+		return nil
+	}
+
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+
+	return b
+}
+
+func (r *binaryReader) strings() []string {
+	n := r.uvarint()
+	if r.err != nil || n == 0 {
+		return nil
+	}
+
+	if n > uint64(len(r.data)) {
+		r.err = ErrInvalidRecord
+
+		return nil
+	}
+
+	values := make([]string, 0, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		values = append(values, string(r.bytes()))
+	}
+
+	return values
+}
+
+func (r *binaryReader) headers() map[string][]string {
+	n := r.uvarint()
+	if r.err != nil || n == 0 {
+		return nil
+	}
+
+	h := make(map[string][]string)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		k := string(r.bytes())
+		h[k] = r.strings()
+	}
+
+	return h
+}
+
+// compressBody gzips the body of the record when it is larger than the
+// `CompressionThreshold`.
+func compressBody(config IdempotencyConfig, reqRec *ReqRecord) error {
+	if config.CompressionThreshold <= 0 || len(reqRec.ResponseBody) <= config.CompressionThreshold {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+
+	if _, err := zw.Write(reqRec.ResponseBody); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	reqRec.ResponseBody = buf.Bytes()
+	reqRec.BodyEncoding = bodyEncodingGzip
+
+	return nil
+}
+
+// decompressBody returns the decoded body.
+func decompressBody(encoding string, body []byte) ([]byte, error) {
+	if encoding != bodyEncodingGzip {
+		return body, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
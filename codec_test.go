@@ -0,0 +1,225 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// codecTestRecord has all the fields of the record set.
+func codecTestRecord() ReqRecord {
+	leaseExpiresAt := time.Unix(1650000000, 1).UTC()
+	completedAt := time.Unix(1650000001, 2).UTC()
+	receivedAt := time.Unix(1650000002, 3).UTC()
+
+	return ReqRecord{
+		Done:                 true,
+		ResponseCode:         201,
+		ResponseHeaders:      map[string][]string{"Content-Type": {"text/plain"}, "X-A": {"1", "2"}},
+		ResponseTrailers:     map[string][]string{"X-T": {"t"}},
+		ResponseBody:         []byte("body"),
+		BodyOmitted:          true,
+		BodyTruncated:        true,
+		BodyEncoding:         "gzip",
+		BodyChunks:           []string{"c1", "c2"},
+		Groups:               []string{"g"},
+		Result:               []byte("{}"),
+		Fingerprint:          "fp",
+		LeaseExpiresAt:       &leaseExpiresAt,
+		Owner:                "owner",
+		CompletedAt:          &completedAt,
+		Method:               "POST",
+		Path:                 "/orders",
+		ReceivedAt:           &receivedAt,
+		Instance:             "i1",
+		RequestHeaders:       map[string][]string{"Accept": {"*/*"}},
+		RequestBody:          []byte("req"),
+		RequestBodyDigest:    "rd",
+		RequestBodyTruncated: true,
+		ResponseBodyDigest:   "sd",
+	}
+}
+
+// codecGoldenRecord is the encoding of `codecTestRecord`. A change of it
+// breaks the records already stored.
+const codecGoldenRecord = "4952420290013fc901020c436f6e74656e742d54797065010a746578742f706c61696e03582d41020131013204626f647904677a697002026331026332010167027b7d026670056f776e65728280a8f6c090fde52d84a8feafc890fde52d0103582d5401017404504f5354072f6f726465727302693186d0d4e9cf90fde52d010641636365707401032a2f2a03726571027264027364"
+
+// codecGoldenLegacyRecord is the encoding of `codecTestRecord` before the
+// records were framed with their length.
+const codecGoldenLegacyRecord = "495242013fc901020c436f6e74656e742d54797065010a746578742f706c61696e03582d41020131013204626f647904677a697002026331026332010167027b7d026670056f776e65728280a8f6c090fde52d84a8feafc890fde52d0103582d5401017404504f5354072f6f726465727302693186d0d4e9cf90fde52d010641636365707401032a2f2a03726571027264027364"
+
+// equalRecords compares the records, ignoring the times' locations.
+func equalRecords(a, b ReqRecord) bool {
+	for _, times := range [][2]**time.Time{
+		{&a.LeaseExpiresAt, &b.LeaseExpiresAt},
+		{&a.CompletedAt, &b.CompletedAt},
+		{&a.ReceivedAt, &b.ReceivedAt},
+	} {
+		if (*times[0] == nil) != (*times[1] == nil) {
+			return false
+		}
+
+		if *times[0] != nil {
+			if !(*times[0]).Equal(**times[1]) {
+				return false
+			}
+
+			*times[0], *times[1] = nil, nil
+		}
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+	}{
+		{"uncompressed", 0},
+		{"compressed", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := codecTestRecord()
+			want.BodyEncoding = ""
+			want.ResponseBody = bytes.Repeat([]byte("body"), 64)
+
+			if err := compressBody(IdempotencyConfig{CompressionThreshold: tt.threshold}, &want); err != nil {
+				t.Fatal(err)
+			}
+
+			if compressed := want.BodyEncoding == bodyEncodingGzip; compressed != (tt.threshold > 0) {
+				t.Fatalf("body compressed: %v", compressed)
+			}
+
+			data, err := BinaryCodec{}.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got ReqRecord
+			if err := (BinaryCodec{}).Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !equalRecords(got, want) {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+
+			body, err := decompressBody(got.BodyEncoding, got.ResponseBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(body, bytes.Repeat([]byte("body"), 64)) {
+				t.Fatalf("got body %q", body)
+			}
+		})
+	}
+}
+
+func TestBinaryCodecZeroRecord(t *testing.T) {
+	data, err := BinaryCodec{}.Marshal(ReqRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := codecTestRecord()
+	if err := (BinaryCodec{}).Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, ReqRecord{}) {
+		t.Fatalf("got %+v, want the zero record", got)
+	}
+}
+
+func TestBinaryCodecMalformed(t *testing.T) {
+	data, err := BinaryCodec{}.Marshal(codecTestRecord())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A record cut anywhere, even between two fields, is malformed.
+	for n := len(binaryRecordMagic); n < len(data); n++ {
+		got := ReqRecord{Owner: "untouched"}
+		if err := (BinaryCodec{}).Unmarshal(data[:n], &got); err != ErrInvalidRecord {
+			t.Fatalf("record truncated to %d of %d bytes: got error %v, want ErrInvalidRecord", n, len(data), err)
+		}
+
+		if !reflect.DeepEqual(got, ReqRecord{Owner: "untouched"}) {
+			t.Fatalf("record truncated to %d bytes: decoded partially as %+v", n, got)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		garbage := make([]byte, rnd.Intn(256))
+		rnd.Read(garbage)
+
+		for _, magic := range [][]byte{binaryRecordMagic, nil} {
+			got := ReqRecord{Owner: "untouched"}
+			if err := (BinaryCodec{}).Unmarshal(append(append([]byte{}, magic...), garbage...), &got); err == nil {
+				continue
+			}
+
+			if !reflect.DeepEqual(got, ReqRecord{Owner: "untouched"}) {
+				t.Fatalf("garbage %x: decoded partially as %+v", garbage, got)
+			}
+		}
+	}
+
+	// The length prefix of the framed record must match.
+	got := ReqRecord{}
+	if err := (BinaryCodec{}).Unmarshal(append(append([]byte{}, data...), 0), &got); err != ErrInvalidRecord {
+		t.Fatalf("record with a trailing byte: got error %v, want ErrInvalidRecord", err)
+	}
+}
+
+func TestBinaryCodecGolden(t *testing.T) {
+	data, err := BinaryCodec{}.Marshal(codecTestRecord())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := hex.EncodeToString(data); got != codecGoldenRecord {
+		t.Fatalf("the encoding changed:\ngot  %s\nwant %s", got, codecGoldenRecord)
+	}
+
+	for _, golden := range []string{codecGoldenRecord, codecGoldenLegacyRecord} {
+		data, err := hex.DecodeString(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got ReqRecord
+		if err := (BinaryCodec{}).Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if !equalRecords(got, codecTestRecord()) {
+			t.Fatalf("decoding %s: got %+v", golden[:8], got)
+		}
+	}
+}
+
+func TestBinaryCodecDecodesJSON(t *testing.T) {
+	data, err := JSONCodec{}.Marshal(codecTestRecord())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got ReqRecord
+	if err := (BinaryCodec{}).Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalRecords(got, codecTestRecord()) {
+		t.Fatalf("got %+v", got)
+	}
+}
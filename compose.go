@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// With returns a middleware using the config of the manager overridden by
+// the non-zero fields of override, e.g. other methods, TTL or policies for a
+// route group. Boolean options can only be enabled by the override. The
+// middleware shares the store with the manager but has its own in-flight
+// limit. `Shutdown` of the manager shuts it down as well.
+//
+// The outermost Idempotency middleware handling a request wins; use
+// `ForGroup` to override the config of a group under the global middleware
+// of the manager.
+func (m *Manager) With(override IdempotencyConfig) echo.MiddlewareFunc {
+	return m.derive(override).Middleware()
+}
+
+// ForGroup overrides the config of the manager for the route group, like
+// `With`. The global middleware of the manager handles the requests of the
+// group with the overriding config, and the group uses it when the manager
+// isn't registered globally. The override of the innermost group wins.
+func (m *Manager) ForGroup(g *echo.Group, override IdempotencyConfig) {
+	derived := m.derive(override)
+
+	// The catch-all route `Group.Use` registers as well tells the prefix.
+	prefix := g.Any("", echo.NotFoundHandler)[0].Path
+
+	m.mu.Lock()
+	m.groups = append(m.groups, groupOverride{prefix: prefix, mw: derived.middleware()})
+	m.mu.Unlock()
+
+	g.Use(derived.Middleware())
+}
+
+// groupOverride is a route group overridden by `ForGroup`.
+type groupOverride struct {
+	prefix string
+	mw     echo.MiddlewareFunc
+}
+
+// derive returns a manager of the overridden config, shut down along with m.
+func (m *Manager) derive(override IdempotencyConfig) *Manager {
+	derived := NewManager(mergeConfig(m.base, override))
+
+	m.mu.Lock()
+	m.derived = append(m.derived, derived)
+	m.mu.Unlock()
+
+	return derived
+}
+
+// groupMiddleware returns the middleware of the innermost group overridden
+// by `ForGroup` the route path belongs to, or nil.
+func (m *Manager) groupMiddleware(path string) echo.MiddlewareFunc {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var match *groupOverride
+	for i, g := range m.groups {
+		if path != g.prefix && !strings.HasPrefix(path, strings.TrimSuffix(g.prefix, "/")+"/") {
+			continue
+		}
+
+		if match == nil || len(g.prefix) > len(match.prefix) {
+			match = &m.groups[i]
+		}
+	}
+
+	if match == nil {
+		return nil
+	}
+
+	return match.mw
+}
+
+// mergeConfig returns the base config with the non-zero fields of override.
+func mergeConfig(base, override IdempotencyConfig) IdempotencyConfig {
+	merged := reflect.ValueOf(&base).Elem()
+	fields := reflect.ValueOf(override)
+
+	for i := 0; i < fields.NumField(); i++ {
+		if f := fields.Field(i); !f.IsZero() {
+			merged.Field(i).Set(f)
+		}
+	}
+
+	// A key lookup derived from the base KeyLookup doesn't apply to the
+	// overriding one.
+	if override.KeyLookup != "" && override.KeyLookupFunc == nil {
+		base.KeyLookupFunc = nil
+	}
+
+	return base
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestForGroupUnderGlobalMiddleware(t *testing.T) {
+	store := NewMemoryStore(0)
+	m := NewManager(IdempotencyConfig{Store: store, DisableScope: true, MaxWait: 2 * time.Second})
+
+	e := echo.New()
+	e.Use(m.Middleware())
+
+	g := e.Group("/g")
+	m.ForGroup(g, IdempotencyConfig{Methods: []string{http.MethodPost, http.MethodPut}, TTL: time.Hour})
+
+	var executions int32
+	h := func(c echo.Context) error {
+		atomic.AddInt32(&executions, 1)
+
+		return c.String(http.StatusCreated, "created")
+	}
+
+	g.POST("/x", h)
+	g.PUT("/x", h)
+
+	send := func(method, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/g/x", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", key)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		atomic.StoreInt32(&executions, 0)
+
+		for i := 0; i < 2; i++ {
+			if rec := send(method, method); rec.Code != http.StatusCreated || rec.Body.String() != "created" {
+				t.Fatalf("%s #%d: got status %d, body %q", method, i, rec.Code, rec.Body.String())
+			}
+		}
+
+		if n := atomic.LoadInt32(&executions); n != 1 {
+			t.Fatalf("%s: handler executed %d times, want 1", method, n)
+		}
+
+		// The TTL of the group applies, not the one of the global middleware.
+		if ttl, err := store.TTL(context.Background(), m.config.recordKey(method)); err != nil || ttl > time.Hour {
+			t.Fatalf("%s: got record TTL %v, %v, want at most an hour", method, ttl, err)
+		}
+	}
+}
+
+func TestShutdownDerivedManagers(t *testing.T) {
+	store := NewMemoryStore(0)
+	m := NewManager(IdempotencyConfig{Store: store, DisableScope: true})
+
+	e := echo.New()
+	g := e.Group("/g")
+	m.ForGroup(g, IdempotencyConfig{AsyncPersistence: true})
+	g.POST("/x", func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	})
+
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/g/x", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", key)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := send("a"); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want 201", rec.Code)
+	}
+
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The background write of the group's manager completed.
+	if reqRec, err := m.Lookup(context.Background(), "a"); err != nil || !reqRec.Done {
+		t.Fatalf("record after Shutdown: got %+v, %v, want a completed one", reqRec, err)
+	}
+
+	if rec := send("b"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("request after Shutdown: got status %d, want 503", rec.Code)
+	}
+}
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// stateContextKey is the echo context key of the per-request state.
+const stateContextKey = "echo-idempotency.state"
+
+// ErrNotClaimed is returned by the handler APIs when the request didn't claim
+// an idempotency record, e.g. because it had no key or it is a replay.
+var ErrNotClaimed = errors.New("request has not claimed an idempotency record")
+
+// requestState is the state of a request that claimed an idempotency record.
+type requestState struct {
+	// mu guards placeholder and claimedKeys while the handler runs, as the
+	// heartbeat renews them and `Shutdown` abandons them, and writer, which
+	// is detached before its buffer is recycled.
+	mu sync.Mutex
+
+	config      IdempotencyConfig
+	reqKey      string
+	owner       string
+	scope       string
+	placeholder []byte
+	ttl         time.Duration
+	expires     time.Time
+	extended    time.Time
+	claimedKeys []string
+	groups      []string
+	result      []byte
+	writer      *bodyDumpResponseWriter
+}
+
+func stateFromContext(c echo.Context) (*requestState, error) {
+	state, ok := c.Get(stateContextKey).(*requestState)
+	if !ok {
+		return nil, ErrNotClaimed
+	}
+
+	return state, nil
+}
+
+// ExtendTTL lengthens the retention of the idempotency record claimed by the
+// request so it expires no earlier than `d` from now. It is meant for
+// handlers that kick off long running asynchronous workflows.
+func ExtendTTL(c echo.Context, d time.Duration) error {
+	state, err := stateFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	keys := []string{state.reqKey}
+	keys = append(keys, state.claimedKeys...)
+	for _, g := range state.groups {
+		keys = append(keys, state.config.groupKey(g))
+	}
+
+	for _, k := range keys {
+		if err := extendTTL(ctx, state.config.Store, k, d); err != nil {
+			return err
+		}
+	}
+
+	// The final write keeps the extension, see `RefreshTTLOnCompletion`.
+	if until := time.Now().Add(d); until.After(state.extended) {
+		state.extended = until
+	}
+
+	return nil
+}
+
+// extendTTL sets the TTL of the key to `d` unless it already expires later.
+// Keys that don't expire get the TTL.
+func extendTTL(ctx context.Context, store Store, key string, d time.Duration) error {
+	var err error
+	if extender, ok := store.(TTLExtender); ok {
+		err = extender.ExtendTTL(ctx, key, d)
+	} else {
+		err = expireLater(ctx, store, key, d)
+	}
+
+	if errors.Is(err, ErrNotFound) {
+		return ErrRecordLost
+	}
+
+	return err
+}
+
+// expireLater implements `TTLExtender.ExtendTTL` with `Store.TTL` and
+// `Store.Expire`, for the stores not implementing it.
+func expireLater(ctx context.Context, store Store, key string, d time.Duration) error {
+	ttl, err := store.TTL(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if ttl >= d {
+		return nil
+	}
+
+	return store.Expire(ctx, key, d)
+}
+
+// remainingTTL returns the TTL the final record must be stored with to keep
+// the expiration of the placeholder: its remaining TTL as of the claim and
+// the extensions of the request, or the TTL of the request when the
+// placeholder expired meanwhile, so the final write needs no TTL read.
+func (state *requestState) remainingTTL() time.Duration {
+	expires := state.expires
+	if state.extended.After(expires) {
+		expires = state.extended
+	}
+
+	if remaining := time.Until(expires); remaining >= time.Millisecond {
+		return remaining
+	}
+
+	return state.ttl
+}
+
+// ClaimKeys atomically claims additional idempotency keys for the request,
+// for endpoints performing several child operations each with its own key.
+// Either all keys are claimed or none of them; it returns false when any of
+// them is already in use. Keys held by abandoned records, e.g. of a crashed
+// request, are taken over. Claimed keys store the same record as the request
+// and share its scope and lease: the heartbeat renews them and releasing or
+// abandoning the record releases them. On a Redis Cluster, the keys must
+// share a slot, e.g. by containing the same hash tag; it returns a
+// `*ConfigError` with `HashTags`, which gives each key its own tag.
+func ClaimKeys(c echo.Context, keys ...string) (bool, error) {
+	state, err := stateFromContext(c)
+	if err != nil {
+		return false, err
+	}
+
+	if state.config.HashTags {
+		return false, &ConfigError{Field: "HashTags", Reason: "ClaimKeys can't claim keys with hash tags of their own"}
+	}
+
+	if len(keys) == 0 {
+		return true, nil
+	}
+
+	reqKeys := make([]string, len(keys))
+	for i, k := range keys {
+		reqKeys[i] = state.config.recordKey(ScopedKey(state.scope, k))
+	}
+
+	ctx := c.Request().Context()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	claimed, err := state.config.Store.SetNXMulti(ctx, reqKeys, state.placeholder, state.ttl)
+	if err == nil && !claimed {
+		claimed, err = takeOverKeys(ctx, state.config, reqKeys, state.placeholder, state.ttl)
+	}
+
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	if err := tagGroups(ctx, state.config, state.groups, reqKeys, state.ttl); err != nil {
+		return false, err
+	}
+
+	state.claimedKeys = append(state.claimedKeys, reqKeys...)
+
+	return true, nil
+}
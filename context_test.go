@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// crashingStore fails the writes once crashed, like the store of a process
+// that died: the leases of its records aren't renewed anymore.
+type crashingStore struct {
+	Store
+	crashed int32
+}
+
+func (s *crashingStore) CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error) {
+	if atomic.LoadInt32(&s.crashed) == 1 {
+		return false, errors.New("crashed")
+	}
+
+	return s.Store.CompareAndSwap(ctx, key, old, new, ttl)
+}
+
+func newClaimEcho(t *testing.T, store Store, h echo.HandlerFunc) *echo.Echo {
+	t.Helper()
+
+	mw, err := IdempotencyConfig{Store: store, LeaseTTL: 60 * time.Millisecond, MaxWait: 2 * time.Second, WaitPollInterval: 10 * time.Millisecond}.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(mw)
+	e.POST("/", h)
+
+	return e
+}
+
+func sendClaim(e *echo.Echo, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", key)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestClaimKeysLease(t *testing.T) {
+	store := NewMemoryStore(0)
+
+	e := newClaimEcho(t, store, func(c echo.Context) error {
+		if ok, err := ClaimKeys(c, "child"); err != nil || !ok {
+			t.Errorf("ClaimKeys: got %v, %v, want true", ok, err)
+		}
+
+		// Outlive the lease; the heartbeat renews the claimed key.
+		time.Sleep(200 * time.Millisecond)
+
+		state, err := stateFromContext(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reqData, err := store.Get(c.Request().Context(), state.claimedKeys[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reqRec := ReqRecord{}
+		if err := (JSONCodec{}).Unmarshal(reqData, &reqRec); err != nil {
+			t.Fatal(err)
+		}
+
+		if reqRec.Owner == "" || reqRec.abandoned(time.Now()) {
+			t.Errorf("claimed key holds %+v, want a placeholder with a live lease", reqRec)
+		}
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	if rec := sendClaim(e, "parent"); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want 201", rec.Code)
+	}
+}
+
+func TestClaimKeysTakeover(t *testing.T) {
+	crashing := &crashingStore{Store: NewMemoryStore(0)}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	crashed := newClaimEcho(t, crashing, func(c echo.Context) error {
+		if ok, err := ClaimKeys(c, "child-a", "child-b"); err != nil || !ok {
+			t.Errorf("ClaimKeys: got %v, %v, want true", ok, err)
+		}
+
+		atomic.StoreInt32(&crashing.crashed, 1)
+		<-stop
+
+		return nil
+	})
+
+	go sendClaim(crashed, "parent")
+
+	for atomic.LoadInt32(&crashing.crashed) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The retry of the request takes over the record and the child keys
+	// of the crashed one, once its lease expired.
+	e := newClaimEcho(t, crashing.Store, func(c echo.Context) error {
+		if ok, err := ClaimKeys(c, "child-a", "child-b"); err != nil || !ok {
+			t.Errorf("ClaimKeys after takeover: got %v, %v, want true", ok, err)
+		}
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	if rec := sendClaim(e, "parent"); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want 201", rec.Code)
+	}
+
+	if rec := sendClaim(e, "child-a"); rec.Code != http.StatusCreated || rec.Body.String() != "created" {
+		t.Fatalf("replay of a child key: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestExtendTTLWithRefreshOnCompletion(t *testing.T) {
+	store := NewMemoryStore(0)
+
+	var reqKey string
+
+	mw, err := IdempotencyConfig{Store: store, TTL: time.Minute, RefreshTTLOnCompletion: true}.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(mw)
+	e.POST("/", func(c echo.Context) error {
+		if err := ExtendTTL(c, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+
+		state, err := stateFromContext(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reqKey = state.reqKey
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	if rec := sendClaim(e, "key"); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want 201", rec.Code)
+	}
+
+	ttl, err := store.TTL(context.Background(), reqKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl <= time.Minute {
+		t.Fatalf("record TTL %v, want the extension to an hour", ttl)
+	}
+}
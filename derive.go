@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ContentKey returns a `KeyExtractor` deriving the key from a hash of the
+// method, the path, the canonicalized body and the given headers of the
+// request. JSON bodies are canonicalized, so their formatting and the order
+// of their object keys don't change the key.
+func ContentKey(headers ...string) KeyExtractor {
+	return contentKey(DefaultIdempotencyConfig.MaxKeyBodySize, headers)
+}
+
+// contentKey returns the `ContentKey` extractor buffering up to limit bytes
+// of the body.
+func contentKey(limit int64, headers []string) KeyExtractor {
+	return func(c echo.Context) (string, bool, error) {
+		req := c.Request()
+
+		body, err := bufferRequestBodyLimit(req, limit)
+		if err != nil {
+			return "", false, err
+		}
+
+		h := sha256.New()
+		h.Write([]byte(req.Method))
+		h.Write([]byte{'\n'})
+		h.Write([]byte(req.URL.Path))
+		h.Write([]byte{'\n'})
+
+		for _, name := range headers {
+			h.Write([]byte(http.CanonicalHeaderKey(name)))
+			h.Write([]byte{':'})
+			h.Write([]byte(req.Header.Get(name)))
+			h.Write([]byte{'\n'})
+		}
+
+		h.Write(canonicalBody(body))
+
+		return "content:" + hex.EncodeToString(h.Sum(nil)), true, nil
+	}
+}
+
+// canonicalBody returns the JSON bodies re-encoded with sorted object keys
+// and no insignificant whitespace, and the other bodies as is.
+func canonicalBody(body []byte) []byte {
+	if !json.Valid(body) {
+		return body
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return body
+	}
+
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+
+	return canonical
+}
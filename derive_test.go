@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestDeriveKeyFromContent(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DeriveKeyFromContent: true, DeriveKeyHeaders: []string{"X-Tenant"}})
+
+	executed := 0
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		executed++
+
+		// The body is restored for the handler.
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+
+		return c.Blob(http.StatusCreated, echo.MIMEApplicationJSON, body)
+	})
+
+	send := func(tenant, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("X-Tenant", tenant)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := send("acme", `{"a": 1, "b": [1, 2]}`); rec.Code != http.StatusCreated || rec.Body.String() != `{"a": 1, "b": [1, 2]}` {
+		t.Fatalf("first request: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	// The formatting and the order of the object keys don't matter.
+	rec := send("acme", `{"b":[1,2],"a":1}`)
+	if rec.Header().Get("Idempotency-Replayed") != "true" || rec.Body.String() != `{"a": 1, "b": [1, 2]}` {
+		t.Fatalf("equivalent body: got headers %v, body %q, want the replay", rec.Header(), rec.Body.String())
+	}
+
+	send("acme", `{"a":2,"b":[1,2]}`)
+	send("other", `{"a":1,"b":[1,2]}`)
+
+	if executed != 3 {
+		t.Fatalf("handler executed %d times, want 3", executed)
+	}
+}
+
+func TestDeriveKeyExplicitKey(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DeriveKeyFromContent: true})
+
+	executed := 0
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		executed++
+
+		info, _ := FromContext(c)
+
+		return c.String(http.StatusCreated, info.Key)
+	})
+
+	// An explicit key takes precedence over the content.
+	for _, key := range []string{"first", "second"} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", key)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if rec.Body.String() != key {
+			t.Fatalf("got key %q, want %q", rec.Body.String(), key)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body")))
+
+	if !strings.HasPrefix(rec.Body.String(), "content:") || executed != 3 {
+		t.Fatalf("got key %q after %d executions, want a derived key", rec.Body.String(), executed)
+	}
+}
+
+func TestContentKey(t *testing.T) {
+	e := echo.New()
+
+	key := func(method, path, body string) string {
+		c := e.NewContext(httptest.NewRequest(method, path, strings.NewReader(body)), httptest.NewRecorder())
+
+		key, found, err := ContentKey()(c)
+		if err != nil || !found {
+			t.Fatalf("got %q, %v, %v", key, found, err)
+		}
+
+		return key
+	}
+
+	if key(http.MethodPost, "/a", "body") == key(http.MethodPost, "/b", "body") {
+		t.Fatal("the path isn't part of the key")
+	}
+
+	if key(http.MethodPost, "/a", "body") == key(http.MethodPut, "/a", "body") {
+		t.Fatal("the method isn't part of the key")
+	}
+
+	if key(http.MethodPost, "/a", `{"x":1.0}`) == key(http.MethodPost, "/a", `{"x":1}`) {
+		t.Fatal("the number literals 1.0 and 1 got the same key")
+	}
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"context"
+	"time"
+)
+
+// detachedContext carries the values of its parent, e.g. its span, without
+// its deadline and cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// writeContext returns the context of the store writes completing the record
+// of the request, detached from the request and bounded by `WriteTimeout`.
+func writeContext(ctx context.Context, config IdempotencyConfig) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{parent: ctx}, config.WriteTimeout)
+}
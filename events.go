@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"time"
+)
+
+// EventType is the type of an `Event`.
+type EventType int
+
+const (
+	// EventClaimed is emitted when a request claims a key.
+	EventClaimed EventType = iota + 1
+
+	// EventCompleted is emitted when the record of a claimed key is stored.
+	EventCompleted
+
+	// EventReplayed is emitted when a stored response is replayed.
+	EventReplayed
+
+	// EventConflict is emitted when a request is rejected since a concurrent
+	// request holds the key.
+	EventConflict
+
+	// EventExpired is emitted when a record disappeared before completion.
+	EventExpired
+
+	// EventStoreError is emitted when reading or writing a record fails.
+	EventStoreError
+
+	// EventKeyExtracted is emitted when a request carries an idempotency key.
+	EventKeyExtracted
+
+	// EventWaitStarted is emitted when a request starts waiting for a
+	// concurrent request holding the key.
+	EventWaitStarted
+
+	// EventWaitFinished is emitted when a request stops waiting, with the
+	// wait duration.
+	EventWaitFinished
+
+	// EventFingerprintMismatch is emitted when a key is reused with a
+	// different request.
+	EventFingerprintMismatch
+)
+
+var eventTypeNames = map[EventType]string{
+	EventClaimed:    "claimed",
+	EventCompleted:  "completed",
+	EventReplayed:   "replayed",
+	EventConflict:   "conflict",
+	EventExpired:    "expired",
+	EventStoreError: "store_error",
+
+	EventKeyExtracted:        "key_extracted",
+	EventWaitStarted:         "wait_started",
+	EventWaitFinished:        "wait_finished",
+	EventFingerprintMismatch: "fingerprint_mismatch",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// Event describes an activity of the middleware.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Key is the idempotency key of the request.
+	Key string
+
+	// Status is the response status of the completed or replayed record.
+	Status int
+
+	// Err is the error of the expired and store error events.
+	Err error
+
+	// Duration is the handler duration of the completed events and the wait
+	// duration of the wait finished events.
+	Duration time.Duration
+}
+
+// EventChannel returns an `OnEvent` callback that sends the events to the
+// buffered channel. Events are dropped when the channel is full, so a slow
+// consumer never blocks the requests.
+func EventChannel(ch chan<- Event) func(Event) {
+	return func(e Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Events returns an `OnEvent` callback that passes the events to all of the
+// callbacks, e.g. to both `EventChannel` and `Metrics.Observe`.
+func Events(callbacks ...func(Event)) func(Event) {
+	return func(e Event) {
+		for _, fn := range callbacks {
+			fn(e)
+		}
+	}
+}
+
+func (config IdempotencyConfig) emit(t EventType, key string, status int, err error) {
+	config.observe(Event{Type: t, Key: key, Status: status, Err: err})
+}
+
+func (config IdempotencyConfig) observe(e Event) {
+	if config.OnEvent == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	config.OnEvent(e)
+}
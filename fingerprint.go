@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// ErrFingerprintMismatch is the internal error of the default
+	// `FingerprintMismatchError`.
+	ErrFingerprintMismatch = errors.New("idempotency key reused with a different request")
+
+	// ErrRequestBodyTooLarge is the internal error of the responses sent
+	// when the body to extract the key from, or to fingerprint, exceeds
+	// `MaxKeyBodySize`.
+	ErrRequestBodyTooLarge = errors.New("request body too large to extract the idempotency key")
+)
+
+// RequestFingerprint hashes the method, the path and the body of the request;
+// the body is restored for the handler. It is the default `FingerprintFunc`
+// with the default `MaxKeyBodySize`: bodies larger than that are hashed on
+// their way to a temporary file the handler reads them back from, instead of
+// being kept in memory.
+func RequestFingerprint(c echo.Context) (string, error) {
+	return requestFingerprint(defaultMaxKeyBodySize)(c)
+}
+
+// defaultMaxKeyBodySize is the default `MaxKeyBodySize`.
+const defaultMaxKeyBodySize = 10 << 20
+
+// requestFingerprint returns the `RequestFingerprint` func keeping up to
+// limit bytes of the body in memory.
+func requestFingerprint(limit int64) func(echo.Context) (string, error) {
+	return func(c echo.Context) (string, error) {
+		req := c.Request()
+
+		bodySum, err := hashRequestBody(req, limit)
+		if err != nil {
+			return "", err
+		}
+
+		h := sha256.New()
+		h.Write([]byte(req.Method))
+		h.Write([]byte{'\n'})
+		h.Write([]byte(req.URL.Path))
+		h.Write([]byte{'\n'})
+		h.Write(bodySum)
+
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+}
+
+// hashRequestBody returns the SHA-256 sum of the body of the request and
+// restores the body for the handler. Up to limit bytes are kept in memory,
+// the rest is spooled to a temporary file; a non-positive limit keeps the
+// whole body in memory.
+func hashRequestBody(req *http.Request, limit int64) ([]byte, error) {
+	h := sha256.New()
+
+	if limit <= 0 || req.Body == nil || req.Body == http.NoBody {
+		body, err := bufferRequestBody(req)
+		if err != nil {
+			return nil, err
+		}
+
+		h.Write(body)
+
+		return h.Sum(nil), nil
+	}
+
+	head := new(bytes.Buffer)
+	n, err := io.Copy(io.MultiWriter(h, head), io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if n <= limit {
+		req.Body.Close()
+		req.Body = io.NopCloser(head)
+
+		return h.Sum(nil), nil
+	}
+
+	f, err := os.CreateTemp("", "echo-idempotency-body-")
+	if err != nil {
+		return nil, err
+	}
+
+	spooled := &spooledBody{Reader: io.MultiReader(head, f), file: f}
+
+	if _, err := io.Copy(io.MultiWriter(h, f), req.Body); err != nil {
+		spooled.Close()
+
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+
+		return nil, err
+	}
+
+	req.Body.Close()
+	req.Body = spooled
+
+	return h.Sum(nil), nil
+}
+
+// spooledBody is a request body restored from memory and a temporary file,
+// which is removed once the body is closed.
+type spooledBody struct {
+	io.Reader
+	file *os.File
+	once sync.Once
+}
+
+func (b *spooledBody) Close() error {
+	var err error
+	b.once.Do(func() {
+		err = b.file.Close()
+		os.Remove(b.file.Name())
+	})
+
+	return err
+}
+
+// bufferRequestBody reads the body of the request and restores it for the
+// handler.
+func bufferRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return []byte{}, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// bufferRequestBodyLimit is `bufferRequestBody` reading at most limit bytes;
+// a non-positive limit disables it. Larger bodies are restored unread for
+// the handler and get 413 Request Entity Too Large.
+func bufferRequestBodyLimit(req *http.Request, limit int64) ([]byte, error) {
+	body, truncated, err := bufferRequestBodyPrefix(req, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if truncated {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge).SetInternal(ErrRequestBodyTooLarge)
+	}
+
+	return body, nil
+}
+
+// bufferRequestBodyPrefix is `bufferRequestBody` reading at most limit
+// bytes; a non-positive limit disables it. Larger bodies are restored for
+// the handler, and their first limit bytes are returned truncated.
+func bufferRequestBodyPrefix(req *http.Request, limit int64) ([]byte, bool, error) {
+	if limit <= 0 {
+		body, err := bufferRequestBody(req)
+
+		return body, false, err
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return []byte{}, false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(body)) > limit {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+
+		return body[:limit], true, nil
+	}
+
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, false, nil
+}
+
+// readCloser reads the restored body and closes the original one.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// formValue returns the value of the form field parsed from a copy of the
+// body, leaving the body and the form of the request untouched.
+func formValue(req *http.Request, param string, limit int64) (string, error) {
+	body, err := bufferRequestBodyLimit(req, limit)
+	if err != nil {
+		return "", err
+	}
+
+	form := req.Clone(req.Context())
+	form.Body = io.NopCloser(bytes.NewReader(body))
+	form.Form, form.PostForm, form.MultipartForm = nil, nil, nil
+
+	value := form.FormValue(param)
+	if form.MultipartForm != nil {
+		_ = form.MultipartForm.RemoveAll()
+	}
+
+	return value, nil
+}
+
+// fingerprintMatches reports whether the replayed record belongs to a
+// request with the same fingerprint. Records stored without a fingerprint
+// match any request.
+func fingerprintMatches(reqRec ReqRecord, fingerprint string) bool {
+	return reqRec.Fingerprint == "" || fingerprint == "" || reqRec.Fingerprint == fingerprint
+}
@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestFingerprintBodyLimit(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	h, err := IdempotencyConfig{Store: NewMemoryStore(0), MaxKeyBodySize: 8}.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(h)
+	e.POST("/", func(c echo.Context) error {
+		body, err := bufferRequestBody(c.Request())
+		if err != nil {
+			return err
+		}
+
+		return c.Blob(http.StatusCreated, echo.MIMEOctetStream, body)
+	})
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("X-Idempotency-Key", key)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := send("small", "12345678"); rec.Code != http.StatusCreated || rec.Body.String() != "12345678" {
+		t.Fatalf("body within the limit: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	if rec := send("large", "123456789"); rec.Code != http.StatusCreated || rec.Body.String() != "123456789" {
+		t.Fatalf("body over the limit: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	if rec := send("large", "123456789"); rec.Code != http.StatusCreated || rec.Header().Get("Idempotency-Replayed") != "true" {
+		t.Fatalf("replay of a body over the limit: got status %d, headers %v", rec.Code, rec.Header())
+	}
+
+	// The part of the body past the limit is fingerprinted as well.
+	if rec := send("large", "123456780"); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("different body over the limit: got status %d, want 422", rec.Code)
+	}
+
+	if files, _ := os.ReadDir(tmp); len(files) != 0 {
+		t.Fatalf("got %d spooled bodies left behind, want 0", len(files))
+	}
+}
+
+func TestFingerprintDefaultConfigLimit(t *testing.T) {
+	config := DefaultIdempotencyConfig
+	config.Store = NewMemoryStore(0)
+	config.MaxKeyBodySize = 8
+
+	h, err := config.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(h)
+	e.POST("/", func(c echo.Context) error {
+		// Only the first MaxKeyBodySize bytes are kept in memory.
+		if _, spooled := c.Request().Body.(*spooledBody); !spooled {
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		return c.NoContent(http.StatusCreated)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("123456789"))
+	req.Header.Set("X-Idempotency-Key", "key")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want the body past MaxKeyBodySize spooled", rec.Code)
+	}
+}
+
+func TestFormKey(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DisableScope: true, KeyLookup: "form:idempotency_key", MaxKeyBodySize: 1024})
+
+	executed := 0
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		executed++
+
+		// The handler still reads the form from the body.
+		name := c.FormValue("name")
+		if file, err := c.FormFile("file"); err == nil {
+			name += "+" + file.Filename
+		}
+
+		return c.String(http.StatusCreated, name)
+	})
+
+	send := func(contentType string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", body)
+		req.Header.Set(echo.HeaderContentType, contentType)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	form := url.Values{"idempotency_key": {"form"}, "name": {"order"}}.Encode()
+
+	if rec := send(echo.MIMEApplicationForm, strings.NewReader(form)); rec.Code != http.StatusCreated || rec.Body.String() != "order" {
+		t.Fatalf("form: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	if rec := send(echo.MIMEApplicationForm, strings.NewReader(form)); rec.Header().Get("Idempotency-Replayed") != "true" {
+		t.Fatalf("form: got headers %v, want a replay", rec.Header())
+	}
+
+	multipartBody := func() (string, io.Reader) {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+
+		// The boundary is part of the fingerprint.
+		_ = mw.SetBoundary("boundary")
+		_ = mw.WriteField("idempotency_key", "multipart")
+		_ = mw.WriteField("name", "upload")
+		fw, _ := mw.CreateFormFile("file", "a.txt")
+		_, _ = fw.Write([]byte("content"))
+		_ = mw.Close()
+
+		return mw.FormDataContentType(), body
+	}
+
+	if rec := send(multipartBody()); rec.Code != http.StatusCreated || rec.Body.String() != "upload+a.txt" {
+		t.Fatalf("multipart: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	if rec := send(multipartBody()); rec.Header().Get("Idempotency-Replayed") != "true" {
+		t.Fatalf("multipart: got headers %v, want a replay", rec.Header())
+	}
+
+	large := url.Values{"idempotency_key": {"large"}, "name": {strings.Repeat("n", 1024)}}.Encode()
+	if rec := send(echo.MIMEApplicationForm, strings.NewReader(large)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("form over MaxKeyBodySize: got status %d, want 413", rec.Code)
+	}
+
+	if executed != 2 {
+		t.Fatalf("handler executed %d times, want 2", executed)
+	}
+}
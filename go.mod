@@ -1,15 +1,10 @@
 module github.com/mgurevin/echo-idempotency
 
-go 1.17
+go 1.18
 
-require (
-	github.com/go-redis/redis/v8 v8.11.5
-	github.com/labstack/echo/v4 v4.7.2
-)
+require github.com/labstack/echo/v4 v4.7.2
 
 require (
-	github.com/cespare/xxhash/v2 v2.1.2 // indirect
-	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
 	github.com/labstack/gommon v0.3.1 // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// groupKey returns the store key of the set holding the record keys of the group.
+func (config IdempotencyConfig) groupKey(group string) string {
+	return config.KeyPrefix + "grp::" + group
+}
+
+// TagGroup tags the idempotency record claimed by the request with the given
+// group labels (e.g. an order ID), so all records of a group can be dropped
+// at once with `InvalidateGroup`.
+func TagGroup(c echo.Context, groups ...string) error {
+	state, err := stateFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	keys := append([]string{state.reqKey}, state.claimedKeys...)
+	if err := tagGroups(c.Request().Context(), state.config, groups, keys, state.ttl); err != nil {
+		return err
+	}
+
+	state.groups = append(state.groups, groups...)
+
+	return nil
+}
+
+// InvalidateGroup deletes all idempotency records tagged with the group by a
+// middleware configured without `KeyPrefix` and `Codec`; see
+// `Manager.InvalidateGroup` otherwise.
+func InvalidateGroup(ctx context.Context, store Store, group string) error {
+	return invalidateGroup(ctx, store, DefaultIdempotencyConfig.Codec, IdempotencyConfig{}.groupKey(group))
+}
+
+func invalidateGroup(ctx context.Context, store Store, codec Codec, grpKey string) error {
+	reqKeys, err := store.Members(ctx, grpKey)
+	if err != nil {
+		return err
+	}
+
+	keys, err := withChunks(ctx, store, codec, reqKeys...)
+	if err != nil {
+		return err
+	}
+
+	return store.Delete(ctx, append(keys, grpKey)...)
+}
+
+// tagGroups adds the record keys to the sets of the groups and makes sure the
+// sets live at least as long as the records.
+func tagGroups(ctx context.Context, config IdempotencyConfig, groups, keys []string, ttl time.Duration) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for _, g := range groups {
+		grpKey := config.groupKey(g)
+
+		if err := config.Store.AddMembers(ctx, grpKey, keys...); err != nil {
+			return err
+		}
+
+		if err := extendTTL(ctx, config.Store, grpKey, ttl); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrTooManyInFlight is the internal error of the responses sent when no
+// in-flight slot is available, see `MaxInFlight`.
+var ErrTooManyInFlight = errors.New("too many idempotent requests in-flight")
+
+// acquireInFlight takes a slot of the in-flight executions of the instance,
+// waiting up to `InFlightQueueTimeout` for one. It responds 503 Service
+// Unavailable when no slot is available in time. The returned func releases
+// the slot and is safe to call more than once.
+func (m *Manager) acquireInFlight(c echo.Context) (func(), error) {
+	if m.inFlight == nil {
+		return func() {}, nil
+	}
+
+	var once sync.Once
+	release := func() { once.Do(func() { <-m.inFlight }) }
+
+	select {
+	case m.inFlight <- struct{}{}:
+		return release, nil
+
+	default:
+	}
+
+	if m.config.InFlightQueueTimeout <= 0 {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable).SetInternal(ErrTooManyInFlight)
+	}
+
+	timer := time.NewTimer(m.config.InFlightQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case m.inFlight <- struct{}{}:
+		return release, nil
+
+	case <-timer.C:
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable).SetInternal(ErrTooManyInFlight)
+
+	case <-c.Request().Context().Done():
+		return nil, c.Request().Context().Err()
+	}
+}
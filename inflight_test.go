@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestTakeoverWithoutInFlightSlot(t *testing.T) {
+	store := NewMemoryStore(0)
+	m := NewManager(IdempotencyConfig{Store: store, DisableScope: true, MaxInFlight: 1, WaitPollInterval: 10 * time.Millisecond})
+
+	// The record is abandoned while the request waits for it.
+	abandonedAt := time.Now().Add(200 * time.Millisecond)
+
+	abandoned, err := m.config.Codec.Marshal(ReqRecord{LeaseExpiresAt: &abandonedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqKey := m.config.recordKey("abandoned")
+	if err := store.Set(context.Background(), reqKey, abandoned, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	started, finish := make(chan struct{}), make(chan struct{})
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		if c.Request().Header.Get("X-Idempotency-Key") == "busy" {
+			close(started)
+			<-finish
+		}
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	send := func(key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", key)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	waited := make(chan int)
+	go func() {
+		waited <- send("abandoned")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		send("busy")
+	}()
+
+	<-started
+
+	if code := <-waited; code != http.StatusServiceUnavailable {
+		t.Fatalf("takeover without a slot: got status %d, want 503", code)
+	}
+
+	close(finish)
+	<-done
+
+	reqData, err := store.Get(context.Background(), reqKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqRec := ReqRecord{}
+	if err := m.config.Codec.Unmarshal(reqData, &reqRec); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reqRec.abandoned(time.Now()) {
+		t.Fatalf("record after the failed takeover: got %+v, want it still abandoned", reqRec)
+	}
+
+	if code := send("abandoned"); code != http.StatusCreated {
+		t.Fatalf("takeover with a slot: got status %d, want 201", code)
+	}
+}
+
+func TestLockClaimWaitsWithoutInFlightSlot(t *testing.T) {
+	store := NewMemoryStore(0)
+	strategy := &LockClaim{Locker: &StoreLocker{Store: store, RetryInterval: 5 * time.Millisecond}}
+
+	started, finish := make(chan struct{}), make(chan struct{})
+
+	newEcho := func(maxInFlight int) *echo.Echo {
+		m := NewManager(IdempotencyConfig{Store: store, DisableScope: true, ClaimStrategy: strategy, MaxInFlight: maxInFlight})
+
+		e := echo.New()
+		e.Use(m.Middleware())
+		e.POST("/", func(c echo.Context) error {
+			if c.Request().Header.Get("X-Idempotency-Key") == "busy" && maxInFlight == 0 {
+				close(started)
+				<-finish
+			}
+
+			return c.String(http.StatusCreated, "created")
+		})
+
+		return e
+	}
+
+	// The instances share the store and the locks.
+	first, second := newEcho(0), newEcho(1)
+
+	send := func(e *echo.Echo, key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", key)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		send(first, "busy")
+	}()
+
+	<-started
+
+	// The duplicate blocks on the lock held by the first instance.
+	duplicate := make(chan int)
+	go func() {
+		duplicate <- send(second, "busy")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	if code := send(second, "other"); code != http.StatusCreated {
+		t.Fatalf("request next to a blocked duplicate: got status %d, want 201", code)
+	}
+
+	close(finish)
+	<-done
+
+	if code := <-duplicate; code != http.StatusCreated {
+		t.Fatalf("duplicate: got status %d, want 201", code)
+	}
+}
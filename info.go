@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"github.com/labstack/echo/v4"
+)
+
+// The echo context keys set by the middleware, for the middlewares and
+// handlers not using the accessors, e.g. generic request loggers.
+const (
+	// KeyContextKey is the echo context key of the idempotency key of the
+	// request.
+	KeyContextKey = "idempotency_key"
+
+	// ReplayedContextKey is the echo context key set to true when the
+	// response is replayed from the store.
+	ReplayedContextKey = "idempotency_replayed"
+
+	// RecordContextKey is the echo context key of the `*ReqRecord` replayed
+	// or stored by the request.
+	RecordContextKey = "idempotency_record"
+
+	// SkipPersistContextKey is the echo context key a middleware sets to true
+	// to keep the response of the request out of the store. See
+	// `SkipPersist`.
+	SkipPersistContextKey = "idempotency_skip_persist"
+)
+
+// Info is what the middleware tells about the request.
+type Info struct {
+	// Key is the idempotency key of the request.
+	Key string
+
+	// Replayed reports whether the response is replayed from the store.
+	Replayed bool
+
+	// Record is the replayed record, or the record stored once the handler
+	// completed. It is nil before then, and when the response isn't stored.
+	Record *ReqRecord
+}
+
+// FromContext returns what the middleware tells about the request. It
+// returns false when the request has no idempotency key.
+func FromContext(c echo.Context) (Info, bool) {
+	key, ok := c.Get(KeyContextKey).(string)
+	if !ok {
+		return Info{}, false
+	}
+
+	replayed, _ := c.Get(ReplayedContextKey).(bool)
+	reqRec, _ := c.Get(RecordContextKey).(*ReqRecord)
+
+	return Info{Key: key, Replayed: replayed, Record: reqRec}, true
+}
+
+// SkipPersist keeps the response of the request out of the store: the
+// record claimed by the request is released once the handler returns, so a
+// retry executes the handler again. Called before the middleware, e.g. by an
+// outer middleware, the response writer isn't wrapped at all; called later,
+// the response body isn't copied anymore. Called after the middleware
+// returned, e.g. from a detached goroutine, it has no effect.
+func SkipPersist(c echo.Context) {
+	c.Set(SkipPersistContextKey, true)
+
+	if state, err := stateFromContext(c); err == nil {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+
+		if state.writer != nil {
+			state.writer.skip()
+		}
+	}
+}
+
+// persistSkipped reports whether `SkipPersist` was called for the request.
+func persistSkipped(c echo.Context) bool {
+	skipped, _ := c.Get(SkipPersistContextKey).(bool)
+
+	return skipped
+}
@@ -0,0 +1,233 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOwnershipLost is returned when a request completes after its record
+// was claimed again or taken over by another request; its response isn't
+// stored. A record gone altogether is reported as `ErrRecordLost`.
+var ErrOwnershipLost = errors.New("idempotency record is not owned by the request anymore")
+
+// abandoned reports whether the record is in-flight and its owner stopped
+// renewing its lease, e.g. because its process crashed.
+func (r ReqRecord) abandoned(now time.Time) bool {
+	return !r.Done && r.LeaseExpiresAt != nil && now.After(*r.LeaseExpiresAt)
+}
+
+var (
+	ownerPrefix     string
+	ownerPrefixErr  error
+	ownerPrefixOnce sync.Once
+	ownerSeq        uint64
+)
+
+// newOwner returns a token identifying the request claiming a key: a random
+// prefix drawn once per process followed by a sequence number, so the hot
+// path doesn't read the system's random source.
+func newOwner() (string, error) {
+	ownerPrefixOnce.Do(func() {
+		b := make([]byte, 12)
+		if _, ownerPrefixErr = rand.Read(b); ownerPrefixErr == nil {
+			ownerPrefix = hex.EncodeToString(b) + "-"
+		}
+	})
+
+	if ownerPrefixErr != nil {
+		return "", ownerPrefixErr
+	}
+
+	return ownerPrefix + strconv.FormatUint(atomic.AddUint64(&ownerSeq, 1), 36), nil
+}
+
+// defaultInstanceID returns the default `InstanceID`.
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// newPlaceholder returns the placeholder record stored when claiming a key,
+// carrying the owner and the metadata of the request from meta, so pending
+// records tell which request they belong to. Placeholders of different
+// owners never compare equal.
+func newPlaceholder(config IdempotencyConfig, meta ReqRecord) ([]byte, error) {
+	reqRec := meta
+	if config.LeaseTTL > 0 {
+		leaseExpiresAt := time.Now().Add(config.LeaseTTL)
+		reqRec.LeaseExpiresAt = &leaseExpiresAt
+	}
+
+	return config.Codec.Marshal(reqRec)
+}
+
+// takeOver claims the key of the abandoned record by atomically replacing it
+// with a new placeholder. The record is read again only if it wasn't read
+// from the store, e.g. by a custom `WaitStrategy`. It returns false when the
+// record isn't abandoned anymore or another request took it over first, and
+// `ErrFingerprintMismatch` when the record belongs to a different request.
+func takeOver(ctx context.Context, config IdempotencyConfig, reqKey string, reqRec, meta ReqRecord, ttl time.Duration) ([]byte, bool, error) {
+	stale := reqRec.raw
+	if stale == nil {
+		var err error
+		reqRec, err = getRecord(ctx, config.Store, config.Codec, reqKey)
+		if errors.Is(err, ErrRecordLost) {
+			return nil, false, nil
+		}
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		stale = reqRec.raw
+	}
+
+	if !reqRec.abandoned(time.Now()) {
+		return nil, false, nil
+	}
+
+	if !fingerprintMatches(reqRec, meta.Fingerprint) {
+		return nil, false, ErrFingerprintMismatch
+	}
+
+	placeholder, err := newPlaceholder(config, meta)
+	if err != nil {
+		return nil, false, err
+	}
+
+	swapped, err := config.Store.CompareAndSwap(ctx, reqKey, stale, placeholder, ttl)
+	if err != nil || !swapped {
+		return nil, false, err
+	}
+
+	return placeholder, true, nil
+}
+
+// takeOverKeys claims the keys one by one when some of them are held by
+// abandoned records, which are replaced with the placeholder. It returns
+// false, after releasing the keys it claimed, when any key is held by a
+// record that isn't abandoned.
+func takeOverKeys(ctx context.Context, config IdempotencyConfig, keys []string, placeholder []byte, ttl time.Duration) (bool, error) {
+	claimed := make([]string, 0, len(keys))
+
+	for _, k := range keys {
+		ok, err := takeOverKey(ctx, config, k, placeholder, ttl)
+		if err != nil || !ok {
+			if len(claimed) > 0 {
+				_ = config.Store.Delete(ctx, claimed...)
+			}
+
+			return false, err
+		}
+
+		claimed = append(claimed, k)
+	}
+
+	return true, nil
+}
+
+// takeOverKey claims the key unless it is held by a record that isn't
+// abandoned.
+func takeOverKey(ctx context.Context, config IdempotencyConfig, key string, placeholder []byte, ttl time.Duration) (bool, error) {
+	stale, err := config.Store.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return config.Store.SetNX(ctx, key, placeholder, ttl)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	reqRec := ReqRecord{}
+	if err := config.Codec.Unmarshal(stale, &reqRec); err != nil {
+		return false, err
+	}
+
+	if !reqRec.abandoned(time.Now()) {
+		return false, nil
+	}
+
+	return config.Store.CompareAndSwap(ctx, key, stale, placeholder, ttl)
+}
+
+// startHeartbeat renews the lease of the placeholder claimed by the request,
+// and of its claimed keys, periodically until the returned func is called.
+// It gives up once the placeholder was replaced, i.e. after a takeover.
+func startHeartbeat(config IdempotencyConfig, state *requestState, meta ReqRecord) func() {
+	if config.LeaseTTL <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(config.LeaseTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-ticker.C:
+			}
+
+			if !renewLease(config, state, meta) {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func renewLease(config IdempotencyConfig, state *requestState, meta ReqRecord) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), config.LeaseTTL)
+	defer cancel()
+
+	renewed, err := newPlaceholder(config, meta)
+	if err != nil {
+		return false
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	swapped, err := config.Store.CompareAndSwap(ctx, state.reqKey, state.placeholder, renewed, KeepTTL)
+	if err != nil {
+		// Keep trying; the lease may survive a transient store error.
+		return true
+	}
+
+	if !swapped {
+		return false
+	}
+
+	// The claimed keys hold the same placeholder as the request.
+	for _, k := range state.claimedKeys {
+		_, _ = config.Store.CompareAndSwap(ctx, k, state.placeholder, renewed, KeepTTL)
+	}
+
+	state.placeholder = renewed
+
+	return true
+}
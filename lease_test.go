@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestClaimRoundTrips(t *testing.T) {
+	tests := []struct {
+		name      string
+		abandoned bool
+		wantGets  int
+	}{
+		{"claim", false, 0},
+		{"takeover", true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore(0)
+			tracer := &recordingTracer{}
+			m := NewManager(IdempotencyConfig{Store: store, Tracer: tracer, DisableScope: true, LeaseTTL: time.Minute})
+
+			if tt.abandoned {
+				abandonedAt := time.Now().Add(-time.Second)
+
+				abandoned, err := m.config.Codec.Marshal(ReqRecord{LeaseExpiresAt: &abandonedAt})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := store.Set(context.Background(), m.config.recordKey("key"), abandoned, time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			e := echo.New()
+			e.Use(m.Middleware())
+			e.POST("/", func(c echo.Context) error {
+				return c.String(http.StatusCreated, "created")
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+			req.Header.Set("X-Idempotency-Key", "key")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusCreated)
+			}
+
+			counts := map[string]int{}
+			for _, name := range tracer.spans {
+				counts[strings.TrimPrefix(name, "idempotency.store.")]++
+			}
+
+			if counts["get"] != tt.wantGets || counts["ttl"] != 0 {
+				t.Fatalf("got %d reads and %d TTL reads, want %d and 0 (spans %q)", counts["get"], counts["ttl"], tt.wantGets, tracer.spans)
+			}
+
+			reqRec, err := m.Lookup(context.Background(), "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reqRec.Done {
+				t.Fatalf("got record %+v, want it done", reqRec)
+			}
+
+			if ttl, _ := store.TTL(context.Background(), m.config.recordKey("key")); ttl <= 0 || ttl > m.config.TTL {
+				t.Fatalf("got TTL %v of the record, want at most %v", ttl, m.config.TTL)
+			}
+		})
+	}
+}
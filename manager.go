@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Invalidate deletes the record of the idempotency key and the chunks of its
+// body, so the next request with the key executes the handler again. It is
+// meant for compensation workflows that rolled back the side effect of the
+// cached response. Keys of scoped records must be combined with their scope
+// by `ScopedKey`.
+func (m *Manager) Invalidate(ctx context.Context, key string) error {
+	reqKey := m.config.recordKey(key)
+
+	keys, err := withChunks(ctx, m.config.Store, m.config.Codec, reqKey)
+	if err != nil {
+		return err
+	}
+
+	if err := m.config.Store.Delete(ctx, keys...); err != nil {
+		return err
+	}
+
+	m.release(reqKey)
+
+	return nil
+}
+
+// InvalidateByPrefix deletes the records of all idempotency keys starting
+// with the prefix. The prefix isn't normalized, so it only makes sense with
+// a `KeyNormalizer` preserving the prefixes of the keys.
+func (m *Manager) InvalidateByPrefix(ctx context.Context, prefix string) error {
+	return m.config.Store.Scan(ctx, m.config.recordPrefix()+prefix, func(reqKeys []string) error {
+		keys, err := withChunks(ctx, m.config.Store, m.config.Codec, reqKeys...)
+		if err != nil {
+			return err
+		}
+
+		if err := m.config.Store.Delete(ctx, keys...); err != nil {
+			return err
+		}
+
+		m.release(reqKeys...)
+
+		return nil
+	})
+}
+
+// InvalidateGroup deletes all records tagged with the group.
+func (m *Manager) InvalidateGroup(ctx context.Context, group string) error {
+	return invalidateGroup(ctx, m.config.Store, m.config.Codec, m.config.groupKey(group))
+}
+
+// release drops the quota accounting of the record keys.
+func (m *Manager) release(reqKeys ...string) {
+	if m.config.Quota == nil {
+		return
+	}
+
+	for _, k := range reqKeys {
+		m.config.Quota.release(k)
+	}
+}
+
+// Lookup returns the record of the idempotency key, or `ErrNotFound`. Keys
+// of scoped records must be combined with their scope by `ScopedKey`.
+func (m *Manager) Lookup(ctx context.Context, key string) (ReqRecord, error) {
+	reqRec, err := getRecord(ctx, m.config.Store, m.config.Codec, m.config.recordKey(key))
+	if errors.Is(err, ErrRecordLost) {
+		return reqRec, ErrNotFound
+	}
+
+	return reqRec, err
+}
+
+// List returns up to limit idempotency keys starting with the prefix, in
+// lexical order after the cursor, and the cursor of the next page; the
+// cursor is empty on the last page. Keys are returned as stored, i.e.
+// scoped and normalized. Since the stores scan their whole keyspace, it is
+// meant for the occasional administrative use.
+func (m *Manager) List(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	recordPrefix := m.config.recordPrefix()
+
+	var keys []string
+	err := m.config.Store.Scan(ctx, recordPrefix+prefix, func(batch []string) error {
+		for _, k := range batch {
+			k = strings.TrimPrefix(k, recordPrefix)
+			if m.config.HashTags {
+				k = strings.TrimSuffix(k, "}")
+			}
+
+			if k > cursor {
+				keys = append(keys, k)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Strings(keys)
+
+	if limit <= 0 || len(keys) <= limit {
+		return keys, "", nil
+	}
+
+	return keys[:limit], keys[limit-1], nil
+}
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestHashTags(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), HashTags: true, DisableScope: true})
+
+	var claimErr error
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		_, claimErr = ClaimKeys(c, "child")
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", "key")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	var configErr *ConfigError
+	if !errors.As(claimErr, &configErr) {
+		t.Fatalf("ClaimKeys with hash tags: got error %v, want a ConfigError", claimErr)
+	}
+
+	keys, _, err := m.List(context.Background(), "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys[0] != "key" {
+		t.Fatalf("List: got %q, want [key]", keys)
+	}
+
+	if _, err := m.Lookup(context.Background(), keys[0]); err != nil {
+		t.Fatalf("Lookup of a listed key: %v", err)
+	}
+}
+
+func TestInvalidateChunks(t *testing.T) {
+	tests := []struct {
+		name       string
+		invalidate func(m *Manager, key string) error
+	}{
+		{"Invalidate", func(m *Manager, key string) error {
+			return m.Invalidate(context.Background(), key)
+		}},
+		{"InvalidateByPrefix", func(m *Manager, key string) error {
+			return m.InvalidateByPrefix(context.Background(), key)
+		}},
+		{"InvalidateGroup", func(m *Manager, key string) error {
+			return m.InvalidateGroup(context.Background(), "group")
+		}},
+		{"RegisterAdmin", func(m *Manager, key string) error {
+			e := echo.New()
+			m.RegisterAdmin(e.Group("/admin"))
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/admin/records/"+key, nil))
+			if rec.Code != http.StatusNoContent {
+				return fmt.Errorf("got status %d, want %d", rec.Code, http.StatusNoContent)
+			}
+
+			return nil
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore(0)
+			m := NewManager(IdempotencyConfig{Store: store, ResponseChunkSize: 4, DisableScope: true})
+
+			e := echo.New()
+			e.Use(m.Middleware())
+			e.POST("/", func(c echo.Context) error {
+				if err := TagGroup(c, "group"); err != nil {
+					return err
+				}
+
+				return c.String(http.StatusCreated, "a chunked response body")
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+			req.Header.Set("X-Idempotency-Key", "key")
+			e.ServeHTTP(httptest.NewRecorder(), req)
+
+			chunks := func() (n int) {
+				_ = store.Scan(context.Background(), "chk::", func(keys []string) error {
+					n += len(keys)
+
+					return nil
+				})
+
+				return n
+			}
+
+			if chunks() == 0 {
+				t.Fatal("the response body wasn't chunked")
+			}
+
+			if err := tt.invalidate(m, "key"); err != nil {
+				t.Fatal(err)
+			}
+
+			if n := chunks(); n != 0 {
+				t.Fatalf("got %d chunks left after the invalidation, want 0", n)
+			}
+		})
+	}
+}
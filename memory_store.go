@@ -0,0 +1,397 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is the minimum interval between two sweeps of the
+// expired keys of a `MemoryStore`.
+const memorySweepInterval = time.Minute
+
+// memoryScanCount is the batch size used by `MemoryStore.Scan`.
+const memoryScanCount = 100
+
+// errWrongType is returned when a value operation targets a set or vice versa.
+var errWrongType = errors.New("operation against a key holding the wrong kind of value")
+
+// MemoryStore is an in-memory `Store` for tests and single instance
+// deployments. Keys expire with their TTL and the least recently used keys
+// are evicted once the store holds `MaxEntries` keys.
+type MemoryStore struct {
+	// MaxEntries caps the number of keys.
+	// Optional. Default value 0 (unlimited).
+	MaxEntries int
+
+	mu        sync.Mutex
+	items     map[string]*list.Element
+	lru       *list.List
+	lastSweep time.Time
+	subs      map[string]map[chan struct{}]struct{}
+}
+
+type memoryItem struct {
+	key       string
+	value     []byte
+	members   map[string]struct{}
+	expiresAt time.Time
+}
+
+// NewMemoryStore returns a `MemoryStore` holding up to maxEntries keys; zero
+// means unlimited.
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	return &MemoryStore{MaxEntries: maxEntries}
+}
+
+// Get implements `Store`.
+func (s *MemoryStore) Get(_ context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.get(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if item.members != nil {
+		return nil, errWrongType
+	}
+
+	return append([]byte(nil), item.value...), nil
+}
+
+// Set implements `Store`.
+func (s *MemoryStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expiresAt time.Time
+	if ttl == KeepTTL {
+		if item, ok := s.get(key); ok {
+			expiresAt = item.expiresAt
+		}
+	} else {
+		expiresAt = expiry(ttl)
+	}
+
+	s.put(&memoryItem{key: key, value: append([]byte(nil), value...), expiresAt: expiresAt})
+
+	return nil
+}
+
+// SetNX implements `Store`.
+func (s *MemoryStore) SetNX(_ context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.get(key); ok {
+		return false, nil
+	}
+
+	s.put(&memoryItem{key: key, value: append([]byte(nil), value...), expiresAt: expiry(ttl)})
+
+	return true, nil
+}
+
+// SetNXMulti implements `Store`.
+func (s *MemoryStore) SetNXMulti(_ context.Context, keys []string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range keys {
+		if _, ok := s.get(k); ok {
+			return false, nil
+		}
+	}
+
+	for _, k := range keys {
+		s.put(&memoryItem{key: k, value: append([]byte(nil), value...), expiresAt: expiry(ttl)})
+	}
+
+	return true, nil
+}
+
+// CompareAndSwap implements `Store`.
+func (s *MemoryStore) CompareAndSwap(_ context.Context, key string, old, new []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.get(key)
+	if !ok || item.members != nil || !bytes.Equal(item.value, old) {
+		return false, nil
+	}
+
+	expiresAt := item.expiresAt
+	if ttl != KeepTTL {
+		expiresAt = expiry(ttl)
+	}
+
+	s.put(&memoryItem{key: key, value: append([]byte(nil), new...), expiresAt: expiresAt})
+
+	return true, nil
+}
+
+// Lock implements `Store`.
+func (s *MemoryStore) Lock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	return s.SetNX(ctx, key, []byte(owner), ttl)
+}
+
+// Unlock implements `Store`.
+func (s *MemoryStore) Unlock(_ context.Context, key, owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.get(key)
+	if !ok || item.members != nil || string(item.value) != owner {
+		return false, nil
+	}
+
+	s.remove(key)
+
+	return true, nil
+}
+
+// Delete implements `Store`.
+func (s *MemoryStore) Delete(_ context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range keys {
+		s.remove(k)
+	}
+
+	return nil
+}
+
+// TTL implements `Store`.
+func (s *MemoryStore) TTL(_ context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.get(key)
+	if !ok {
+		return 0, ErrNotFound
+	}
+
+	if item.expiresAt.IsZero() {
+		return 0, nil
+	}
+
+	return time.Until(item.expiresAt), nil
+}
+
+// Expire implements `Store`.
+func (s *MemoryStore) Expire(_ context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, ok := s.get(key); ok {
+		item.expiresAt = expiry(ttl)
+	}
+
+	return nil
+}
+
+// AddMembers implements `Store`.
+func (s *MemoryStore) AddMembers(_ context.Context, key string, members ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.get(key)
+	if !ok {
+		item = &memoryItem{key: key, members: make(map[string]struct{})}
+		s.put(item)
+	}
+
+	if item.members == nil {
+		return errWrongType
+	}
+
+	for _, m := range members {
+		item.members[m] = struct{}{}
+	}
+
+	return nil
+}
+
+// Members implements `Store`.
+func (s *MemoryStore) Members(_ context.Context, key string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.get(key)
+	if !ok {
+		return nil, nil
+	}
+
+	if item.members == nil {
+		return nil, errWrongType
+	}
+
+	members := make([]string, 0, len(item.members))
+	for m := range item.members {
+		members = append(members, m)
+	}
+
+	return members, nil
+}
+
+// Scan implements `Store`. Keys are collected up front, so fn may modify
+// the store.
+func (s *MemoryStore) Scan(_ context.Context, prefix string, fn func(keys []string) error) error {
+	s.mu.Lock()
+
+	var keys []string
+	now := time.Now()
+	for k, e := range s.items {
+		if strings.HasPrefix(k, prefix) && !e.Value.(*memoryItem).expired(now) {
+			keys = append(keys, k)
+		}
+	}
+
+	s.mu.Unlock()
+
+	for len(keys) > 0 {
+		n := memoryScanCount
+		if n > len(keys) {
+			n = len(keys)
+		}
+
+		if err := fn(keys[:n]); err != nil {
+			return err
+		}
+
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+// Notify implements `Notifier`.
+func (s *MemoryStore) Notify(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for notified := range s.subs[key] {
+		select {
+		case notified <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Subscribe implements `Notifier`.
+func (s *MemoryStore) Subscribe(_ context.Context, key string) (<-chan struct{}, func(), error) {
+	notified := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subs == nil {
+		s.subs = make(map[string]map[chan struct{}]struct{})
+	}
+
+	if s.subs[key] == nil {
+		s.subs[key] = make(map[chan struct{}]struct{})
+	}
+
+	s.subs[key][notified] = struct{}{}
+
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.subs[key], notified)
+
+		if len(s.subs[key]) == 0 {
+			delete(s.subs, key)
+		}
+	}
+
+	return notified, cancel, nil
+}
+
+// get returns the live item of the key and marks it as recently used.
+func (s *MemoryStore) get(key string) (*memoryItem, bool) {
+	e, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	item := e.Value.(*memoryItem)
+	if item.expired(time.Now()) {
+		s.remove(key)
+
+		return nil, false
+	}
+
+	s.lru.MoveToFront(e)
+
+	return item, true
+}
+
+// put stores the item, evicting the least recently used ones over the cap.
+func (s *MemoryStore) put(item *memoryItem) {
+	if s.items == nil {
+		s.items = make(map[string]*list.Element)
+		s.lru = list.New()
+	}
+
+	s.sweep()
+
+	if e, ok := s.items[item.key]; ok {
+		e.Value = item
+		s.lru.MoveToFront(e)
+
+		return
+	}
+
+	s.items[item.key] = s.lru.PushFront(item)
+
+	for s.MaxEntries > 0 && s.lru.Len() > s.MaxEntries {
+		s.remove(s.lru.Back().Value.(*memoryItem).key)
+	}
+}
+
+func (s *MemoryStore) remove(key string) {
+	if e, ok := s.items[key]; ok {
+		s.lru.Remove(e)
+		delete(s.items, key)
+	}
+}
+
+// sweep removes the expired items, at most once per `memorySweepInterval`.
+func (s *MemoryStore) sweep() {
+	now := time.Now()
+	if now.Sub(s.lastSweep) < memorySweepInterval {
+		return
+	}
+
+	s.lastSweep = now
+
+	for k, e := range s.items {
+		if e.Value.(*memoryItem).expired(now) {
+			s.remove(k)
+		}
+	}
+}
+
+func (i *memoryItem) expired(now time.Time) bool {
+	return !i.expiresAt.IsZero() && !now.Before(i.expiresAt)
+}
+
+// expiry returns the expiration time of a TTL; zero means no expiration.
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
+}
@@ -0,0 +1,16 @@
+package middleware_test
+
+import (
+	"testing"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+	"github.com/mgurevin/echo-idempotency/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(tb testing.TB) middleware.Store { return middleware.NewMemoryStore(0) })
+}
+
+func BenchmarkMemoryStore(b *testing.B) {
+	storetest.Benchmark(b, func(tb testing.TB) middleware.Store { return middleware.NewMemoryStore(0) })
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultMetricsBuckets are the upper bounds, in seconds, of the histogram
+// buckets of `Metrics`.
+var DefaultMetricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// metricsCounters maps the event types counted by `Metrics` to their metric
+// names and help texts.
+var metricsCounters = map[EventType][2]string{
+	EventKeyExtracted:        {"idempotency_requests_total", "Requests carrying an idempotency key."},
+	EventClaimed:             {"idempotency_executions_total", "Requests executing the handler for their key."},
+	EventReplayed:            {"idempotency_replays_total", "Requests served with a stored response."},
+	EventConflict:            {"idempotency_conflicts_total", "Requests rejected due to a concurrent request."},
+	EventExpired:             {"idempotency_lost_records_total", "Records lost before completion."},
+	EventStoreError:          {"idempotency_store_errors_total", "Failed store operations."},
+	EventFingerprintMismatch: {"idempotency_fingerprint_mismatches_total", "Keys reused with a different request."},
+}
+
+// Metrics aggregates the events of the middleware and exposes them in the
+// Prometheus text format, so the duplicate traffic absorbed by the
+// middleware can be scraped without a Prometheus client dependency. Set
+// `Observe` as the `OnEvent` callback and serve the metrics with the
+// `http.Handler` implementation, or register them with a Prometheus
+// registry through the collector of the `metrics/prometheus` module.
+type Metrics struct {
+	buckets []float64
+
+	mu       sync.Mutex
+	counters map[EventType]uint64
+	wait     *histogram
+	handler  *histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewMetrics returns a `Metrics` with the given histogram buckets, or
+// `DefaultMetricsBuckets` if none is given.
+func NewMetrics(buckets ...float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultMetricsBuckets
+	}
+
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &Metrics{
+		buckets:  buckets,
+		counters: make(map[EventType]uint64),
+		wait:     &histogram{counts: make([]uint64, len(buckets))},
+		handler:  &histogram{counts: make([]uint64, len(buckets))},
+	}
+}
+
+// Observe records the event; it is meant to be used as the `OnEvent`
+// callback.
+func (m *Metrics) Observe(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[e.Type]++
+
+	switch e.Type {
+	case EventWaitFinished:
+		m.wait.observe(m.buckets, e.Duration)
+
+	case EventCompleted:
+		m.handler.observe(m.buckets, e.Duration)
+	}
+}
+
+// MetricsCounter is a counter of a `MetricsSnapshot`.
+type MetricsCounter struct {
+	Name  string
+	Help  string
+	Value uint64
+}
+
+// MetricsHistogram is a histogram of a `MetricsSnapshot`. Buckets maps the
+// upper bounds to the cumulative counts of the observations.
+type MetricsHistogram struct {
+	Name    string
+	Help    string
+	Buckets map[float64]uint64
+	Count   uint64
+	Sum     float64
+}
+
+// MetricsSnapshot is a consistent view of the values of `Metrics`, e.g. for
+// exporting them with a metrics client; the `metrics/prometheus` module
+// provides a Prometheus collector.
+type MetricsSnapshot struct {
+	Counters   []MetricsCounter
+	Histograms []MetricsHistogram
+}
+
+// Snapshot returns the current values, ordered by the event types.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	types := make([]EventType, 0, len(metricsCounters))
+	for t := range metricsCounters {
+		types = append(types, t)
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	var s MetricsSnapshot
+
+	for _, t := range types {
+		s.Counters = append(s.Counters, MetricsCounter{
+			Name:  metricsCounters[t][0],
+			Help:  metricsCounters[t][1],
+			Value: m.counters[t],
+		})
+	}
+
+	s.Histograms = []MetricsHistogram{
+		m.wait.snapshot(m.buckets, "idempotency_wait_duration_seconds", "Time spent waiting for concurrent requests."),
+		m.handler.snapshot(m.buckets, "idempotency_handler_duration_seconds", "Duration of the handlers executed for a key."),
+	}
+
+	return s
+}
+
+// ServeHTTP implements `http.Handler`.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	s := m.Snapshot()
+
+	for _, c := range s.Counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.Name, c.Help, c.Name, c.Name, c.Value)
+	}
+
+	for _, h := range s.Histograms {
+		writeHistogram(w, h)
+	}
+}
+
+func (h *histogram) observe(buckets []float64, d time.Duration) {
+	s := d.Seconds()
+
+	for i, b := range buckets {
+		if s <= b {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += s
+}
+
+func (h *histogram) snapshot(buckets []float64, name, help string) MetricsHistogram {
+	s := MetricsHistogram{
+		Name:    name,
+		Help:    help,
+		Buckets: make(map[float64]uint64, len(buckets)),
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+
+	for i, b := range buckets {
+		s.Buckets[b] = h.counts[i]
+	}
+
+	return s
+}
+
+func writeHistogram(w io.Writer, h MetricsHistogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name)
+
+	bounds := make([]float64, 0, len(h.Buckets))
+	for b := range h.Buckets {
+		bounds = append(bounds, b)
+	}
+
+	sort.Float64s(bounds)
+
+	for _, b := range bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.Name, strconv.FormatFloat(b, 'g', -1, 64), h.Buckets[b])
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", h.Name, h.Count, h.Name, strconv.FormatFloat(h.Sum, 'g', -1, 64), h.Name, h.Count)
+}
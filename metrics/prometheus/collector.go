@@ -0,0 +1,54 @@
+// Package prometheus exports the `middleware.Metrics` with the Prometheus
+// client, for the services registering their metrics with a Prometheus
+// registry instead of serving the text format of `middleware.Metrics`.
+package prometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+// Collector is a `prometheus.Collector` exporting the values of a
+// `middleware.Metrics` under the same names.
+type Collector struct {
+	metrics *middleware.Metrics
+	descs   map[string]*prometheus.Desc
+}
+
+// NewCollector returns a `Collector` of the metrics.
+func NewCollector(m *middleware.Metrics) *Collector {
+	c := &Collector{metrics: m, descs: make(map[string]*prometheus.Desc)}
+
+	s := m.Snapshot()
+
+	for _, counter := range s.Counters {
+		c.descs[counter.Name] = prometheus.NewDesc(counter.Name, counter.Help, nil, nil)
+	}
+
+	for _, h := range s.Histograms {
+		c.descs[h.Name] = prometheus.NewDesc(h.Name, h.Help, nil, nil)
+	}
+
+	return c
+}
+
+// Describe implements `prometheus.Collector`.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
+
+// Collect implements `prometheus.Collector`.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.metrics.Snapshot()
+
+	for _, counter := range s.Counters {
+		ch <- prometheus.MustNewConstMetric(c.descs[counter.Name], prometheus.CounterValue, float64(counter.Value))
+	}
+
+	for _, h := range s.Histograms {
+		ch <- prometheus.MustNewConstHistogram(c.descs[h.Name], h.Count, h.Sum, h.Buckets)
+	}
+}
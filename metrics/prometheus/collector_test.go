@@ -0,0 +1,108 @@
+package prometheus
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+func observe(m *middleware.Metrics) {
+	m.Observe(middleware.Event{Type: middleware.EventKeyExtracted})
+	m.Observe(middleware.Event{Type: middleware.EventReplayed})
+	m.Observe(middleware.Event{Type: middleware.EventCompleted, Duration: 50 * time.Millisecond})
+	m.Observe(middleware.Event{Type: middleware.EventWaitFinished, Duration: 2 * time.Second})
+}
+
+func TestCollector(t *testing.T) {
+	m := middleware.NewMetrics(0.1, 1)
+	observe(m)
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(NewCollector(m)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP idempotency_replays_total Requests served with a stored response.
+# TYPE idempotency_replays_total counter
+idempotency_replays_total 1
+# HELP idempotency_requests_total Requests carrying an idempotency key.
+# TYPE idempotency_requests_total counter
+idempotency_requests_total 1
+# HELP idempotency_handler_duration_seconds Duration of the handlers executed for a key.
+# TYPE idempotency_handler_duration_seconds histogram
+idempotency_handler_duration_seconds_bucket{le="0.1"} 1
+idempotency_handler_duration_seconds_bucket{le="1"} 1
+idempotency_handler_duration_seconds_bucket{le="+Inf"} 1
+idempotency_handler_duration_seconds_sum 0.05
+idempotency_handler_duration_seconds_count 1
+# HELP idempotency_wait_duration_seconds Time spent waiting for concurrent requests.
+# TYPE idempotency_wait_duration_seconds histogram
+idempotency_wait_duration_seconds_bucket{le="0.1"} 0
+idempotency_wait_duration_seconds_bucket{le="1"} 0
+idempotency_wait_duration_seconds_bucket{le="+Inf"} 1
+idempotency_wait_duration_seconds_sum 2
+idempotency_wait_duration_seconds_count 1
+`
+
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"idempotency_replays_total",
+		"idempotency_requests_total",
+		"idempotency_handler_duration_seconds",
+		"idempotency_wait_duration_seconds",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := testutil.GatherAndCount(reg); err != nil || n != 9 {
+		t.Fatalf("got %d metrics, %v, want 9", n, err)
+	}
+}
+
+// The text served by `middleware.Metrics` parses to the families gathered by
+// the collector.
+func TestServeHTTPExposition(t *testing.T) {
+	m := middleware.NewMetrics(0.1, 1)
+	observe(m)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	var parser expfmt.TextParser
+
+	served, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewCollector(m))
+
+	gathered, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(served) != len(gathered) {
+		t.Fatalf("served %d families, gathered %d", len(served), len(gathered))
+	}
+
+	for _, g := range gathered {
+		s, ok := served[g.GetName()]
+		if !ok {
+			t.Fatalf("family %s isn't served", g.GetName())
+		}
+
+		if s.String() != g.String() {
+			t.Errorf("family %s:\nserved   %v\ngathered %v", g.GetName(), s, g)
+		}
+	}
+}
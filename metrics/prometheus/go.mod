@@ -0,0 +1,9 @@
+module github.com/mgurevin/echo-idempotency/metrics/prometheus
+
+go 1.18
+
+require (
+	github.com/mgurevin/echo-idempotency v0.1.0
+	github.com/prometheus/client_golang v1.13.0
+	github.com/prometheus/common v0.37.0
+)
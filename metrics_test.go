@@ -0,0 +1,230 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expositionFamily is a metric family parsed from the Prometheus text format.
+type expositionFamily struct {
+	typ     string
+	help    string
+	samples map[string]float64
+}
+
+var (
+	expositionMetaRe   = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.*)$`)
+	expositionSampleRe = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{le="([^"]*)"\})? (\S+)$`)
+)
+
+// parseExposition parses the Prometheus text format strictly: every sample
+// follows the HELP and TYPE lines of its family and belongs to it, and the
+// histograms have cumulative buckets ending with "+Inf" and agreeing with
+// their counts.
+func parseExposition(text string) (map[string]*expositionFamily, error) {
+	families := make(map[string]*expositionFamily)
+
+	var (
+		current *expositionFamily
+		name    string
+		prev    = math.Inf(-1)
+		prevCnt float64
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if m := expositionMetaRe.FindStringSubmatch(line); m != nil {
+			switch m[1] {
+			case "HELP":
+				if _, ok := families[m[2]]; ok {
+					return nil, fmt.Errorf("duplicate family %s", m[2])
+				}
+
+				current, name = &expositionFamily{help: m[3], samples: make(map[string]float64)}, m[2]
+				families[name] = current
+				prev, prevCnt = math.Inf(-1), 0
+
+			case "TYPE":
+				if current == nil || m[2] != name || current.typ != "" {
+					return nil, fmt.Errorf("TYPE of %s without its HELP", m[2])
+				}
+
+				if m[3] != "counter" && m[3] != "histogram" {
+					return nil, fmt.Errorf("unknown type %q", m[3])
+				}
+
+				current.typ = m[3]
+			}
+
+			continue
+		}
+
+		m := expositionSampleRe.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+
+		if current == nil || current.typ == "" {
+			return nil, fmt.Errorf("sample %s without a family", m[1])
+		}
+
+		v, err := strconv.ParseFloat(m[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("value of %q: %w", line, err)
+		}
+
+		switch {
+		case current.typ == "counter" && m[1] == name && m[2] == "":
+			current.samples[name] = v
+
+		case current.typ == "histogram" && m[1] == name+"_bucket" && m[2] != "":
+			le, err := strconv.ParseFloat(m[3], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bound of %q: %w", line, err)
+			}
+
+			if le <= prev || v < prevCnt {
+				return nil, fmt.Errorf("bucket %q isn't cumulative", line)
+			}
+
+			prev, prevCnt = le, v
+			current.samples[`le="`+m[3]+`"`] = v
+
+		case current.typ == "histogram" && (m[1] == name+"_sum" || m[1] == name+"_count") && m[2] == "":
+			current.samples[strings.TrimPrefix(m[1], name)] = v
+
+		default:
+			return nil, fmt.Errorf("sample %q doesn't belong to %s", line, name)
+		}
+	}
+
+	for name, f := range families {
+		if f.typ != "histogram" {
+			continue
+		}
+
+		inf, ok := f.samples[`le="+Inf"`]
+		if !ok || inf != f.samples["_count"] {
+			return nil, fmt.Errorf("histogram %s: +Inf bucket %v, count %v", name, inf, f.samples["_count"])
+		}
+	}
+
+	return families, scanner.Err()
+}
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics(0.1, 0.01, 1)
+
+	for _, e := range []Event{
+		{Type: EventKeyExtracted},
+		{Type: EventKeyExtracted},
+		{Type: EventKeyExtracted},
+		{Type: EventClaimed},
+		{Type: EventReplayed},
+		{Type: EventConflict},
+		{Type: EventCompleted, Duration: 50 * time.Millisecond},
+		{Type: EventWaitFinished, Duration: 5 * time.Millisecond},
+		{Type: EventWaitFinished, Duration: 2 * time.Second},
+	} {
+		m.Observe(e)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("got content type %q", ct)
+	}
+
+	families, err := parseExposition(rec.Body.String())
+	if err != nil {
+		t.Fatalf("%v\n%s", err, rec.Body.String())
+	}
+
+	if len(families) != len(metricsCounters)+2 {
+		t.Fatalf("got %d families, want %d", len(families), len(metricsCounters)+2)
+	}
+
+	for name, want := range map[string]float64{
+		"idempotency_requests_total":     3,
+		"idempotency_executions_total":   1,
+		"idempotency_replays_total":      1,
+		"idempotency_conflicts_total":    1,
+		"idempotency_lost_records_total": 0,
+	} {
+		f, ok := families[name]
+		if !ok || f.typ != "counter" || f.samples[name] != want {
+			t.Errorf("%s = %+v, want %v", name, f, want)
+		}
+	}
+
+	wait := families["idempotency_wait_duration_seconds"]
+	if wait == nil || wait.typ != "histogram" {
+		t.Fatalf("wait histogram = %+v", wait)
+	}
+
+	for sample, want := range map[string]float64{
+		`le="0.01"`: 1,
+		`le="0.1"`:  1,
+		`le="1"`:    1,
+		`le="+Inf"`: 2,
+		"_count":    2,
+		"_sum":      2.005,
+	} {
+		if got := wait.samples[sample]; math.Abs(got-want) > 1e-9 {
+			t.Errorf("wait %s = %v, want %v", sample, got, want)
+		}
+	}
+
+	handler := families["idempotency_handler_duration_seconds"]
+	if handler == nil || handler.samples[`le="0.01"`] != 0 || handler.samples[`le="0.1"`] != 1 || handler.samples["_count"] != 1 {
+		t.Fatalf("handler histogram = %+v", handler)
+	}
+}
+
+func TestMetricsSnapshot(t *testing.T) {
+	m := NewMetrics(1)
+	m.Observe(Event{Type: EventStoreError})
+	m.Observe(Event{Type: EventCompleted, Duration: 3 * time.Second})
+
+	s := m.Snapshot()
+
+	if len(s.Counters) != len(metricsCounters) {
+		t.Fatalf("got %d counters, want %d", len(s.Counters), len(metricsCounters))
+	}
+
+	for _, c := range s.Counters {
+		want := uint64(0)
+		if c.Name == "idempotency_store_errors_total" {
+			want = 1
+		}
+
+		if c.Value != want {
+			t.Errorf("counter %s = %d, want %d", c.Name, c.Value, want)
+		}
+	}
+
+	if len(s.Histograms) != 2 {
+		t.Fatalf("got %d histograms, want 2", len(s.Histograms))
+	}
+
+	h := s.Histograms[1]
+	if h.Name != "idempotency_handler_duration_seconds" || h.Buckets[1] != 0 || h.Count != 1 || h.Sum != 3 {
+		t.Fatalf("handler histogram = %+v", h)
+	}
+
+	// The snapshot doesn't change with the later events.
+	m.Observe(Event{Type: EventCompleted, Duration: time.Millisecond})
+	if h.Buckets[1] != 0 || s.Histograms[1].Count != 1 {
+		t.Fatalf("snapshot changed: %+v", s.Histograms[1])
+	}
+}
@@ -1,28 +1,19 @@
 package middleware
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net"
 	"net/http"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
-type Rediser interface {
-	Get(ctx context.Context, key string) *redis.StringCmd
-	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
-}
-
 type KeyExtractor func(echo.Context) (string, bool, error)
 
 // IdempotencyConfig defines the config for Idempotency middleware.
@@ -30,14 +21,18 @@ type IdempotencyConfig struct {
 	// Skipper defines a function to skip middleware.
 	Skipper middleware.Skipper
 
-	Rediser Rediser
+	// Store persists the idempotency records, e.g. a `MemoryStore` or a
+	// Redis store of the `store/redisv8` or `store/redisv9` modules.
+	// Required.
+	Store Store
 
 	// Methods defines a list of HTTP methods that should be works as idempotent.
 	// Optional. Default value []string{"POST"}.
 	Methods []string `yaml:"methods"`
 
 	// KeyLookup is a string in the form of "<source>:<name>" that is used
-	// to extract key from the request.
+	// to extract key from the request. Multiple sources may be given
+	// separated by commas; they are tried in order until one has a key.
 	// Optional. Default value "header:X-Idempotency-Key".
 	// Possible values:
 	// - "header:<name>"
@@ -47,35 +42,600 @@ type IdempotencyConfig struct {
 
 	KeyLookupFunc KeyExtractor
 
-	TTL time.Duration
+	// StrictRFC follows the IETF Idempotency-Key HTTP header draft: the key
+	// is read from the Idempotency-Key header by default, as a quoted
+	// structured field string and required unless RequireKeyFunc decides
+	// otherwise; malformed and missing keys get 400 Bad Request, keys
+	// reused with a different payload 422 Unprocessable Entity, and
+	// requests arriving while the first one is in-flight 409 Conflict,
+	// whatever the ConcurrentRequestPolicy. The error responses carry
+	// `application/problem+json` bodies unless the errors are configured
+	// otherwise; the KeyLookup and errors of `DefaultIdempotencyConfig`
+	// count as not configured.
+	// Optional. Default value false.
+	StrictRFC bool `yaml:"strict_rfc"`
+
+	// DeriveKeyFromContent derives the key of the requests without one from
+	// their content, see `ContentKey`, e.g. for third-party webhook senders
+	// that retry without a key. Derived keys are subject to the key
+	// validation as well; they aren't checked against the fingerprint since
+	// they cover the content already.
+	// Optional. Default value false.
+	DeriveKeyFromContent bool `yaml:"derive_key_from_content"`
+
+	// DeriveKeyHeaders lists the request headers included in the derived
+	// keys.
+	// Optional. Default value nil.
+	DeriveKeyHeaders []string `yaml:"derive_key_headers"`
+
+	// MaxKeyBodySize limits the request body buffered to look the key up in
+	// the form or to derive it from the content; the body is restored for
+	// the handler. Requests with larger bodies get 413 Request Entity Too
+	// Large. The default FingerprintFunc spools the rest of larger bodies to
+	// a temporary file instead.
+	// Optional. Default value 10 MiB; negative disables the limit.
+	MaxKeyBodySize int64 `yaml:"max_key_body_size"`
+
+	// RequireKey makes the requests without an idempotency key get
+	// MissingKeyError instead of executing the handler.
+	// Optional. Default value false.
+	RequireKey bool `yaml:"require_key"`
+
+	// RequireKeyFunc decides per request, e.g. per route, whether the key is
+	// required; it takes precedence over RequireKey.
+	// Optional. Default value nil.
+	RequireKeyFunc func(echo.Context) bool
+
+	// MissingKeyError is returned for the requests missing a required key.
+	// Optional. Default value 400 Bad Request with a `KeyError` message.
+	MissingKeyError error
+
+	// MaxKeyLength is the maximum length of the idempotency keys; requests
+	// with longer keys get 400 Bad Request.
+	// Optional. Default value 255; negative disables the limit.
+	MaxKeyLength int `yaml:"max_key_length"`
+
+	// KeyPattern validates the format of the idempotency keys, e.g.
+	// `UUIDKeyPattern`; requests with other keys get 400 Bad Request.
+	// Optional. Default value nil (any format).
+	KeyPattern *regexp.Regexp
+
+	// ScopeFunc returns the scope of the request, e.g. the user and the
+	// route, combined with the idempotency key so different scopes never
+	// share a record.
+	// Optional. Default value DefaultScope.
+	ScopeFunc func(echo.Context) string
+
+	// DisableScope disables the scoping of the idempotency keys, so the
+	// records are shared by all requests with the same key.
+	// Optional. Default value false.
+	DisableScope bool `yaml:"disable_scope"`
+
+	// KeyPrefix is prepended to all store keys, so several services or
+	// environments can share a store.
+	// Optional. Default value "".
+	KeyPrefix string `yaml:"key_prefix"`
+
+	// HashTags wraps the idempotency keys in Redis Cluster hash tags, so a
+	// record and its auxiliary keys (locks, throttles, body chunks) land on
+	// the same cluster slot. Keys may contain `}` only when normalized, e.g.
+	// with `SHA256KeyNormalizer`. Changing it orphans the stored records.
+	// `ClaimKeys` isn't supported with it, since the claimed keys have hash
+	// tags of their own.
+	// Optional. Default value false.
+	HashTags bool `yaml:"hash_tags"`
+
+	// KeyNormalizer transforms the idempotency keys before they are used in
+	// the store keys, e.g. `SHA256KeyNormalizer` to bound their length.
+	// Optional. Default value nil (keys are used as is).
+	KeyNormalizer func(string) string
+
+	// TTL is the retention of the records, counted from the claim of the key.
+	// Optional. Default value 24 hours.
+	TTL time.Duration `yaml:"ttl"`
+
+	// TTLFunc returns the retention of the record of the request, e.g. per
+	// route or tenant. Values below a millisecond fall back to TTL.
+	// Optional. Default value nil.
+	TTLFunc func(echo.Context) time.Duration
+
+	// RefreshTTLOnCompletion restarts the retention of the records when they
+	// are completed instead of counting it from the claim of the key. A
+	// longer retention set by `ExtendTTL` is kept.
+	// Optional. Default value false.
+	RefreshTTLOnCompletion bool `yaml:"refresh_ttl_on_completion"`
+
+	// LeaseTTL is the lease of the in-flight records, renewed while their
+	// handler runs. Requests waiting on a record whose lease expired, e.g.
+	// because its process crashed, take it over and execute the handler.
+	// Optional. Default value 30 seconds. Negative values disable leases.
+	LeaseTTL time.Duration `yaml:"lease_ttl"`
+
+	// WriteTimeout bounds the store writes completing or releasing the
+	// record. They don't use the request context, so a client disconnecting
+	// after the handler returned doesn't leave the record in-flight.
+	// Optional. Default value 5 seconds.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	// PersistOnDisconnect stores the response even when the client went away
+	// before the handler returned. Otherwise the record is released, so a
+	// retry of the client executes the handler again.
+	// Optional. Default value false.
+	PersistOnDisconnect bool `yaml:"persist_on_disconnect"`
+
+	// AsyncPersistence stores the completed records in the background, so
+	// the first requests return as soon as their response is written instead
+	// of waiting for the store. Duplicates arriving meanwhile wait for the
+	// record as for an in-flight request. Records are stored synchronously
+	// while the queue of the workers is full.
+	// Optional. Default value false.
+	AsyncPersistence bool `yaml:"async_persistence"`
+
+	// AsyncWorkers is the number of goroutines storing the records of
+	// AsyncPersistence.
+	// Optional. Default value 4.
+	AsyncWorkers int `yaml:"async_workers"`
+
+	// AsyncQueueSize is the number of completed records waiting for a worker.
+	// Optional. Default value 1024.
+	AsyncQueueSize int `yaml:"async_queue_size"`
+
+	// OnPersistError is called when storing a record in the background
+	// failed, or with `ErrShuttingDown` when `Manager.Shutdown` dropped the
+	// write. The placeholder of the record is left to expire or to be taken
+	// over, as for a crashed process.
+	// Optional. Default value nil.
+	OnPersistError func(key string, err error)
+
+	// InstanceID identifies the process in the placeholders of the in-flight
+	// records, e.g. to tell which instance executes a pending request.
+	// Optional. Default value the hostname and the process ID.
+	InstanceID string `yaml:"instance_id"`
+
+	// Quota limits the approximate number of response body bytes stored by
+	// the middleware. Records that don't fit are stored without their body.
+	// Optional. Default value nil (unlimited).
+	Quota *Quota
+
+	// MemoryPressure detects store memory limit errors and record evictions
+	// and applies a degraded policy while they last.
+	// Optional. Default value nil (errors are returned as is).
+	MemoryPressure *MemoryPressure
+
+	// StorageErrorPolicy defines how the requests are handled when claiming
+	// their key fails due to a store error.
+	// Optional. Default value FailClosed.
+	StorageErrorPolicy StorageErrorPolicy `yaml:"storage_error_policy"`
+
+	// StorageErrorHandler handles the store errors instead of
+	// StorageErrorPolicy. The handler is executed without idempotency when it
+	// returns nil; the returned error is sent to the client otherwise.
+	// Optional. Default value nil.
+	StorageErrorHandler func(echo.Context, error) error
+
+	// CircuitBreaker skips the store for a cooldown after repeated store
+	// errors, handling the requests by the storage error policy with
+	// `ErrStoreUnavailable`.
+	// Optional. Default value nil.
+	CircuitBreaker *CircuitBreaker
+
+	// RefreshHeader is the request header that, when set to "true", forces
+	// the handler to be executed again and its record to be overwritten.
+	// Optional. Default value "X-Idempotency-Refresh".
+	RefreshHeader string `yaml:"refresh_header"`
+
+	// RefreshAuthorizer authorizes the refresh requests; the returned error
+	// is sent to the client. Refresh requests are ignored when it is nil.
+	// Optional. Default value nil.
+	RefreshAuthorizer func(echo.Context) error
+
+	// ReplayInterval is the minimum interval between two replays of the same
+	// key. Faster replays get 429 Too Many Requests with a Retry-After header.
+	// Optional. Default value 0 (unlimited).
+	ReplayInterval time.Duration `yaml:"replay_interval"`
+
+	// ReplayLimit is the retry budget of a key: the maximum number of
+	// replays of the same key per ReplayLimitWindow, counted in the store.
+	// Further replays get 429 Too Many Requests with a Retry-After header.
+	// Optional. Default value 0 (unlimited).
+	ReplayLimit int `yaml:"replay_limit"`
+
+	// ReplayLimitWindow is the window of ReplayLimit.
+	// Optional. Default value 1 minute.
+	ReplayLimitWindow time.Duration `yaml:"replay_limit_window"`
+
+	// ExcludeResponseHeaders lists the response headers neither stored nor
+	// replayed.
+	// Optional. Default value Set-Cookie, Date, Connection, Keep-Alive,
+	// Transfer-Encoding and Upgrade.
+	ExcludeResponseHeaders []string `yaml:"exclude_response_headers"`
+
+	// IncludeResponseHeaders limits the stored and replayed response headers
+	// to the listed ones, except the excluded ones.
+	// Optional. Default value nil (all headers).
+	IncludeResponseHeaders []string `yaml:"include_response_headers"`
+
+	// AuditRequestHeaders lists the request headers stored with the records
+	// for audit; "*" stores all of them.
+	// Optional. Default value nil (none).
+	AuditRequestHeaders []string `yaml:"audit_request_headers"`
+
+	// AuditExcludeRequestHeaders lists the request headers never stored for
+	// audit, even with "*".
+	// Optional. Default value Authorization, Cookie and Proxy-Authorization.
+	AuditExcludeRequestHeaders []string `yaml:"audit_exclude_request_headers"`
+
+	// AuditRequestBody defines what is stored of the request bodies with the
+	// records for audit.
+	// Optional. Default value AuditBodyNone.
+	AuditRequestBody AuditBody `yaml:"audit_request_body"`
+
+	// AuditMaxBodySize limits the request body read for audit. Larger bodies
+	// are audited by their first AuditMaxBodySize bytes: the digest and the
+	// stored body cover them, and the record has RequestBodyTruncated set.
+	// Optional. Default value 64 KiB; negative disables the limit.
+	AuditMaxBodySize int64 `yaml:"audit_max_body_size"`
+
+	// Redactor removes the personal data from the request bodies stored by
+	// `AuditBodyRedacted`, e.g. masking the card numbers of JSON bodies. It
+	// may modify the body it gets.
+	// Required with AuditBodyRedacted.
+	Redactor func([]byte) []byte
+
+	// DigestResponseBody stores the SHA-256 digest of the response bodies
+	// instead of the bodies, for the endpoints with sensitive payloads. The
+	// replays send the stored status and headers without a body.
+	// Optional. Default value false.
+	DigestResponseBody bool `yaml:"digest_response_body"`
+
+	// ReplayedHeader is the response header set to "true" on the replayed
+	// responses.
+	// Optional. Default value "Idempotency-Replayed".
+	ReplayedHeader string `yaml:"replayed_header"`
+
+	// OriginalDateHeader is the response header carrying the completion time
+	// of the original request on the replayed responses.
+	// Optional. Default value "Idempotency-Original-Date".
+	OriginalDateHeader string `yaml:"original_date_header"`
+
+	// DisableReplayHeaders disables the `ReplayedHeader` and
+	// `OriginalDateHeader` headers.
+	// Optional. Default value false.
+	DisableReplayHeaders bool `yaml:"disable_replay_headers"`
+
+	// WaitStrategy defines how a request waits for a concurrent request
+	// holding the same key to complete.
+	// Optional. Default value a `NotifyWait` polling with WaitPollInterval
+	// and WaitPollMaxInterval.
+	WaitStrategy WaitStrategy
+
+	// WaitPollInterval is the initial delay between two reads of the record
+	// of a concurrent request by the default WaitStrategy.
+	// Optional. Default value 500 milliseconds.
+	WaitPollInterval time.Duration `yaml:"wait_poll_interval"`
+
+	// WaitPollMaxInterval caps the delay between two reads of the record of
+	// a concurrent request; the delay doubles with jitter after each read.
+	// Optional. Default value 5 seconds.
+	WaitPollMaxInterval time.Duration `yaml:"wait_poll_max_interval"`
+
+	// ConcurrentRequestPolicy defines how a request is handled while a
+	// concurrent request holding the same key is in-flight.
+	// Optional. Default value ConcurrentWait.
+	ConcurrentRequestPolicy ConcurrentRequestPolicy `yaml:"concurrent_request_policy"`
+
+	// MaxWait limits how long a request waits for a concurrent request
+	// holding the same key, independently of the request context. Requests
+	// waiting longer get WaitTimeoutStatus.
+	// Optional. Default value 0 (until the request context is done).
+	MaxWait time.Duration `yaml:"max_wait"`
+
+	// WaitTimeoutStatus is the response status of the requests waiting
+	// longer than MaxWait, e.g. 504 Gateway Timeout.
+	// Optional. Default value 409 Conflict.
+	WaitTimeoutStatus int `yaml:"wait_timeout_status"`
+
+	// RetryAfterStatus is the response status of the `ConcurrentRetryAfter`
+	// policy.
+	// Optional. Default value 425 Too Early.
+	RetryAfterStatus int `yaml:"retry_after_status"`
+
+	// RetryAfter is the Retry-After delay of the `ConcurrentRetryAfter`
+	// policy.
+	// Optional. Default value 1 second.
+	RetryAfter time.Duration `yaml:"retry_after"`
+
+	// StoreOnStatusCodes lists the response status codes stored for replay.
+	// The requests responding with another status code don't store their
+	// response; the next request with the key executes the handler again.
+	// Optional. Default value nil (all but SkipOnStatusCodes).
+	StoreOnStatusCodes []int `yaml:"store_on_status_codes"`
+
+	// SkipOnStatusCodes lists the response status codes not stored for
+	// replay. An empty non-nil list stores all status codes.
+	// Optional. Default value 500-599.
+	SkipOnStatusCodes []int `yaml:"skip_on_status_codes"`
+
+	// RejectedTTL is the retention of the records of rejected requests, e.g.
+	// failing validation, so a client hammering a key with a bad request
+	// gets the stored rejection for a short while instead of executing the
+	// handler again. Rejected responses are stored regardless of
+	// StoreOnStatusCodes and SkipOnStatusCodes.
+	// Optional. Default value 0 (rejected responses are stored like others).
+	RejectedTTL time.Duration `yaml:"rejected_ttl"`
+
+	// RejectedStatusCodes lists the response status codes of the rejected
+	// requests stored with RejectedTTL.
+	// Optional. Default value 400-499.
+	RejectedStatusCodes []int `yaml:"rejected_status_codes"`
+
+	// MaxResponseBodySize limits the size of the stored response bodies, see
+	// `OversizePolicy`.
+	// Optional. Default value 0 (unlimited).
+	MaxResponseBodySize int64 `yaml:"max_response_body_size"`
+
+	// OversizePolicy defines how the responses exceeding
+	// `MaxResponseBodySize` or hijacking the connection are handled.
+	// Optional. Default value OversizeSkipStorage.
+	OversizePolicy OversizePolicy `yaml:"oversize_policy"`
+
+	// ResponseChunkSize splits the stored response bodies larger than it
+	// into chunks stored under separate keys.
+	// Optional. Default value 512 KiB; negative disables the chunking.
+	ResponseChunkSize int `yaml:"response_chunk_size"`
+
+	// Codec encodes the records in the store, e.g. `BinaryCodec`.
+	// Optional. Default value JSONCodec{}.
+	Codec Codec
+
+	// CompressionThreshold gzips the stored response bodies larger than it.
+	// Optional. Default value 0 (no compression).
+	CompressionThreshold int `yaml:"compression_threshold"`
+
+	// ClaimStrategy decides which one of the concurrent requests having the
+	// same key executes the handler.
+	// Optional. Default value StoreClaim{}.
+	ClaimStrategy ClaimStrategy
+
+	// OnEvent is called synchronously with the activities of the middleware,
+	// see `EventChannel` to consume them from a buffered channel.
+	// Optional. Default value nil.
+	OnEvent func(Event)
+
+	// Tracer traces the middleware and its store operations, e.g. with an
+	// OpenTelemetry adapter.
+	// Optional. Default value nil.
+	Tracer Tracer
+
+	// OnFirstRequest is called before the handler is executed for a key,
+	// e.g. to attach the key to the application context values.
+	// Optional. Default value nil.
+	OnFirstRequest func(c echo.Context, key string)
+
+	// OnReplay is called before a stored record is replayed.
+	// Optional. Default value nil.
+	OnReplay func(c echo.Context, key string, reqRec ReqRecord)
+
+	// ReplayTransformer may rewrite a stored record before it is replayed,
+	// e.g. to re-sign a URL or redact a header, keeping the business result
+	// identical. It gets the decoded body in ResponseBody; the Content-Length
+	// header follows its length. Returning an error aborts the replay.
+	// Optional. Default value nil.
+	ReplayTransformer func(c echo.Context, reqRec *ReqRecord) error
+
+	// OnConflict is called when a request is rejected since a concurrent
+	// request holds the key.
+	// Optional. Default value nil.
+	OnConflict func(c echo.Context, key string)
+
+	// MaxInFlight limits the number of first executions of idempotent
+	// requests running concurrently on the instance, so a flood of unique
+	// keys can't starve the requests that need to finish and persist.
+	// Optional. Default value 0 (unlimited).
+	MaxInFlight int `yaml:"max_in_flight"`
+
+	// InFlightQueueTimeout is how long a request waits for an in-flight slot
+	// before getting 503 Service Unavailable.
+	// Optional. Default value 0 (no waiting).
+	InFlightQueueTimeout time.Duration `yaml:"in_flight_queue_timeout"`
+
+	// DisableCoalescing makes the concurrent duplicates of a request on the
+	// instance claim and wait for the key on their own. By default they skip
+	// the claim of a key held by the instance and share a single wait, so a
+	// retry storm costs one store round-trip per poll instead of one per
+	// request.
+	// Optional. Default value false.
+	DisableCoalescing bool `yaml:"disable_coalescing"`
+
+	// FingerprintFunc computes the fingerprint of the request stored with
+	// its record. A key reused with a request having a different
+	// fingerprint gets FingerprintMismatchError instead of the stored
+	// response. Returning an empty fingerprint disables the check.
+	// Optional. Default value hashing the method, the path and the body of
+	// the request like RequestFingerprint, keeping up to MaxKeyBodySize
+	// bytes of the body in memory.
+	FingerprintFunc func(echo.Context) (string, error)
+
+	// FingerprintMismatchError is returned when a key is reused with a
+	// different request.
+	// Optional. Default value 422 Unprocessable Entity.
+	FingerprintMismatchError error
 }
 
 var DefaultIdempotencyConfig = IdempotencyConfig{
-	Skipper:   middleware.DefaultSkipper,
-	Methods:   []string{http.MethodPost},
-	KeyLookup: "header:X-Idempotency-Key",
-	TTL:       24 * time.Hour,
+	Skipper:       middleware.DefaultSkipper,
+	Methods:       []string{http.MethodPost},
+	KeyLookup:     "header:X-Idempotency-Key",
+	MaxKeyLength:  255,
+	ScopeFunc:     DefaultScope,
+	TTL:           24 * time.Hour,
+	LeaseTTL:      30 * time.Second,
+	WriteTimeout:  5 * time.Second,
+	RefreshHeader: "X-Idempotency-Refresh",
+
+	ExcludeResponseHeaders: []string{
+		echo.HeaderSetCookie,
+		"Date",
+		echo.HeaderConnection,
+		"Keep-Alive",
+		"Transfer-Encoding",
+		echo.HeaderUpgrade,
+	},
+
+	AuditExcludeRequestHeaders: []string{
+		echo.HeaderAuthorization,
+		echo.HeaderCookie,
+		"Proxy-Authorization",
+	},
+	AuditMaxBodySize: 64 << 10,
+
+	ReplayedHeader:     "Idempotency-Replayed",
+	OriginalDateHeader: "Idempotency-Original-Date",
+
+	WaitPollInterval:    500 * time.Millisecond,
+	WaitPollMaxInterval: 5 * time.Second,
+	WaitTimeoutStatus:   http.StatusConflict,
+
+	ClaimStrategy: StoreClaim{},
+	Codec:         JSONCodec{},
+
+	MaxKeyBodySize:    defaultMaxKeyBodySize,
+	ResponseChunkSize: 512 << 10,
+
+	RetryAfterStatus: http.StatusTooEarly,
+	RetryAfter:       time.Second,
+
+	ReplayLimitWindow: time.Minute,
+
+	AsyncWorkers:   4,
+	AsyncQueueSize: 1024,
+
+	MissingKeyError: keyError("idempotency_key_missing", ErrKeyMissing),
+
+	FingerprintMismatchError: echo.NewHTTPError(http.StatusUnprocessableEntity).SetInternal(ErrFingerprintMismatch),
 }
 
 func Idempotency() echo.MiddlewareFunc {
-	return IdempotencyWithConfig(DefaultIdempotencyConfig)
+	return MustIdempotencyWithConfig(DefaultIdempotencyConfig)
 }
 
 // ReqRecord ...
 type ReqRecord struct {
-	Done            bool                `json:"done"`
-	ResponseCode    int                 `json:"response_code"`
-	ResponseHeaders map[string][]string `json:"response_headers"`
-	ResponseBody    []byte              `json:"response_body"`
+	Done             bool                `json:"done"`
+	ResponseCode     int                 `json:"response_code"`
+	ResponseHeaders  map[string][]string `json:"response_headers"`
+	ResponseTrailers map[string][]string `json:"response_trailers,omitempty"`
+	ResponseBody     []byte              `json:"response_body"`
+	BodyOmitted      bool                `json:"body_omitted,omitempty"`
+	BodyTruncated    bool                `json:"body_truncated,omitempty"`
+	BodyEncoding     string              `json:"body_encoding,omitempty"`
+	BodyChunks       []string            `json:"body_chunks,omitempty"`
+	Groups           []string            `json:"groups,omitempty"`
+	Result           []byte              `json:"result,omitempty"`
+	Fingerprint      string              `json:"fingerprint,omitempty"`
+	LeaseExpiresAt   *time.Time          `json:"lease_expires_at,omitempty"`
+	Owner            string              `json:"owner,omitempty"`
+	CompletedAt      *time.Time          `json:"completed_at,omitempty"`
+	Method           string              `json:"method,omitempty"`
+	Path             string              `json:"path,omitempty"`
+	ReceivedAt       *time.Time          `json:"received_at,omitempty"`
+	Instance         string              `json:"instance,omitempty"`
+
+	// Audit details, see `AuditRequestHeaders`, `AuditRequestBody` and
+	// `DigestResponseBody`.
+	RequestHeaders       map[string][]string `json:"request_headers,omitempty"`
+	RequestBody          []byte              `json:"request_body,omitempty"`
+	RequestBodyDigest    string              `json:"request_body_digest,omitempty"`
+	RequestBodyTruncated bool                `json:"request_body_truncated,omitempty"`
+	ResponseBodyDigest   string              `json:"response_body_digest,omitempty"`
+
+	// raw is the encoding the record was read as, so a takeover swaps it
+	// without reading it again.
+	raw []byte
 }
 
-type bodyDumpResponseWriter struct {
-	io.Writer
-	http.ResponseWriter
+// IdempotencyWithConfig returns an Idempotency middleware with the config, or
+// a `*ConfigError` if the config is invalid.
+func IdempotencyWithConfig(config IdempotencyConfig) (echo.MiddlewareFunc, error) {
+	return config.ToMiddleware()
 }
 
-func IdempotencyWithConfig(config IdempotencyConfig) echo.MiddlewareFunc {
+// MustIdempotencyWithConfig is like `IdempotencyWithConfig` but panics with
+// the `*ConfigError` if the config is invalid.
+func MustIdempotencyWithConfig(config IdempotencyConfig) echo.MiddlewareFunc {
+	return NewManager(config).Middleware()
+}
+
+// Manager holds a configured Idempotency middleware and gives application
+// code access to the records it stores.
+type Manager struct {
+	base     IdempotencyConfig
+	config   IdempotencyConfig
+	inFlight chan struct{}
+	flights  *flightGroup
+	writes   *writeBehind
+
+	mu      sync.Mutex
+	active  map[*requestState]struct{}
+	idle    chan struct{}
+	closing bool
+	derived []*Manager
+	groups  []groupOverride
+}
+
+// ConfigError is the error of an invalid `IdempotencyConfig`.
+type ConfigError struct {
+	// Field is the name of the invalid field.
+	Field string
+
+	// Reason describes the problem.
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid idempotency configuration: %s", e.Reason)
+}
+
+// NewManager returns a `Manager` for the config, applying its defaults. It
+// panics with a `*ConfigError` if the config is invalid; see `ToManager`.
+func NewManager(config IdempotencyConfig) *Manager {
+	m, err := config.ToManager()
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// ToMiddleware returns the Idempotency middleware of the config, or a
+// `*ConfigError` if the config is invalid.
+func (config IdempotencyConfig) ToMiddleware() (echo.MiddlewareFunc, error) {
+	m, err := config.ToManager()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Middleware(), nil
+}
+
+// ToManager returns a `Manager` for the config, applying its defaults, or a
+// `*ConfigError` if the config is invalid.
+func (config IdempotencyConfig) ToManager() (*Manager, error) {
+	base := config
+
 	// Defaults
+	if config.Store == nil {
+		return nil, &ConfigError{Field: "Store", Reason: "store is required"}
+	}
+
+	if config.Tracer != nil {
+		config.Store = traceStore(config.Store, config.Tracer)
+	}
+
+	if config.StrictRFC {
+		applyStrictRFC(&config)
+	}
+
 	if config.Skipper == nil {
 		config.Skipper = DefaultIdempotencyConfig.Skipper
 	}
@@ -88,32 +648,206 @@ func IdempotencyWithConfig(config IdempotencyConfig) echo.MiddlewareFunc {
 		config.KeyLookup = DefaultIdempotencyConfig.KeyLookup
 	}
 
+	if config.MaxKeyBodySize == 0 {
+		config.MaxKeyBodySize = DefaultIdempotencyConfig.MaxKeyBodySize
+	}
+
 	if config.KeyLookupFunc == nil {
-		switch parts := strings.Split(config.KeyLookup, ":"); parts[0] {
-		case "header":
-			config.KeyLookupFunc = keyFromHeader(parts[1])
+		var extractors []KeyExtractor
+		for _, lookup := range strings.Split(config.KeyLookup, ",") {
+			parts := strings.SplitN(strings.TrimSpace(lookup), ":", 2)
+			if len(parts) != 2 {
+				return nil, &ConfigError{Field: "KeyLookup", Reason: fmt.Sprintf("invalid key lookup `%s`", lookup)}
+			}
+
+			switch parts[0] {
+			case "header":
+				if config.StrictRFC {
+					extractors = append(extractors, keyFromStructuredHeader(parts[1]))
+				} else {
+					extractors = append(extractors, keyFromHeader(parts[1]))
+				}
 
-		case "query":
-			config.KeyLookupFunc = keyFromQuery(parts[1])
+			case "query":
+				extractors = append(extractors, keyFromQuery(parts[1]))
 
-		case "form":
-			config.KeyLookupFunc = keyFromForm(parts[1])
+			case "form":
+				extractors = append(extractors, keyFromForm(parts[1], config.MaxKeyBodySize))
 
-		default:
-			panic(fmt.Errorf("invalid idempotency configuration: unknown key lookup `%s`", parts[0]))
+			default:
+				return nil, &ConfigError{Field: "KeyLookup", Reason: fmt.Sprintf("unknown key lookup `%s`", parts[0])}
+			}
 		}
+
+		config.KeyLookupFunc = keyFromChain(extractors)
+	}
+
+	if config.MissingKeyError == nil {
+		config.MissingKeyError = DefaultIdempotencyConfig.MissingKeyError
+	}
+
+	if config.MaxKeyLength == 0 {
+		config.MaxKeyLength = DefaultIdempotencyConfig.MaxKeyLength
+	}
+
+	if config.ScopeFunc == nil {
+		config.ScopeFunc = DefaultIdempotencyConfig.ScopeFunc
 	}
 
 	if config.TTL < time.Millisecond {
 		config.TTL = DefaultIdempotencyConfig.TTL
 	}
 
+	if config.LeaseTTL == 0 {
+		config.LeaseTTL = DefaultIdempotencyConfig.LeaseTTL
+	}
+
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = DefaultIdempotencyConfig.WriteTimeout
+	}
+
+	if config.AsyncWorkers <= 0 {
+		config.AsyncWorkers = DefaultIdempotencyConfig.AsyncWorkers
+	}
+
+	if config.AsyncQueueSize <= 0 {
+		config.AsyncQueueSize = DefaultIdempotencyConfig.AsyncQueueSize
+	}
+
+	if config.InstanceID == "" {
+		config.InstanceID = defaultInstanceID()
+	}
+
+	if config.RefreshHeader == "" {
+		config.RefreshHeader = DefaultIdempotencyConfig.RefreshHeader
+	}
+
+	if config.ExcludeResponseHeaders == nil {
+		config.ExcludeResponseHeaders = DefaultIdempotencyConfig.ExcludeResponseHeaders
+	}
+
+	if config.AuditExcludeRequestHeaders == nil {
+		config.AuditExcludeRequestHeaders = DefaultIdempotencyConfig.AuditExcludeRequestHeaders
+	}
+
+	if config.AuditMaxBodySize == 0 {
+		config.AuditMaxBodySize = DefaultIdempotencyConfig.AuditMaxBodySize
+	}
+
+	if config.AuditRequestBody == AuditBodyRedacted && config.Redactor == nil {
+		return nil, &ConfigError{Field: "Redactor", Reason: "redactor is required to store redacted request bodies"}
+	}
+
+	if config.ReplayedHeader == "" {
+		config.ReplayedHeader = DefaultIdempotencyConfig.ReplayedHeader
+	}
+
+	if config.OriginalDateHeader == "" {
+		config.OriginalDateHeader = DefaultIdempotencyConfig.OriginalDateHeader
+	}
+
+	if config.WaitPollInterval <= 0 {
+		config.WaitPollInterval = DefaultIdempotencyConfig.WaitPollInterval
+	}
+
+	if config.WaitPollMaxInterval <= 0 {
+		config.WaitPollMaxInterval = DefaultIdempotencyConfig.WaitPollMaxInterval
+	}
+
+	if config.WaitStrategy == nil {
+		config.WaitStrategy = &NotifyWait{
+			FallbackInterval:    config.WaitPollInterval,
+			MaxFallbackInterval: config.WaitPollMaxInterval,
+		}
+	}
+
+	if config.ReplayLimitWindow <= 0 {
+		config.ReplayLimitWindow = DefaultIdempotencyConfig.ReplayLimitWindow
+	}
+
+	if config.WaitTimeoutStatus == 0 {
+		config.WaitTimeoutStatus = DefaultIdempotencyConfig.WaitTimeoutStatus
+	}
+
+	if config.RetryAfterStatus == 0 {
+		config.RetryAfterStatus = DefaultIdempotencyConfig.RetryAfterStatus
+	}
+
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = DefaultIdempotencyConfig.RetryAfter
+	}
+
+	if config.ResponseChunkSize == 0 {
+		config.ResponseChunkSize = DefaultIdempotencyConfig.ResponseChunkSize
+	}
+
+	if config.Codec == nil {
+		config.Codec = DefaultIdempotencyConfig.Codec
+	}
+
+	if config.ClaimStrategy == nil {
+		config.ClaimStrategy = DefaultIdempotencyConfig.ClaimStrategy
+	}
+
+	if config.FingerprintFunc == nil {
+		config.FingerprintFunc = requestFingerprint(config.MaxKeyBodySize)
+	}
+
+	if config.FingerprintMismatchError == nil {
+		config.FingerprintMismatchError = DefaultIdempotencyConfig.FingerprintMismatchError
+	}
+
+	m := &Manager{base: base, config: config, active: make(map[*requestState]struct{})}
+	if config.MaxInFlight > 0 {
+		m.inFlight = make(chan struct{}, config.MaxInFlight)
+	}
+
+	if !config.DisableCoalescing {
+		m.flights = newFlightGroup()
+	}
+
+	if config.AsyncPersistence {
+		m.writes = newWriteBehind(config.AsyncWorkers, config.AsyncQueueSize)
+	}
+
+	return m, nil
+}
+
+// Middleware returns the Idempotency middleware of the manager. Requests of
+// the route groups overridden by `ForGroup` are handled with the config of
+// their group.
+func (m *Manager) Middleware() echo.MiddlewareFunc {
+	own := m.middleware()
+
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := own(next)
+
+		return func(c echo.Context) error {
+			if mw := m.groupMiddleware(c.Path()); mw != nil {
+				return mw(next)(c)
+			}
+
+			return h(c)
+		}
+	}
+}
+
+// middleware returns the Idempotency middleware of the manager's own config.
+func (m *Manager) middleware() echo.MiddlewareFunc {
+	config := m.config
+
+	mw := func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			if config.Skipper(c) {
 				return next(c)
 			}
 
+			// An outer Idempotency middleware handles the request already,
+			// e.g. the global one of a manager also used by `ForGroup`.
+			if _, handled := c.Get(KeyContextKey).(string); handled {
+				return next(c)
+			}
+
 			skip := true
 			for _, m := range config.Methods {
 				if c.Request().Method == m {
@@ -130,85 +864,710 @@ func IdempotencyWithConfig(config IdempotencyConfig) echo.MiddlewareFunc {
 				return err
 			}
 
+			derived := false
+			if !found && config.DeriveKeyFromContent {
+				if idempotencyKey, found, err = contentKey(config.MaxKeyBodySize, config.DeriveKeyHeaders)(c); err != nil {
+					return err
+				}
+
+				derived = true
+			}
+
 			if !found {
+				if keyRequired(config, c) {
+					return config.MissingKeyError
+				}
+
 				return next(c)
 			}
 
-			reqRec := ReqRecord{}
-			reqKey := fmt.Sprintf("req::%s", idempotencyKey)
-			reqData, err := json.Marshal(reqRec)
-			if err != nil {
+			if err := validateKey(config, idempotencyKey); err != nil {
 				return err
 			}
 
-			setOK, err := config.Rediser.SetNX(c.Request().Context(), reqKey, reqData, config.TTL).Result()
+			config.emit(EventKeyExtracted, idempotencyKey, 0, nil)
+			c.Set(KeyContextKey, idempotencyKey)
+
+			ctx, span := config.startSpan(c.Request().Context(), "idempotency")
+			defer span.End()
+
+			if config.Tracer != nil {
+				span.SetAttributes(Attr("idempotency.key_hash", keyHash(idempotencyKey)))
+			}
+
+			c.SetRequest(c.Request().WithContext(WithKey(ctx, idempotencyKey)))
+
+			refresh, err := refreshRequested(config, c)
 			if err != nil {
 				return err
 			}
 
-			if setOK {
-				resBody := new(bytes.Buffer)
-				mw := io.MultiWriter(c.Response().Writer, resBody)
-				writer := &bodyDumpResponseWriter{Writer: mw, ResponseWriter: c.Response().Writer}
-				c.Response().Writer = writer
+			degraded := config.MemoryPressure.policy()
+			if degraded == DegradeSkipCaching {
+				return next(c)
+			}
 
-				handlerErr := next(c)
+			if config.CircuitBreaker.open() {
+				if err := storageError(config, c, echo.NewHTTPError(http.StatusServiceUnavailable).SetInternal(ErrStoreUnavailable)); err != nil {
+					return err
+				}
 
-				reqRec.Done = true
-				reqRec.ResponseCode = c.Response().Status
-				reqRec.ResponseHeaders = c.Response().Header()
-				reqRec.ResponseBody = resBody.Bytes()
+				return next(c)
+			}
 
-				reqData, err := json.Marshal(reqRec)
-				if err != nil {
+			fingerprint := ""
+			if !derived {
+				if fingerprint, err = config.FingerprintFunc(c); err != nil {
 					return err
 				}
 
-				_, err = config.Rediser.Set(c.Request().Context(), reqKey, reqData, redis.KeepTTL).Result()
-				if err != nil {
-					return err
+				// The handler is done with a spooled body once it returned.
+				if body, ok := c.Request().Body.(*spooledBody); ok {
+					defer body.Close()
 				}
+			}
 
-				return handlerErr
+			audit, err := auditRequest(config, c.Request())
+			if err != nil {
+				return err
 			}
 
-			for {
-				reqDataStr, err := config.Rediser.Get(c.Request().Context(), reqKey).Result()
-				if err != nil {
+			ttl := config.TTL
+			if config.TTLFunc != nil {
+				if d := config.TTLFunc(c); d >= time.Millisecond {
+					ttl = d
+				}
+			}
+
+			scope := ""
+			if !config.DisableScope {
+				scope = config.ScopeFunc(c)
+			}
+
+			reqKey := config.recordKey(ScopedKey(scope, idempotencyKey))
+			owner, err := newOwner()
+			if err != nil {
+				return err
+			}
+
+			receivedAt := time.Now()
+			meta := ReqRecord{
+				Owner:       owner,
+				Method:      c.Request().Method,
+				Path:        c.Request().URL.Path,
+				Fingerprint: fingerprint,
+				ReceivedAt:  &receivedAt,
+				Instance:    config.InstanceID,
+			}
+
+			// The duplicates of a request holding the key on the instance don't
+			// claim it, so they don't need a placeholder.
+			claim := refresh || !m.flights.claimedLocally(reqKey)
+
+			var reqData []byte
+			if claim {
+				if reqData, err = newPlaceholder(config, meta); err != nil {
 					return err
 				}
+			}
+
+			if err := m.shuttingDown(); err != nil {
+				return err
+			}
+
+			// The errors of the in-flight slots are returned as they are,
+			// unlike the store errors.
+			var slotErr error
+			acquire := func() (func(), error) {
+				release, err := m.acquireInFlight(c)
+				slotErr = err
 
-				if err := json.Unmarshal([]byte(reqDataStr), &reqRec); err != nil {
+				return release, err
+			}
+
+			releaseInFlight := func() {}
+			defer func() { releaseInFlight() }()
+
+			release := func() {}
+			claimedAt := time.Now()
+			var setOK bool
+			if claim && !refresh {
+				var releaseSlot func()
+				if release, releaseSlot, setOK, err = claimKey(c.Request().Context(), config.ClaimStrategy, config.Store, reqKey, reqData, ttl, acquire); setOK {
+					releaseInFlight = releaseSlot
+				}
+			} else if releaseInFlight, err = acquire(); err == nil && refresh {
+				err = config.Store.Set(c.Request().Context(), reqKey, reqData, ttl)
+				setOK = err == nil
+			}
+
+			if slotErr != nil {
+				return slotErr
+			}
+
+			if err != nil {
+				config.emit(EventStoreError, idempotencyKey, 0, err)
+			}
+
+			if isOOMError(err) {
+				config.MemoryPressure.oom()
+
+				if config.MemoryPressure != nil && config.MemoryPressure.Policy == DegradeSkipCaching {
+					return next(c)
+				}
+
+				return &MemoryPressureError{Key: reqKey, Err: err}
+			}
+
+			if err != nil {
+				config.CircuitBreaker.failure()
+
+				if err := storageError(config, c, storeUnavailable(err)); err != nil {
 					return err
 				}
 
-				if reqRec.Done {
-					for k, vArr := range reqRec.ResponseHeaders {
-						for _, v := range vArr {
-							c.Response().Header().Set(k, v)
+				return next(c)
+			}
+
+			config.CircuitBreaker.success()
+
+			reqRec := ReqRecord{}
+			if !setOK {
+				releaseInFlight()
+
+				config.emit(EventWaitStarted, idempotencyKey, 0, nil)
+				waitStarted := time.Now()
+
+				for {
+					reqRec, err = wait(config, m.flights, c, reqKey)
+					if errors.Is(err, ErrRecordLost) {
+						// The record expired or was invalidated meanwhile;
+						// claim the key again.
+						config.emit(EventExpired, idempotencyKey, 0, err)
+
+						if reqData == nil {
+							if reqData, err = newPlaceholder(config, meta); err != nil {
+								return err
+							}
+						}
+
+						claimedAt = time.Now()
+						var releaseClaim func()
+						release, releaseClaim, setOK, err = claimKey(c.Request().Context(), config.ClaimStrategy, config.Store, reqKey, reqData, ttl, acquire)
+						if slotErr != nil {
+							return slotErr
+						}
+
+						if err != nil {
+							config.emit(EventStoreError, idempotencyKey, 0, err)
+
+							return err
 						}
+
+						if !setOK {
+							continue
+						}
+
+						config.observe(Event{Type: EventWaitFinished, Key: idempotencyKey, Duration: time.Since(waitStarted)})
+						waitEvent(span, time.Since(waitStarted))
+
+						defer releaseClaim()
+
+						break
+					}
+
+					if err != nil {
+						config.observe(Event{Type: EventWaitFinished, Key: idempotencyKey, Err: err, Duration: time.Since(waitStarted)})
+						waitEvent(span, time.Since(waitStarted))
+
+						switch {
+						case errors.Is(err, ErrConflict), errors.Is(err, ErrWaitTimeout):
+							config.emit(EventConflict, idempotencyKey, 0, nil)
+
+							if config.OnConflict != nil {
+								config.OnConflict(c, idempotencyKey)
+							}
+
+						case !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded):
+							config.emit(EventStoreError, idempotencyKey, 0, err)
+						}
+
+						return err
+					}
+
+					if reqRec.Done {
+						config.observe(Event{Type: EventWaitFinished, Key: idempotencyKey, Status: reqRec.ResponseCode, Duration: time.Since(waitStarted)})
+						waitEvent(span, time.Since(waitStarted))
+
+						break
+					}
+
+					// The owner of the record abandoned it; take it over. The
+					// in-flight slot is taken first, so a placeholder is never
+					// claimed by a request that can't execute.
+					releaseTakeover, err := m.acquireInFlight(c)
+					if err != nil {
+						return err
 					}
 
-					c.Response().WriteHeader(reqRec.ResponseCode)
+					claimedAt = time.Now()
+					reqData, setOK, err = takeOver(c.Request().Context(), config, reqKey, reqRec, meta, ttl)
+					if errors.Is(err, ErrFingerprintMismatch) {
+						releaseTakeover()
+						config.emit(EventFingerprintMismatch, idempotencyKey, 0, nil)
+
+						return config.FingerprintMismatchError
+					}
 
-					_, err = c.Response().Write(reqRec.ResponseBody)
 					if err != nil {
+						releaseTakeover()
+						config.emit(EventStoreError, idempotencyKey, 0, err)
+
+						return err
+					}
+
+					if !setOK {
+						releaseTakeover()
+
+						continue
+					}
+
+					config.observe(Event{Type: EventWaitFinished, Key: idempotencyKey, Duration: time.Since(waitStarted)})
+					waitEvent(span, time.Since(waitStarted))
+
+					release = func() {}
+
+					defer releaseTakeover()
+
+					break
+				}
+			}
+
+			if setOK {
+				state := &requestState{config: config, reqKey: reqKey, scope: scope, ttl: ttl, expires: claimedAt.Add(ttl), owner: owner, placeholder: reqData}
+
+				// The body is recycled once the record is stored.
+				body := getBuffer()
+
+				untrack, err := m.track(state)
+				if err != nil {
+					writeCtx, cancelWrite := writeContext(c.Request().Context(), config)
+					defer cancelWrite()
+
+					if err := releaseRecord(writeCtx, config, state); err != nil {
+						config.emit(EventStoreError, idempotencyKey, 0, err)
+					}
+
+					release()
+
+					return err
+				}
+
+				unclaim := m.flights.claim(reqKey)
+				done := func() {
+					// A late `SkipPersist` mustn't reset the buffer once
+					// another request got it.
+					state.mu.Lock()
+					state.writer = nil
+					state.mu.Unlock()
+
+					putBuffer(body)
+					unclaim()
+					release()
+					untrack()
+				}
+
+				// The background write releases the key once it completed.
+				background := false
+				defer func() {
+					if !background {
+						done()
+					}
+				}()
+
+				config.emit(EventClaimed, idempotencyKey, 0, nil)
+
+				c.Set(stateContextKey, state)
+
+				writer := &bodyDumpResponseWriter{
+					ResponseWriter: c.Response().Writer,
+					body:           body,
+					limit:          config.MaxResponseBodySize,
+					policy:         config.OversizePolicy,
+				}
+
+				if !persistSkipped(c) {
+					state.mu.Lock()
+					state.writer = writer
+					state.mu.Unlock()
+					c.Response().Writer = writer.wrap()
+
+					// Errors written by the error handler afterwards aren't
+					// copied to the recycled body.
+					defer func() { c.Response().Writer = writer.ResponseWriter }()
+				}
+
+				if config.OnFirstRequest != nil {
+					config.OnFirstRequest(c, idempotencyKey)
+				}
+
+				stopHeartbeat := startHeartbeat(config, state, meta)
+				handlerStarted := time.Now()
+				handlerErr := next(c)
+				handlerDuration := time.Since(handlerStarted)
+				stopHeartbeat()
+
+				status := c.Response().Status
+				if handlerErr != nil && !c.Response().Committed {
+					status = errorStatus(handlerErr)
+				}
+
+				disconnected := c.Request().Context().Err() != nil && !config.PersistOnDisconnect
+
+				writeCtx, cancelWrite := writeContext(c.Request().Context(), config)
+				defer cancelWrite()
+
+				if writer.hijacked || (writer.oversize && config.OversizePolicy != OversizeTruncate) || !(storable(config, status) || rejected(config, status)) || disconnected || persistSkipped(c) {
+					if err := releaseRecord(writeCtx, config, state); err != nil {
+						config.emit(EventStoreError, idempotencyKey, 0, err)
+
+						return err
+					}
+
+					return handlerErr
+				}
+
+				// Let the error handler write the response, so it is stored.
+				if handlerErr != nil && !c.Response().Committed {
+					c.Error(handlerErr)
+					handlerErr = nil
+				}
+
+				headers, trailers := splitTrailers(filterHeaders(config, c.Response().Header()))
+
+				completedAt := time.Now()
+				reqRec := ReqRecord{
+					Done:             true,
+					CompletedAt:      &completedAt,
+					ResponseCode:     c.Response().Status,
+					ResponseHeaders:  headers,
+					ResponseTrailers: trailers,
+					ResponseBody:     writer.body.Bytes(),
+					BodyTruncated:    writer.oversize,
+					Groups:           state.groups,
+					Result:           state.result,
+					Fingerprint:      fingerprint,
+					Method:           meta.Method,
+					Path:             meta.Path,
+					ReceivedAt:       meta.ReceivedAt,
+					Instance:         meta.Instance,
+
+					RequestHeaders:       audit.RequestHeaders,
+					RequestBody:          audit.RequestBody,
+					RequestBodyDigest:    audit.RequestBodyDigest,
+					RequestBodyTruncated: audit.RequestBodyTruncated,
+				}
+
+				persist := func(ctx context.Context, reqRec ReqRecord) error {
+					if err := finalizeRecord(ctx, config, state, reqRec, degraded); err != nil {
+						config.emit(EventStoreError, idempotencyKey, 0, err)
+
 						return err
 					}
 
+					config.observe(Event{Type: EventCompleted, Key: idempotencyKey, Status: reqRec.ResponseCode, Duration: handlerDuration})
+
 					return nil
 				}
 
-				select {
-				case <-c.Request().Context().Done():
-					return c.Request().Context().Err()
+				// The body is recycled once the record is stored, possibly in
+				// the background, so the context gets a copy taken before.
+				stored := reqRec
+				stored.ResponseBody = append([]byte(nil), reqRec.ResponseBody...)
+
+				if m.writes != nil {
+					reqCtx, bgRec := c.Request().Context(), reqRec.clone()
+
+					background = m.writes.enqueue(func() {
+						defer done()
+
+						ctx, cancel := writeContext(reqCtx, config)
+						defer cancel()
 
-				case <-time.After(500 * time.Millisecond):
-					continue
+						if err := persist(ctx, bgRec); err != nil && config.OnPersistError != nil {
+							config.OnPersistError(idempotencyKey, err)
+						}
+					}, func() {
+						defer done()
+
+						if config.OnPersistError != nil {
+							config.OnPersistError(idempotencyKey, ErrShuttingDown)
+						}
+					})
+
+					if background {
+						c.Set(RecordContextKey, &stored)
+
+						return handlerErr
+					}
 				}
+
+				if err := persist(writeCtx, reqRec); err != nil {
+					return err
+				}
+
+				c.Set(RecordContextKey, &stored)
+
+				return handlerErr
+			}
+
+			if !fingerprintMatches(reqRec, fingerprint) {
+				config.emit(EventFingerprintMismatch, idempotencyKey, 0, nil)
+
+				return config.FingerprintMismatchError
 			}
+
+			// Only the replays of completed records count, not the waits
+			// or the takeovers.
+			if err := throttleReplay(config, c, reqKey); err != nil {
+				return err
+			}
+
+			if err := limitReplays(config, c, reqKey); err != nil {
+				return err
+			}
+
+			span.AddEvent("replayed from cache", Attr("http.status_code", reqRec.ResponseCode))
+
+			c.Set(ReplayedContextKey, true)
+			c.Set(RecordContextKey, &reqRec)
+
+			if config.OnReplay != nil {
+				config.OnReplay(c, idempotencyKey, reqRec)
+			}
+
+			if err := transformReplay(config, c, &reqRec); err != nil {
+				return err
+			}
+
+			setReplayHeaders(config, c, reqRec)
+
+			if reqRec.Result != nil {
+				c.Set(resultContextKey, storedResult{data: reqRec.Result, codec: config.Codec})
+				config.emit(EventReplayed, idempotencyKey, reqRec.ResponseCode, nil)
+
+				return next(c)
+			}
+
+			addHeaders(c.Response().Header(), filterHeaders(config, reqRec.ResponseHeaders))
+
+			if reqRec.BodyOmitted || reqRec.BodyTruncated {
+				c.Response().Header().Del(echo.HeaderContentLength)
+			}
+
+			c.Response().WriteHeader(reqRec.ResponseCode)
+
+			if err := writeBody(c.Request().Context(), config.Store, c.Response(), reqRec); err != nil {
+				return err
+			}
+
+			// Trailers set after the body are sent once the handler returns.
+			addHeaders(c.Response().Header(), filterHeaders(config, reqRec.ResponseTrailers))
+
+			config.emit(EventReplayed, idempotencyKey, reqRec.ResponseCode, nil)
+
+			return nil
 		}
 	}
+
+	if config.StrictRFC {
+		return problemJSON(mw)
+	}
+
+	return mw
+}
+
+// finalizeRecord stores the completed record of the request claiming it.
+func finalizeRecord(ctx context.Context, config IdempotencyConfig, state *requestState, reqRec ReqRecord, degraded DegradedPolicy) error {
+	if config.DigestResponseBody {
+		reqRec.ResponseBodyDigest = bodyDigest(reqRec.ResponseBody)
+		reqRec.ResponseBody = nil
+		reqRec.BodyOmitted = true
+	}
+
+	if degraded == DegradeMetadataOnly {
+		reqRec.ResponseBody = nil
+		reqRec.BodyOmitted = true
+	}
+
+	ttl := state.ttl
+	if rejected(config, reqRec.ResponseCode) {
+		ttl = config.RejectedTTL
+	} else if !config.RefreshTTLOnCompletion {
+		ttl = state.remainingTTL()
+	} else if extended := time.Until(state.extended); extended > ttl {
+		ttl = extended
+	}
+
+	if !reqRec.BodyOmitted {
+		if err := compressBody(config, &reqRec); err != nil {
+			return err
+		}
+	}
+
+	var evict []string
+	stored := false
+	if config.Quota != nil && !reqRec.BodyOmitted {
+		evicted, unreserve, fits := config.Quota.reserve(state.reqKey, int64(len(reqRec.ResponseBody)), ttl)
+		if fits {
+			evict = evicted
+
+			// The reservation is dropped unless the body is stored.
+			defer func() {
+				if reqRec.BodyOmitted || !stored {
+					unreserve()
+				}
+			}()
+		} else {
+			reqRec.ResponseBody = nil
+			reqRec.BodyEncoding = ""
+			reqRec.BodyOmitted = true
+		}
+	}
+
+	var reqData []byte
+	err := storeChunks(ctx, config, state.reqKey, &reqRec, ttl)
+	if err == nil {
+		if reqData, err = config.Codec.Marshal(reqRec); err != nil {
+			return err
+		}
+
+		err = finalSet(ctx, config, state, reqData, ttl)
+	}
+
+	if isOOMError(err) {
+		config.MemoryPressure.oom()
+
+		if config.MemoryPressure == nil || config.MemoryPressure.Policy != DegradeMetadataOnly || reqRec.BodyOmitted {
+			return &MemoryPressureError{Key: state.reqKey, Err: err}
+		}
+
+		reqRec.ResponseBody = nil
+		reqRec.BodyEncoding = ""
+		reqRec.BodyChunks = nil
+		reqRec.BodyOmitted = true
+
+		if reqData, err = config.Codec.Marshal(reqRec); err != nil {
+			return err
+		}
+
+		err = finalSet(ctx, config, state, reqData, ttl)
+		if isOOMError(err) {
+			return &MemoryPressureError{Key: state.reqKey, Err: err}
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	stored = true
+
+	// A failed notification only delays the waiting requests until their
+	// next fallback read.
+	if notifier, ok := config.Store.(Notifier); ok {
+		_ = notifier.Notify(ctx, state.reqKey)
+	}
+
+	for _, k := range state.claimedKeys {
+		if err := config.Store.Set(ctx, k, reqData, ttl); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range evict {
+		if err := evictBody(ctx, config, k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finalSet replaces the placeholder of the request with its final record,
+// only if the request still owns it.
+func finalSet(ctx context.Context, config IdempotencyConfig, state *requestState, reqData []byte, ttl time.Duration) error {
+	swapped, err := config.Store.CompareAndSwap(ctx, state.reqKey, state.placeholder, reqData, ttl)
+	if err != nil {
+		return err
+	}
+
+	if swapped {
+		return nil
+	}
+
+	// A placeholder gone before the request released it was evicted by the
+	// store, unlike one taken over by another request.
+	if _, err := config.Store.Get(ctx, state.reqKey); errors.Is(err, ErrNotFound) {
+		config.MemoryPressure.lost()
+
+		return ErrRecordLost
+	}
+
+	return ErrOwnershipLost
+}
+
+// recordKey returns the store key of the record for the idempotency key.
+func (config IdempotencyConfig) recordKey(idempotencyKey string) string {
+	if config.KeyNormalizer != nil {
+		idempotencyKey = config.KeyNormalizer(idempotencyKey)
+	}
+
+	return config.storedKey(idempotencyKey)
+}
+
+// storedKey returns the store key of the record for the normalized key, as
+// listed by `Manager.List`.
+func (config IdempotencyConfig) storedKey(key string) string {
+	if config.HashTags {
+		return config.recordPrefix() + key + "}"
+	}
+
+	return config.recordPrefix() + key
+}
+
+// recordPrefix returns the common prefix of the store keys of the records.
+func (config IdempotencyConfig) recordPrefix() string {
+	if config.HashTags {
+		return config.KeyPrefix + "req::{"
+	}
+
+	return config.KeyPrefix + "req::"
+}
+
+// derivedKey returns the store key of the given kind derived from the record
+// key, keeping `KeyPrefix` at the start.
+func (config IdempotencyConfig) derivedKey(kind, reqKey string) string {
+	return config.KeyPrefix + kind + "::" + strings.TrimPrefix(reqKey, config.KeyPrefix)
+}
+
+// keyFromChain returns a `KeyExtractor` that tries the extractors in order
+// and returns the first key found.
+func keyFromChain(extractors []KeyExtractor) KeyExtractor {
+	if len(extractors) == 1 {
+		return extractors[0]
+	}
+
+	return func(c echo.Context) (string, bool, error) {
+		for _, extractor := range extractors {
+			key, found, err := extractor(c)
+			if err != nil || found {
+				return key, found, err
+			}
+		}
+
+		return "", false, nil
+	}
 }
 
 // keyFromHeader returns a `KeyExtractor` that extracts key from the request header.
@@ -235,10 +1594,16 @@ func keyFromQuery(param string) KeyExtractor {
 	}
 }
 
-// keyFromForm returns a `KeyExtractor` that extracts key from the form.
-func keyFromForm(param string) KeyExtractor {
+// keyFromForm returns a `KeyExtractor` that extracts key from the form. The
+// form is parsed from a copy of the body, so the handler can still read or
+// bind the body.
+func keyFromForm(param string, limit int64) KeyExtractor {
 	return func(c echo.Context) (string, bool, error) {
-		key := c.FormValue(param)
+		key, err := formValue(c.Request(), param, limit)
+		if err != nil {
+			return "", false, err
+		}
+
 		if key == "" {
 			return "", false, nil
 		}
@@ -246,19 +1611,3 @@ func keyFromForm(param string) KeyExtractor {
 		return key, true, nil
 	}
 }
-
-func (w *bodyDumpResponseWriter) WriteHeader(code int) {
-	w.ResponseWriter.WriteHeader(code)
-}
-
-func (w *bodyDumpResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
-}
-
-func (w *bodyDumpResponseWriter) Flush() {
-	w.ResponseWriter.(http.Flusher).Flush()
-}
-
-func (w *bodyDumpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return w.ResponseWriter.(http.Hijacker).Hijack()
-}
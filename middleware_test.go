@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestKeyLookupChain(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DisableScope: true, KeyLookup: "header:X-Key, query:key,form:key"})
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		info, _ := FromContext(c)
+
+		return c.String(http.StatusCreated, info.Key)
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		form   string
+		key    string
+	}{
+		{"header first", "h", "q", "f", "h"},
+		{"query next", "", "q", "f", "q"},
+		{"form last", "", "", "f", "f"},
+		{"none", "", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			if tt.form != "" {
+				form.Set("key", tt.form)
+			}
+
+			target := "/"
+			if tt.query != "" {
+				target += "?key=" + tt.query
+			}
+
+			req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			if tt.header != "" {
+				req.Header.Set("X-Key", tt.header)
+			}
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusCreated || rec.Body.String() != tt.key {
+				t.Fatalf("got status %d, key %q, want key %q", rec.Code, rec.Body.String(), tt.key)
+			}
+		})
+	}
+}
+
+func TestKeyLookupConfigError(t *testing.T) {
+	for _, lookup := range []string{"header", "cookie:key", "header:X-Key,param"} {
+		_, err := IdempotencyConfig{Store: NewMemoryStore(0), KeyLookup: lookup}.ToMiddleware()
+
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) || configErr.Field != "KeyLookup" {
+			t.Fatalf("KeyLookup %q: got %v, want a KeyLookup ConfigError", lookup, err)
+		}
+	}
+}
+
+func TestKeyLookupFunc(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DisableScope: true, KeyLookupFunc: func(c echo.Context) (string, bool, error) {
+		key := c.Param("id")
+
+		return key, key != "", nil
+	}})
+
+	executed := 0
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/orders/:id", func(c echo.Context) error {
+		executed++
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	for i := 0; i < 2; i++ {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/orders/1", strings.NewReader("body")))
+	}
+
+	if executed != 1 {
+		t.Fatalf("handler executed %d times, want once", executed)
+	}
+}
+
+func TestLifecycleCallbacks(t *testing.T) {
+	var calls []string
+
+	started, finish := make(chan struct{}), make(chan struct{})
+
+	m := NewManager(IdempotencyConfig{
+		Store:                   NewMemoryStore(0),
+		DisableScope:            true,
+		ConcurrentRequestPolicy: ConcurrentReject,
+		OnFirstRequest: func(c echo.Context, key string) {
+			calls = append(calls, "first:"+key)
+		},
+		OnReplay: func(c echo.Context, key string, reqRec ReqRecord) {
+			calls = append(calls, fmt.Sprintf("replay:%s:%d", key, reqRec.ResponseCode))
+		},
+		OnConflict: func(c echo.Context, key string) {
+			calls = append(calls, "conflict:"+key)
+		},
+	})
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		calls = append(calls, "handler")
+
+		if c.Request().Header.Get("X-Block") != "" {
+			close(started)
+			<-finish
+		}
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	send := func(key string, block bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", key)
+		if block {
+			req.Header.Set("X-Block", "true")
+		}
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	send("key", false)
+	send("key", false)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		send("busy", true)
+	}()
+
+	<-started
+
+	if code := send("busy", false); code != http.StatusConflict {
+		t.Fatalf("concurrent request: got status %d, want 409", code)
+	}
+
+	close(finish)
+	<-done
+
+	want := []string{"first:key", "handler", "replay:key:201", "first:busy", "handler", "conflict:busy"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Fatalf("got calls %q, want %q", calls, want)
+	}
+}
@@ -0,0 +1,14 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// SHA256KeyNormalizer is a `KeyNormalizer` replacing the keys with their
+// hex encoded SHA-256 digest, so arbitrarily long keys use bounded store keys.
+func SHA256KeyNormalizer(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRecordLost is returned when a record disappeared from the store before
+// the request that claimed it completed, typically because it was evicted.
+var ErrRecordLost = errors.New("idempotency record lost before completion")
+
+// MemoryPressureError is returned when the store refuses a write because it
+// reached its memory limit, e.g. the Redis `maxmemory`.
+type MemoryPressureError struct {
+	Key string
+	Err error
+}
+
+func (e *MemoryPressureError) Error() string {
+	return fmt.Sprintf("idempotency record `%s` rejected due to memory pressure: %v", e.Key, e.Err)
+}
+
+func (e *MemoryPressureError) Unwrap() error {
+	return e.Err
+}
+
+// DegradedPolicy defines how the middleware behaves while the store is under
+// memory pressure.
+type DegradedPolicy int
+
+const (
+	// DegradeNone keeps the regular behavior and surfaces the errors.
+	DegradeNone DegradedPolicy = iota
+
+	// DegradeSkipCaching executes the handlers without idempotency.
+	DegradeSkipCaching
+
+	// DegradeMetadataOnly stores the records without their response body.
+	DegradeMetadataOnly
+)
+
+// MemoryPressure detects the memory pressure of the store and switches the
+// middleware to a degraded policy until the pressure subsides.
+type MemoryPressure struct {
+	// Policy is applied while the pressure lasts.
+	Policy DegradedPolicy
+
+	// Cooldown defines how long the policy stays active after the last
+	// pressure signal.
+	// Optional. Default value 30 seconds.
+	Cooldown time.Duration
+
+	mu    sync.Mutex
+	until time.Time
+
+	oomErrors   uint64
+	lostRecords uint64
+	degraded    uint64
+}
+
+// MemoryPressureStats is a snapshot of the `MemoryPressure` counters.
+type MemoryPressureStats struct {
+	OOMErrors        uint64
+	LostRecords      uint64
+	DegradedRequests uint64
+}
+
+// NewMemoryPressure returns a `MemoryPressure` applying the given policy.
+func NewMemoryPressure(policy DegradedPolicy) *MemoryPressure {
+	return &MemoryPressure{Policy: policy}
+}
+
+// Degraded reports whether the degraded policy is currently active.
+func (p *MemoryPressure) Degraded() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return time.Now().Before(p.until)
+}
+
+// Stats returns a snapshot of the counters.
+func (p *MemoryPressure) Stats() MemoryPressureStats {
+	return MemoryPressureStats{
+		OOMErrors:        atomic.LoadUint64(&p.oomErrors),
+		LostRecords:      atomic.LoadUint64(&p.lostRecords),
+		DegradedRequests: atomic.LoadUint64(&p.degraded),
+	}
+}
+
+// policy returns the policy to apply for the current request.
+func (p *MemoryPressure) policy() DegradedPolicy {
+	if p == nil || p.Policy == DegradeNone || !p.Degraded() {
+		return DegradeNone
+	}
+
+	atomic.AddUint64(&p.degraded, 1)
+
+	return p.Policy
+}
+
+func (p *MemoryPressure) trip() {
+	cooldown := p.Cooldown
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.until = time.Now().Add(cooldown)
+}
+
+func (p *MemoryPressure) oom() {
+	if p == nil {
+		return
+	}
+
+	atomic.AddUint64(&p.oomErrors, 1)
+	p.trip()
+}
+
+func (p *MemoryPressure) lost() {
+	if p == nil {
+		return
+	}
+
+	atomic.AddUint64(&p.lostRecords, 1)
+	p.trip()
+}
+
+// isOOMError reports whether the store refused a write due to its memory limit.
+func isOOMError(err error) bool {
+	return errors.Is(err, ErrOutOfMemory)
+}
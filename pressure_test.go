@@ -0,0 +1,246 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestWaitRecordLost(t *testing.T) {
+	store := NewMemoryStore(0)
+	pressure := NewMemoryPressure(DegradeSkipCaching)
+	m := NewManager(IdempotencyConfig{Store: store, DisableScope: true, MemoryPressure: pressure, WaitPollInterval: 10 * time.Millisecond, MaxWait: 2 * time.Second})
+
+	// A concurrent request of another instance holds the key.
+	pending, err := m.config.Codec.Marshal(ReqRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqKey := m.config.recordKey("key")
+	if err := store.Set(context.Background(), reqKey, pending, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	var executed int32
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		atomic.AddInt32(&executed, 1)
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+
+		_ = m.Invalidate(context.Background(), "key")
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", "key")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated || atomic.LoadInt32(&executed) != 1 {
+		t.Fatalf("got status %d and %d executions, want the key claimed again", rec.Code, executed)
+	}
+
+	if pressure.Degraded() || pressure.Stats().LostRecords != 0 {
+		t.Fatal("a record invalidated while waiting counted as memory pressure")
+	}
+}
+
+func TestClaimedRecordLost(t *testing.T) {
+	store := NewMemoryStore(0)
+	pressure := NewMemoryPressure(DegradeSkipCaching)
+	m := NewManager(IdempotencyConfig{Store: store, DisableScope: true, MemoryPressure: pressure})
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		// The store evicts the placeholder while the handler runs.
+		if err := store.Delete(c.Request().Context(), m.config.recordKey("key")); err != nil {
+			return err
+		}
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", "key")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !pressure.Degraded() || pressure.Stats().LostRecords != 1 {
+		t.Fatalf("got stats %+v, want the lost placeholder counted", pressure.Stats())
+	}
+}
+
+// oomStore refuses the writes of the values longer than its limit, like a
+// Redis at its `maxmemory`.
+type oomStore struct {
+	Store
+	limit int64
+}
+
+func (s *oomStore) refuse(value []byte) error {
+	if int64(len(value)) > atomic.LoadInt64(&s.limit) {
+		return fmt.Errorf("OOM command not allowed when used memory > 'maxmemory': %w", ErrOutOfMemory)
+	}
+
+	return nil
+}
+
+func (s *oomStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	if err := s.refuse(value); err != nil {
+		return false, err
+	}
+
+	return s.Store.SetNX(ctx, key, value, ttl)
+}
+
+func (s *oomStore) CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error) {
+	if err := s.refuse(new); err != nil {
+		return false, err
+	}
+
+	return s.Store.CompareAndSwap(ctx, key, old, new, ttl)
+}
+
+// newPressureEcho returns an echo serving the keyed requests with the
+// manager, counting the executions of the handler.
+func newPressureEcho(m *Manager, body string, executed *int32) func(key string) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		atomic.AddInt32(executed, 1)
+
+		return c.String(http.StatusCreated, body)
+	})
+
+	return func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+}
+
+func TestOOMClaimSkipCaching(t *testing.T) {
+	store := &oomStore{Store: NewMemoryStore(0)}
+	pressure := NewMemoryPressure(DegradeSkipCaching)
+	m := NewManager(IdempotencyConfig{Store: store, DisableScope: true, MemoryPressure: pressure})
+
+	var executed int32
+	serve := newPressureEcho(m, "created", &executed)
+
+	// The store refuses the placeholder, the handler executes without
+	// idempotency.
+	if rec := serve("key"); rec.Code != http.StatusCreated || atomic.LoadInt32(&executed) != 1 {
+		t.Fatalf("got status %d and %d executions, want the handler executed", rec.Code, executed)
+	}
+
+	if !pressure.Degraded() || pressure.Stats().OOMErrors != 1 {
+		t.Fatalf("got stats %+v, want the OOM error counted", pressure.Stats())
+	}
+
+	// The store recovers, but the policy stays active during the cooldown.
+	atomic.StoreInt64(&store.limit, math.MaxInt64)
+
+	if rec := serve("key"); rec.Code != http.StatusCreated || atomic.LoadInt32(&executed) != 2 {
+		t.Fatalf("got status %d and %d executions, want the handler executed again", rec.Code, executed)
+	}
+
+	if stats := pressure.Stats(); stats.DegradedRequests != 1 || stats.OOMErrors != 1 {
+		t.Fatalf("got stats %+v, want the degraded request counted", stats)
+	}
+
+	if _, err := m.Lookup(context.Background(), "key"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want no record stored while degraded", err)
+	}
+}
+
+func TestOOMClaimSurfaced(t *testing.T) {
+	store := &oomStore{Store: NewMemoryStore(0)}
+	pressure := NewMemoryPressure(DegradeNone)
+	m := NewManager(IdempotencyConfig{Store: store, DisableScope: true, MemoryPressure: pressure})
+
+	h := m.Middleware()(func(c echo.Context) error {
+		t.Fatal("handler executed despite the OOM error")
+
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", "key")
+
+	var pressureErr *MemoryPressureError
+	if err := h(echo.New().NewContext(req, httptest.NewRecorder())); !errors.As(err, &pressureErr) || !errors.Is(err, ErrOutOfMemory) {
+		t.Fatalf("got %v, want a MemoryPressureError", err)
+	}
+
+	if pressureErr.Key != m.config.recordKey("key") || pressure.Stats().OOMErrors != 1 {
+		t.Fatalf("got key %q and stats %+v", pressureErr.Key, pressure.Stats())
+	}
+
+	// DegradeNone never skips the store.
+	if pressure.policy() != DegradeNone {
+		t.Fatal("DegradeNone applied a degraded policy")
+	}
+}
+
+func TestOOMCompletionMetadataOnly(t *testing.T) {
+	// The store takes the placeholders but not the records with the large,
+	// incompressible body.
+	body := make([]byte, 32<<10)
+	rand.New(rand.NewSource(1)).Read(body)
+
+	store := &oomStore{Store: NewMemoryStore(0), limit: 16 << 10}
+	pressure := NewMemoryPressure(DegradeMetadataOnly)
+	m := NewManager(IdempotencyConfig{Store: store, DisableScope: true, MemoryPressure: pressure})
+
+	var executed int32
+	serve := newPressureEcho(m, hex.EncodeToString(body), &executed)
+
+	if rec := serve("key"); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want the response of the handler", rec.Code)
+	}
+
+	reqRec, err := m.Lookup(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reqRec.BodyOmitted || len(reqRec.ResponseBody) != 0 || reqRec.ResponseCode != http.StatusCreated {
+		t.Fatalf("got record %+v, want the metadata stored without the body", reqRec)
+	}
+
+	if !pressure.Degraded() || pressure.Stats().OOMErrors != 1 {
+		t.Fatalf("got stats %+v, want the OOM error counted", pressure.Stats())
+	}
+
+	// While degraded, the records are stored without their body at once.
+	serve("other")
+
+	if reqRec, err := m.Lookup(context.Background(), "other"); err != nil || !reqRec.BodyOmitted {
+		t.Fatalf("got record %+v, %v, want the body omitted", reqRec, err)
+	}
+
+	if stats := pressure.Stats(); stats.OOMErrors != 1 || stats.DegradedRequests != 1 || atomic.LoadInt32(&executed) != 2 {
+		t.Fatalf("got stats %+v and %d executions", stats, executed)
+	}
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+// keyContextKey is the context key of the idempotency key of the request.
+type keyContextKey struct{}
+
+// WithKey returns a copy of the context carrying the idempotency key.
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyContextKey{}, key)
+}
+
+// KeyFromContext returns the idempotency key carried by the context. The
+// middleware sets it on the context of every request having a key.
+func KeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(keyContextKey{}).(string)
+
+	return key, ok
+}
+
+// ChildKey derives the idempotency key of a downstream call from the key
+// carried by the context, e.g. "<key>:payment-service". A retried inbound
+// request derives identical keys for its downstream calls.
+//
+// `KeyTransport` propagates the child keys over HTTP; the interceptors of the
+// `propagation/grpc` module propagate them over gRPC, so the root module
+// doesn't depend on gRPC.
+func ChildKey(ctx context.Context, name string) (string, bool) {
+	key, ok := KeyFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+
+	return key + ":" + name, true
+}
+
+// KeyTransport is an `http.RoundTripper` that sets the idempotency key header
+// of outgoing requests to the child key derived from the request context.
+// Requests already having the header are sent as is.
+type KeyTransport struct {
+	// Base is the underlying transport.
+	// Optional. Default value http.DefaultTransport.
+	Base http.RoundTripper
+
+	// Header is the header carrying the child key.
+	// Optional. Default value "X-Idempotency-Key".
+	Header string
+
+	// Name is appended to the parent key to derive the child key.
+	Name string
+}
+
+// NewKeyTransport returns a `KeyTransport` deriving child keys with the name.
+func NewKeyTransport(base http.RoundTripper, name string) *KeyTransport {
+	return &KeyTransport{Base: base, Name: name}
+}
+
+// RoundTrip implements `http.RoundTripper`.
+func (t *KeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	header := t.Header
+	if header == "" {
+		header = "X-Idempotency-Key"
+	}
+
+	if req.Header.Get(header) != "" {
+		return base.RoundTrip(req)
+	}
+
+	key, ok := ChildKey(req.Context(), t.Name)
+	if !ok {
+		return base.RoundTrip(req)
+	}
+
+	// RoundTrip must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set(header, key)
+
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,8 @@
+module github.com/mgurevin/echo-idempotency/propagation/grpc
+
+go 1.18
+
+require (
+	github.com/mgurevin/echo-idempotency v0.1.0
+	google.golang.org/grpc v1.47.0
+)
@@ -0,0 +1,89 @@
+// Package grpc propagates the idempotency keys over gRPC: the client
+// interceptors send the child keys derived from the key of the context, see
+// `middleware.ChildKey`, and the server interceptors put the received key on
+// the context of the handlers with `middleware.WithKey`.
+package grpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+// MetadataKey is the metadata key carrying the idempotency keys.
+const MetadataKey = "x-idempotency-key"
+
+// UnaryClientInterceptor returns an interceptor sending the child key
+// derived with the name from the context of the calls. The calls already
+// carrying a key are sent as is.
+func UnaryClientInterceptor(name string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingContext(ctx, name), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor is the `UnaryClientInterceptor` of the streams.
+func StreamClientInterceptor(name string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingContext(ctx, name), desc, cc, method, opts...)
+	}
+}
+
+// UnaryServerInterceptor returns an interceptor passing the key received
+// with the calls on to the handlers, so they derive the keys of their own
+// downstream calls.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(incomingContext(ctx), req)
+	}
+}
+
+// StreamServerInterceptor is the `UnaryServerInterceptor` of the streams.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, keyStream{ServerStream: ss, ctx: incomingContext(ss.Context())})
+	}
+}
+
+// outgoingContext returns the context with the child key in its outgoing
+// metadata.
+func outgoingContext(ctx context.Context, name string) context.Context {
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(MetadataKey)) > 0 {
+		return ctx
+	}
+
+	key, ok := middleware.ChildKey(ctx, name)
+	if !ok {
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, MetadataKey, key)
+}
+
+// incomingContext returns the context carrying the key of its incoming
+// metadata.
+func incomingContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+
+	if keys := md.Get(MetadataKey); len(keys) > 0 && keys[0] != "" {
+		return middleware.WithKey(ctx, keys[0])
+	}
+
+	return ctx
+}
+
+// keyStream is a server stream with the context carrying the key.
+type keyStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s keyStream) Context() context.Context {
+	return s.ctx
+}
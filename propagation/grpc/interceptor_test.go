@@ -0,0 +1,116 @@
+package grpc
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+// sentKeys returns the keys sent by the client interceptor with the context.
+func sentKeys(t *testing.T, ctx context.Context) []string {
+	t.Helper()
+
+	var keys []string
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		keys = md.Get(MetadataKey)
+
+		return nil
+	}
+
+	if err := UnaryClientInterceptor("payments")(ctx, "/payments.Payments/Charge", nil, nil, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	ctx := middleware.WithKey(context.Background(), "key")
+
+	if keys := sentKeys(t, ctx); len(keys) != 1 || keys[0] != "key:payments" {
+		t.Fatalf("got keys %q, want the child key", keys)
+	}
+
+	explicit := metadata.AppendToOutgoingContext(ctx, MetadataKey, "explicit")
+	if keys := sentKeys(t, explicit); len(keys) != 1 || keys[0] != "explicit" {
+		t.Fatalf("got keys %q, want the key of the call", keys)
+	}
+
+	if keys := sentKeys(t, context.Background()); len(keys) != 0 {
+		t.Fatalf("got keys %q without a key, want none", keys)
+	}
+}
+
+func TestStreamClientInterceptor(t *testing.T) {
+	var keys []string
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		keys = md.Get(MetadataKey)
+
+		return nil, nil
+	}
+
+	ctx := middleware.WithKey(context.Background(), "key")
+	if _, err := StreamClientInterceptor("payments")(ctx, &grpc.StreamDesc{}, nil, "/payments.Payments/Watch", streamer); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys[0] != "key:payments" {
+		t.Fatalf("got keys %q, want the child key", keys)
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(MetadataKey, "key:payments"))
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		// The handler derives the keys of its own downstream calls.
+		key, _ := middleware.ChildKey(ctx, "ledger")
+
+		return key, nil
+	}
+
+	got, err := UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+	if err != nil || got != "key:payments:ledger" {
+		t.Fatalf("got %v, %v, want the key derived from the received one", got, err)
+	}
+
+	got, err = UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{}, handler)
+	if err != nil || got != "" {
+		t.Fatalf("got %v, %v without a key, want none", got, err)
+	}
+}
+
+// serverStream is a server stream with a context.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(MetadataKey, "key"))
+
+	var got string
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		got, _ = middleware.KeyFromContext(ss.Context())
+
+		return nil
+	}
+
+	if err := StreamServerInterceptor()(nil, serverStream{ctx: ctx}, &grpc.StreamServerInfo{}, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "key" {
+		t.Fatalf("got key %q, want the received one", got)
+	}
+}
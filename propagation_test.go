@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestKeyTransport(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("X-Idempotency-Key")+"|"+r.Header.Get("X-Payment-Key"))
+	}))
+	defer downstream.Close()
+
+	client := &http.Client{Transport: NewKeyTransport(downstream.Client().Transport, "payments")}
+	custom := &http.Client{Transport: &KeyTransport{Base: downstream.Client().Transport, Header: "X-Payment-Key", Name: "payments"}}
+
+	call := func(ctx context.Context, client *http.Client, key string) string {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, downstream.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key != "" {
+			req.Header.Set("X-Idempotency-Key", key)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The request of the caller isn't modified.
+		if key == "" && req.Header.Get("X-Idempotency-Key") != "" {
+			t.Fatal("the outgoing request is modified")
+		}
+
+		return string(body)
+	}
+
+	mw, err := IdempotencyConfig{Store: NewMemoryStore(0)}.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(mw)
+	e.POST("/", func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		return c.String(http.StatusCreated, strings.Join([]string{
+			call(ctx, client, ""),
+			call(ctx, client, "explicit"),
+			call(ctx, custom, ""),
+		}, ","))
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", "key")
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if want := "key:payments|,explicit|,|key:payments"; rec.Body.String() != want {
+		t.Fatalf("got downstream keys %q, want %q", rec.Body.String(), want)
+	}
+
+	// Without a key in the context, the requests are sent as is.
+	if got := call(context.Background(), client, ""); got != "|" {
+		t.Fatalf("got downstream keys %q without a key, want none", got)
+	}
+}
+
+func TestChildKey(t *testing.T) {
+	if _, ok := ChildKey(context.Background(), "payments"); ok {
+		t.Fatal("got a child key without a key")
+	}
+
+	ctx := WithKey(context.Background(), "key")
+	if key, ok := KeyFromContext(ctx); !ok || key != "key" {
+		t.Fatalf("got key %q, %v", key, ok)
+	}
+
+	if key, ok := ChildKey(ctx, "payments"); !ok || key != "key:payments" {
+		t.Fatalf("got child key %q, %v", key, ok)
+	}
+}
@@ -0,0 +1,187 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuotaPolicy defines what a `Quota` does when storing a response body would
+// exceed its budget.
+type QuotaPolicy int
+
+const (
+	// QuotaRefuse stores the record without its response body.
+	QuotaRefuse QuotaPolicy = iota
+
+	// QuotaEvictOldest drops the bodies of the oldest stored records until
+	// the new body fits into the budget.
+	QuotaEvictOldest
+
+	// QuotaEvictLargest drops the bodies of the largest stored records until
+	// the new body fits into the budget.
+	QuotaEvictLargest
+)
+
+// Quota tracks the approximate number of response body bytes stored by the
+// middleware and enforces a budget on them, so the middleware can't push
+// other data out of a shared store. The accounting is local to the process.
+type Quota struct {
+	// MaxBytes is the budget of stored response body bytes.
+	MaxBytes int64
+
+	// Policy defines what happens when the budget would be exceeded.
+	Policy QuotaPolicy
+
+	mu      sync.Mutex
+	used    int64
+	entries map[string]*quotaEntry
+}
+
+type quotaEntry struct {
+	key       string
+	size      int64
+	storedAt  time.Time
+	expiresAt time.Time
+}
+
+// NewQuota returns a `Quota` with the given budget and policy.
+func NewQuota(maxBytes int64, policy QuotaPolicy) *Quota {
+	return &Quota{MaxBytes: maxBytes, Policy: policy}
+}
+
+// Used returns the approximate number of response body bytes currently stored.
+func (q *Quota) Used() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune(time.Now())
+
+	return q.used
+}
+
+// reserve accounts a body of the given size stored under the key. It returns
+// the keys whose bodies must be evicted to make room, a function dropping the
+// reservation when the body isn't stored after all and whether the body may
+// be stored at all.
+func (q *Quota) reserve(key string, size int64, ttl time.Duration) ([]string, func(), bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	q.prune(now)
+	q.remove(key)
+
+	if size > q.MaxBytes {
+		return nil, nil, false
+	}
+
+	var evict []string
+	if q.used+size > q.MaxBytes {
+		if q.Policy == QuotaRefuse {
+			return nil, nil, false
+		}
+
+		candidates := make([]*quotaEntry, 0, len(q.entries))
+		for _, e := range q.entries {
+			candidates = append(candidates, e)
+		}
+
+		sort.Slice(candidates, func(i, j int) bool {
+			if q.Policy == QuotaEvictLargest {
+				return candidates[i].size > candidates[j].size
+			}
+
+			return candidates[i].storedAt.Before(candidates[j].storedAt)
+		})
+
+		for _, e := range candidates {
+			if q.used+size <= q.MaxBytes {
+				break
+			}
+
+			q.remove(e.key)
+			evict = append(evict, e.key)
+		}
+	}
+
+	if q.entries == nil {
+		q.entries = make(map[string]*quotaEntry)
+	}
+
+	entry := &quotaEntry{key: key, size: size, storedAt: now, expiresAt: now.Add(ttl)}
+	q.entries[key] = entry
+	q.used += size
+
+	unreserve := func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		// A later request may have reserved the key meanwhile.
+		if q.entries[key] == entry {
+			q.remove(key)
+		}
+	}
+
+	return evict, unreserve, true
+}
+
+// release drops the accounting of the key.
+func (q *Quota) release(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.remove(key)
+}
+
+func (q *Quota) remove(key string) {
+	if e, ok := q.entries[key]; ok {
+		q.used -= e.size
+		delete(q.entries, key)
+	}
+}
+
+func (q *Quota) prune(now time.Time) {
+	for k, e := range q.entries {
+		if now.After(e.expiresAt) {
+			q.remove(k)
+		}
+	}
+}
+
+// evictBody rewrites the record stored under the key without its response
+// body, keeping the remaining metadata and TTL.
+func evictBody(ctx context.Context, config IdempotencyConfig, key string) error {
+	reqRec, err := getRecord(ctx, config.Store, config.Codec, key)
+	if errors.Is(err, ErrRecordLost) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !reqRec.Done || reqRec.BodyOmitted {
+		return nil
+	}
+
+	chunks := reqRec.BodyChunks
+
+	reqRec.ResponseBody = nil
+	reqRec.BodyEncoding = ""
+	reqRec.BodyChunks = nil
+	reqRec.BodyOmitted = true
+
+	reqData, err := config.Codec.Marshal(reqRec)
+	if err != nil {
+		return err
+	}
+
+	if err := config.Store.Set(ctx, key, reqData, KeepTTL); err != nil {
+		return err
+	}
+
+	return config.Store.Delete(ctx, chunks...)
+}
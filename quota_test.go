@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// casFailingStore fails the final writes of the records.
+type casFailingStore struct {
+	Store
+	err error
+}
+
+func (s casFailingStore) CompareAndSwap(context.Context, string, []byte, []byte, time.Duration) (bool, error) {
+	return false, s.err
+}
+
+func TestQuotaUnstoredBody(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"ownership lost", nil},
+		{"store error", errStoreDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quota := NewQuota(1<<20, QuotaRefuse)
+
+			e := echo.New()
+			e.Use(MustIdempotencyWithConfig(IdempotencyConfig{Store: casFailingStore{NewMemoryStore(0), tt.err}, Quota: quota}))
+			e.POST("/", func(c echo.Context) error {
+				return c.String(http.StatusCreated, "created")
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+			req.Header.Set("X-Idempotency-Key", "key")
+			e.ServeHTTP(httptest.NewRecorder(), req)
+
+			if used := quota.Used(); used != 0 {
+				t.Fatalf("got %d bytes used after the final write failed, want 0", used)
+			}
+		})
+	}
+}
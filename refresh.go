@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// refreshRequested reports whether the request asks to re-execute the handler
+// and overwrite the stored record. Refresh requests must pass the
+// `RefreshAuthorizer`; they are ignored when no authorizer is configured.
+func refreshRequested(config IdempotencyConfig, c echo.Context) (bool, error) {
+	if config.RefreshAuthorizer == nil {
+		return false, nil
+	}
+
+	refresh, err := strconv.ParseBool(c.Request().Header.Get(config.RefreshHeader))
+	if err != nil || !refresh {
+		return false, nil
+	}
+
+	if err := config.RefreshAuthorizer(c); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
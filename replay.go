@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// filterHeaders returns the headers allowed by `ExcludeResponseHeaders` and
+// `IncludeResponseHeaders`.
+func filterHeaders(config IdempotencyConfig, h map[string][]string) map[string][]string {
+	filtered := make(map[string][]string, len(h))
+	for k, v := range h {
+		if containsHeader(config.ExcludeResponseHeaders, k) {
+			continue
+		}
+
+		if config.IncludeResponseHeaders != nil && !containsHeader(config.IncludeResponseHeaders, k) {
+			continue
+		}
+
+		filtered[k] = v
+	}
+
+	return filtered
+}
+
+// splitTrailers separates the trailers, i.e. the headers declared by the
+// Trailer header or prefixed with `http.TrailerPrefix`, from the headers.
+func splitTrailers(h map[string][]string) (map[string][]string, map[string][]string) {
+	declared := map[string]bool{}
+	for _, v := range h["Trailer"] {
+		for _, name := range strings.Split(v, ",") {
+			declared[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	headers := make(map[string][]string, len(h))
+	var trailers map[string][]string
+
+	for k, v := range h {
+		if !declared[k] && !strings.HasPrefix(k, http.TrailerPrefix) {
+			headers[k] = v
+
+			continue
+		}
+
+		if trailers == nil {
+			trailers = make(map[string][]string)
+		}
+
+		trailers[k] = v
+	}
+
+	return headers, trailers
+}
+
+// addHeaders replaces the headers with the values, keeping all values of the
+// multi-value headers in order.
+func addHeaders(h http.Header, values map[string][]string) {
+	for k, vArr := range values {
+		h.Del(k)
+
+		for _, v := range vArr {
+			h.Add(k, v)
+		}
+	}
+}
+
+func containsHeader(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setReplayHeaders marks the response as a replay of the record.
+func setReplayHeaders(config IdempotencyConfig, c echo.Context, reqRec ReqRecord) {
+	if config.DisableReplayHeaders {
+		return
+	}
+
+	c.Response().Header().Set(config.ReplayedHeader, "true")
+
+	if reqRec.CompletedAt != nil {
+		c.Response().Header().Set(config.OriginalDateHeader, reqRec.CompletedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// transformReplay passes the record to the `ReplayTransformer`, with its
+// body loaded and decoded.
+func transformReplay(config IdempotencyConfig, c echo.Context, reqRec *ReqRecord) error {
+	if config.ReplayTransformer == nil {
+		return nil
+	}
+
+	if !reqRec.BodyOmitted {
+		body, err := readBody(c.Request().Context(), config.Store, *reqRec)
+		if err != nil {
+			return err
+		}
+
+		reqRec.ResponseBody = body
+		reqRec.BodyEncoding = ""
+		reqRec.BodyChunks = nil
+	}
+
+	size := len(reqRec.ResponseBody)
+
+	if err := config.ReplayTransformer(c, reqRec); err != nil {
+		return err
+	}
+
+	if len(reqRec.ResponseBody) != size && http.Header(reqRec.ResponseHeaders).Get(echo.HeaderContentLength) != "" {
+		http.Header(reqRec.ResponseHeaders).Set(echo.HeaderContentLength, strconv.Itoa(len(reqRec.ResponseBody)))
+	}
+
+	return nil
+}
@@ -0,0 +1,230 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newReplayEcho returns an echo with the middleware of the manager and the
+// handler on POST /, and a func sending a request with the key to it.
+func newReplayEcho(m *Manager, h echo.HandlerFunc) func(key string) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", h)
+
+	return func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", key)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+}
+
+func TestFilterHeaders(t *testing.T) {
+	h := func(c echo.Context) error {
+		c.SetCookie(&http.Cookie{Name: "session", Value: "secret"})
+		c.Response().Header().Set("X-Request-Id", "first")
+		c.Response().Header().Add("X-Custom", "a")
+		c.Response().Header().Add("X-Custom", "b")
+
+		return c.String(http.StatusCreated, "created")
+	}
+
+	tests := []struct {
+		name     string
+		config   IdempotencyConfig
+		replayed []string
+		dropped  []string
+	}{
+		{"default exclusions", IdempotencyConfig{}, []string{"X-Request-Id", "X-Custom", echo.HeaderContentType}, []string{echo.HeaderSetCookie}},
+		{"exclusions", IdempotencyConfig{ExcludeResponseHeaders: []string{"x-request-id"}}, []string{"X-Custom", echo.HeaderSetCookie}, []string{"X-Request-Id"}},
+		{"inclusions", IdempotencyConfig{IncludeResponseHeaders: []string{"X-Custom", "Set-Cookie"}}, []string{"X-Custom"}, []string{"X-Request-Id", echo.HeaderContentType, echo.HeaderSetCookie}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Store = NewMemoryStore(0)
+			tt.config.DisableScope = true
+			m := NewManager(tt.config)
+
+			send := newReplayEcho(m, h)
+			send("key")
+
+			reqRec, err := m.Lookup(context.Background(), "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := send("key")
+			if rec.Header().Get("Idempotency-Replayed") != "true" {
+				t.Fatalf("got headers %v, want a replay", rec.Header())
+			}
+
+			for _, name := range tt.replayed {
+				if len(http.Header(reqRec.ResponseHeaders).Values(name)) == 0 || len(rec.Header().Values(name)) == 0 {
+					t.Fatalf("%s isn't stored or replayed: stored %v, replayed %v", name, reqRec.ResponseHeaders, rec.Header())
+				}
+			}
+
+			for _, name := range tt.dropped {
+				if len(http.Header(reqRec.ResponseHeaders).Values(name)) != 0 || len(rec.Header().Values(name)) != 0 {
+					t.Fatalf("%s is stored or replayed: stored %v, replayed %v", name, reqRec.ResponseHeaders, rec.Header())
+				}
+			}
+
+			// The multi-value headers keep their values in order.
+			if got := rec.Header().Values("X-Custom"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+				t.Fatalf("got X-Custom %q, want [a b]", got)
+			}
+		})
+	}
+}
+
+func TestReplayTrailers(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DisableScope: true})
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		c.Response().Header().Set("Trailer", "X-Checksum")
+		c.Response().Header().Add("Link", "</a>; rel=a")
+		c.Response().Header().Add("Link", "</b>; rel=b")
+
+		if err := c.String(http.StatusCreated, "created"); err != nil {
+			return err
+		}
+
+		// Set after the body: a declared trailer and an undeclared one.
+		c.Response().Header().Set("X-Checksum", "abc")
+		c.Response().Header().Set(http.TrailerPrefix+"X-Count", "1")
+
+		return nil
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	send := func() *http.Response {
+		req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("X-Idempotency-Key", "key")
+
+		res, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer res.Body.Close()
+
+		// The trailers are read with the body.
+		if _, err := io.ReadAll(res.Body); err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	for _, name := range []string{"first", "replay"} {
+		res := send()
+
+		if name == "replay" && res.Header.Get("Idempotency-Replayed") != "true" {
+			t.Fatalf("got headers %v, want a replay", res.Header)
+		}
+
+		if res.Trailer.Get("X-Checksum") != "abc" || res.Trailer.Get("X-Count") != "1" {
+			t.Fatalf("%s: got trailers %v, want X-Checksum and X-Count", name, res.Trailer)
+		}
+
+		if links := res.Header.Values("Link"); len(links) != 2 || links[0] != "</a>; rel=a" || links[1] != "</b>; rel=b" {
+			t.Fatalf("%s: got Link %q, want both values in order", name, links)
+		}
+	}
+
+	reqRec, err := m.Lookup(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reqRec.ResponseTrailers["X-Checksum"] == nil || reqRec.ResponseHeaders["X-Checksum"] != nil {
+		t.Fatalf("got headers %v and trailers %v, want X-Checksum stored as a trailer", reqRec.ResponseHeaders, reqRec.ResponseTrailers)
+	}
+}
+
+func TestReplayTransformer(t *testing.T) {
+	m := NewManager(IdempotencyConfig{
+		Store:                NewMemoryStore(0),
+		DisableScope:         true,
+		CompressionThreshold: 1,
+		ReplayTransformer: func(c echo.Context, reqRec *ReqRecord) error {
+			if c.Request().Header.Get("X-Fail") != "" {
+				return echo.NewHTTPError(http.StatusServiceUnavailable)
+			}
+
+			// The body is decoded, not gzipped.
+			reqRec.ResponseBody = []byte(strings.Replace(string(reqRec.ResponseBody), "expires=1", "expires=10", 1))
+			http.Header(reqRec.ResponseHeaders).Set("X-Signed", "again")
+
+			return nil
+		},
+	})
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentLength, "23")
+
+		return c.String(http.StatusCreated, "https://cdn/a?expires=1")
+	})
+
+	send := func(fail bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", "key")
+		if fail {
+			req.Header.Set("X-Fail", "true")
+		}
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := send(false); rec.Body.String() != "https://cdn/a?expires=1" || rec.Header().Get("X-Signed") != "" {
+		t.Fatalf("first request: got body %q, headers %v, want it untransformed", rec.Body.String(), rec.Header())
+	}
+
+	rec := send(false)
+	if rec.Body.String() != "https://cdn/a?expires=10" || rec.Header().Get("X-Signed") != "again" {
+		t.Fatalf("replay: got body %q, headers %v, want it transformed", rec.Body.String(), rec.Header())
+	}
+
+	if rec.Header().Get(echo.HeaderContentLength) != "24" {
+		t.Fatalf("got Content-Length %q, want the length of the transformed body", rec.Header().Get(echo.HeaderContentLength))
+	}
+
+	if rec := send(true); rec.Code != http.StatusServiceUnavailable || rec.Body.String() == "https://cdn/a?expires=1" {
+		t.Fatalf("failing transformer: got status %d, body %q, want the replay aborted", rec.Code, rec.Body.String())
+	}
+
+	// The stored record isn't transformed.
+	reqRec, err := m.Lookup(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reqRec.BodyEncoding != bodyEncodingGzip || http.Header(reqRec.ResponseHeaders).Get("X-Signed") != "" {
+		t.Fatalf("got stored record %+v, want it as stored", reqRec)
+	}
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"encoding/json"
+
+	"github.com/labstack/echo/v4"
+)
+
+// resultContextKey is the echo context key of the stored result of a replay.
+const resultContextKey = "echo-idempotency.result"
+
+// SetIdempotentResult stores the structured result of the handler along with
+// the record claimed by the request, encoded by the `Codec` of the middleware
+// when it is a `ResultCodec` and as JSON otherwise. Replays of records having
+// a result don't write the captured response; they call the handler again,
+// which renders the result returned by `GetIdempotentResult` through the
+// regular response path (content negotiation, templating) instead of
+// re-executing the operation.
+func SetIdempotentResult(c echo.Context, v interface{}) error {
+	state, err := stateFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	result, err := marshalResult(state.config.Codec, v)
+	if err != nil {
+		return err
+	}
+
+	state.result = result
+
+	return nil
+}
+
+// GetIdempotentResult returns the result stored by `SetIdempotentResult` when
+// the request is a replay. Handlers storing results must check it first and
+// render the result instead of executing the operation when it is found.
+func GetIdempotentResult[T any](c echo.Context) (T, bool, error) {
+	var v T
+
+	result, ok := c.Get(resultContextKey).(storedResult)
+	if !ok {
+		return v, false, nil
+	}
+
+	if err := unmarshalResult(result.codec, result.data, &v); err != nil {
+		return v, false, err
+	}
+
+	return v, true, nil
+}
+
+// storedResult is the result of a replayed record, set on the echo context.
+type storedResult struct {
+	data  []byte
+	codec Codec
+}
+
+// marshalResult encodes the result with the codec, or as JSON when the codec
+// isn't a `ResultCodec`.
+func marshalResult(codec Codec, v interface{}) ([]byte, error) {
+	if rc, ok := codec.(ResultCodec); ok {
+		return rc.MarshalResult(v)
+	}
+
+	return json.Marshal(v)
+}
+
+// unmarshalResult decodes a result encoded by `marshalResult`.
+func unmarshalResult(codec Codec, data []byte, v interface{}) error {
+	if rc, ok := codec.(ResultCodec); ok {
+		return rc.UnmarshalResult(data, v)
+	}
+
+	return json.Unmarshal(data, v)
+}
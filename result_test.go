@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type testOrder struct {
+	ID        int
+	Items     []string
+	CreatedAt time.Time
+}
+
+func TestIdempotentResultCodecs(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+	}{
+		{"JSONCodec", JSONCodec{}},
+		{"BinaryCodec", BinaryCodec{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), Codec: tt.codec, DisableScope: true})
+			want := testOrder{ID: 7, Items: []string{"a", "b"}, CreatedAt: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+			executed := 0
+			var replayed testOrder
+
+			e := echo.New()
+			e.Use(m.Middleware())
+			e.POST("/", func(c echo.Context) error {
+				order, ok, err := GetIdempotentResult[testOrder](c)
+				if err != nil {
+					return err
+				}
+
+				if ok {
+					replayed = order
+
+					return c.JSON(http.StatusCreated, order)
+				}
+
+				executed++
+
+				if err := SetIdempotentResult(c, want); err != nil {
+					return err
+				}
+
+				return c.JSON(http.StatusCreated, want)
+			})
+
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+				req.Header.Set("X-Idempotency-Key", "key")
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+
+				if rec.Code != http.StatusCreated {
+					t.Fatalf("request %d: got status %d, want %d", i, rec.Code, http.StatusCreated)
+				}
+			}
+
+			if executed != 1 {
+				t.Fatalf("the operation executed %d times, want 1", executed)
+			}
+
+			if replayed.ID != want.ID || strings.Join(replayed.Items, ",") != "a,b" || !replayed.CreatedAt.Equal(want.CreatedAt) {
+				t.Fatalf("got replayed result %+v, want %+v", replayed, want)
+			}
+
+			reqRec, err := m.Lookup(context.Background(), "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, binary := tt.codec.(BinaryCodec); binary != bytes.HasPrefix(reqRec.Result, binaryCodecMagic) {
+				t.Fatalf("the result isn't encoded by %s", tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// rfcKeyHeader is the header of the idempotency key defined by the IETF
+// draft, see `StrictRFC`.
+const rfcKeyHeader = "Idempotency-Key"
+
+// mimeProblemJSON is the media type of the RFC 7807 problem details.
+const mimeProblemJSON = "application/problem+json"
+
+// Problem is the RFC 7807 problem details body of the error responses of the
+// `StrictRFC` mode.
+type Problem struct {
+	Type   string `json:"type,omitempty"`
+	Title  string `json:"title"`
+	Detail string `json:"detail,omitempty"`
+}
+
+const problemDetail = "This operation is idempotent and it requires correct usage of Idempotency Key."
+
+var (
+	missingKeyProblem = problemError(http.StatusBadRequest, "Idempotency-Key is missing", problemDetail, ErrKeyMissing)
+
+	fingerprintMismatchProblem = problemError(http.StatusUnprocessableEntity, "Idempotency-Key is already used",
+		problemDetail+" Idempotency Key MUST not be reused across different payloads of this operation.", ErrFingerprintMismatch)
+
+	conflictProblem = problemError(http.StatusConflict, "A request is outstanding for this Idempotency-Key",
+		"A request with the same Idempotency-Key for the same operation is being processed or is outstanding.", ErrConflict)
+)
+
+func problemError(status int, title, detail string, err error) *echo.HTTPError {
+	return echo.NewHTTPError(status, Problem{Title: title, Detail: detail}).SetInternal(err)
+}
+
+// applyStrictRFC sets up the config for the `StrictRFC` mode, before the
+// regular defaults are applied. The fields left unset or holding the values
+// of `DefaultIdempotencyConfig`, e.g. of a config derived from it, get the
+// values of the draft.
+func applyStrictRFC(config *IdempotencyConfig) {
+	if config.KeyLookup == "" || config.KeyLookup == DefaultIdempotencyConfig.KeyLookup {
+		config.KeyLookup = "header:" + rfcKeyHeader
+	}
+
+	if config.RequireKeyFunc == nil {
+		config.RequireKey = true
+	}
+
+	if config.MissingKeyError == nil || config.MissingKeyError == DefaultIdempotencyConfig.MissingKeyError {
+		config.MissingKeyError = missingKeyProblem
+	}
+
+	if config.FingerprintMismatchError == nil || config.FingerprintMismatchError == DefaultIdempotencyConfig.FingerprintMismatchError {
+		config.FingerprintMismatchError = fingerprintMismatchProblem
+	}
+
+	config.ConcurrentRequestPolicy = ConcurrentReject
+}
+
+// keyFromStructuredHeader extracts the key from a header holding it as a
+// structured field string (RFC 8941), e.g. `Idempotency-Key: "8e03978e"`.
+// Malformed values get 400 Bad Request.
+func keyFromStructuredHeader(header string) KeyExtractor {
+	return func(c echo.Context) (string, bool, error) {
+		values := c.Request().Header.Values(header)
+		if len(values) == 0 {
+			return "", false, nil
+		}
+
+		key, ok := parseSFString(strings.Join(values, ", "))
+		if !ok || key == "" {
+			return "", false, invalidKeyProblem(ErrKeyFormat)
+		}
+
+		return key, true, nil
+	}
+}
+
+// parseSFString parses a structured field string item without parameters.
+func parseSFString(s string) (string, bool) {
+	s = strings.Trim(s, " ")
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", false
+	}
+
+	s = s[1 : len(s)-1]
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+
+		switch {
+		case ch == '\\':
+			if i++; i == len(s) || (s[i] != '"' && s[i] != '\\') {
+				return "", false
+			}
+
+			b.WriteByte(s[i])
+
+		case ch == '"', ch < 0x20, ch > 0x7e:
+			return "", false
+
+		default:
+			b.WriteByte(ch)
+		}
+	}
+
+	return b.String(), true
+}
+
+func invalidKeyProblem(err error) *echo.HTTPError {
+	return problemError(http.StatusBadRequest, "Idempotency-Key is invalid", problemDetail+" "+err.Error()+".", err)
+}
+
+// problemJSON makes the error handler send the problem details of the
+// errors returned by the middleware as `application/problem+json`.
+func problemJSON(mw echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := mw(next)
+
+		return func(c echo.Context) error {
+			err := h(c)
+
+			var he *echo.HTTPError
+			if errors.As(err, &he) && !c.Response().Committed {
+				if _, ok := he.Message.(Problem); ok {
+					c.Response().Header().Set(echo.HeaderContentType, mimeProblemJSON)
+				}
+			}
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newStrictEcho(t *testing.T, handlerRan *bool) *echo.Echo {
+	t.Helper()
+
+	h, err := IdempotencyConfig{Store: NewMemoryStore(0), StrictRFC: true}.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(h)
+	e.POST("/", func(c echo.Context) error {
+		*handlerRan = true
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	return e
+}
+
+func sendStrict(e *echo.Echo, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(rfcKeyHeader, key)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestStrictRFCMissingKey(t *testing.T) {
+	handlerRan := false
+	e := newStrictEcho(t, &handlerRan)
+
+	rec := sendStrict(e, "", "body")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want 400", rec.Code)
+	}
+
+	if ct := rec.Header().Get(echo.HeaderContentType); ct != mimeProblemJSON {
+		t.Fatalf("got content type %q, want %q", ct, mimeProblemJSON)
+	}
+
+	if handlerRan {
+		t.Fatal("handler ran for a request without a key")
+	}
+}
+
+func TestStrictRFCKeys(t *testing.T) {
+	handlerRan := false
+	e := newStrictEcho(t, &handlerRan)
+
+	if rec := sendStrict(e, "unquoted", "body"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unquoted key: got status %d, want 400", rec.Code)
+	}
+
+	if rec := sendStrict(e, `"a\"b"`, "body"); rec.Code != http.StatusCreated {
+		t.Fatalf("first request: got status %d, want 201", rec.Code)
+	}
+
+	if rec := sendStrict(e, `"a\"b"`, "body"); rec.Code != http.StatusCreated || rec.Body.String() != "created" {
+		t.Fatalf("replay: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	if rec := sendStrict(e, `"a\"b"`, "other body"); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("payload mismatch: got status %d, want 422", rec.Code)
+	}
+}
+
+func TestStrictRFCDefaultConfig(t *testing.T) {
+	config := DefaultIdempotencyConfig
+	config.Store = NewMemoryStore(0)
+	config.StrictRFC = true
+
+	h, err := config.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(h)
+	e.POST("/", func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	})
+
+	// The default header of the config isn't looked up.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", `"key"`)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest || rec.Header().Get(echo.HeaderContentType) != mimeProblemJSON {
+		t.Fatalf("missing key: got status %d, content type %q", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+
+	if rec := sendStrict(e, `"key"`, "body"); rec.Code != http.StatusCreated {
+		t.Fatalf("first request: got status %d, want 201", rec.Code)
+	}
+
+	rec = sendStrict(e, `"key"`, "other body")
+	if rec.Code != http.StatusUnprocessableEntity || rec.Header().Get(echo.HeaderContentType) != mimeProblemJSON {
+		t.Fatalf("payload mismatch: got status %d, content type %q", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+}
+
+func TestStrictRFCConfiguredFields(t *testing.T) {
+	missing := echo.NewHTTPError(http.StatusPreconditionRequired).SetInternal(ErrKeyMissing)
+	mismatch := echo.NewHTTPError(http.StatusConflict).SetInternal(ErrFingerprintMismatch)
+
+	config := IdempotencyConfig{
+		StrictRFC:                true,
+		KeyLookup:                "header:X-Request-Key",
+		MissingKeyError:          missing,
+		FingerprintMismatchError: mismatch,
+	}
+	applyStrictRFC(&config)
+
+	if config.KeyLookup != "header:X-Request-Key" || config.MissingKeyError != missing || config.FingerprintMismatchError != mismatch {
+		t.Fatalf("got config %+v, want the configured fields kept", config)
+	}
+}
+
+func TestParseSFString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{`"abc"`, "abc", true},
+		{` "a\\b" `, `a\b`, true},
+		{`"a\"b"`, `a"b`, true},
+		{`abc`, "", false},
+		{`"abc`, "", false},
+		{`"a"b"`, "", false},
+		{`"a\b"`, "", false},
+		{`"a", "b"`, "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseSFString(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseSFString(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ScopeUserContextKey is the echo context key `DefaultScope` reads the ID of
+// the authenticated user from. Authentication middlewares are expected to
+// set it to a string or a `fmt.Stringer`.
+const ScopeUserContextKey = "user_id"
+
+// DefaultScope scopes the keys by the authenticated user, see
+// `ScopeUserContextKey`, and the route path.
+func DefaultScope(c echo.Context) string {
+	user := ""
+	switch v := c.Get(ScopeUserContextKey).(type) {
+	case string:
+		user = v
+
+	case fmt.Stringer:
+		user = v.String()
+	}
+
+	return user + "|" + c.Path()
+}
+
+// ScopedKey returns the idempotency key combined with the scope, as used in
+// the store keys of the scoped records.
+func ScopedKey(scope, key string) string {
+	if scope == "" {
+		return key
+	}
+
+	return scope + "::" + key
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestScope(t *testing.T) {
+	tests := []struct {
+		name         string
+		disableScope bool
+		statuses     []int
+		executed     int
+	}{
+		// A record per user and route: alice's ones on /a and /b, bob's.
+		{"scoped", false, []int{http.StatusCreated, http.StatusCreated, http.StatusCreated, http.StatusCreated}, 3},
+
+		// The record is shared; its key reused on another route doesn't
+		// match the fingerprint.
+		{"disabled", true, []int{http.StatusCreated, http.StatusCreated, http.StatusCreated, http.StatusUnprocessableEntity}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw, err := IdempotencyConfig{Store: NewMemoryStore(0), DisableScope: tt.disableScope}.ToMiddleware()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			executed := 0
+			h := func(c echo.Context) error {
+				executed++
+
+				return c.String(http.StatusCreated, "created")
+			}
+
+			e := echo.New()
+			e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+				return func(c echo.Context) error {
+					c.Set(ScopeUserContextKey, c.Request().Header.Get("X-User"))
+
+					return next(c)
+				}
+			})
+			e.Use(mw)
+			e.POST("/a", h)
+			e.POST("/b", h)
+
+			for i, req := range []struct{ user, path string }{
+				{"alice", "/a"},
+				{"alice", "/a"},
+				{"bob", "/a"},
+				{"alice", "/b"},
+			} {
+				r := httptest.NewRequest(http.MethodPost, req.path, strings.NewReader("body"))
+				r.Header.Set("X-Idempotency-Key", "key")
+				r.Header.Set("X-User", req.user)
+
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, r)
+
+				if rec.Code != tt.statuses[i] {
+					t.Fatalf("%s %s: got status %d, want %d", req.user, req.path, rec.Code, tt.statuses[i])
+				}
+			}
+
+			if executed != tt.executed {
+				t.Fatalf("handler executed %d times, want %d", executed, tt.executed)
+			}
+		})
+	}
+}
+
+func TestScopeFunc(t *testing.T) {
+	store := NewMemoryStore(0)
+	mw, err := IdempotencyConfig{Store: store, ScopeFunc: func(c echo.Context) string {
+		return c.Request().Header.Get("X-Tenant")
+	}}.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(mw)
+	e.POST("/", func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", "key")
+	req.Header.Set("X-Tenant", "acme")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	m := NewManager(IdempotencyConfig{Store: store})
+	if _, err := m.Lookup(req.Context(), ScopedKey("acme", "key")); err != nil {
+		t.Fatalf("record of the tenant scope: %v", err)
+	}
+}
+
+func TestScopedKey(t *testing.T) {
+	if got := ScopedKey("", "key"); got != "key" {
+		t.Fatalf("unscoped: got %q", got)
+	}
+
+	if got := ScopedKey("alice|/a", "key"); got != "alice|/a::key" {
+		t.Fatalf("scoped: got %q", got)
+	}
+}
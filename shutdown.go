@@ -0,0 +1,230 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrShuttingDown is the internal error of the responses sent to the
+// requests arriving after `Manager.Shutdown` was called, and the error
+// passed to `OnPersistError` for the background writes it dropped.
+var ErrShuttingDown = errors.New("idempotency middleware is shutting down")
+
+// ShutdownError is returned by `Manager.Shutdown` when its context is done
+// before the background writes of `AsyncPersistence` were run; the queued
+// ones are dropped.
+type ShutdownError struct {
+	// Dropped is the number of the dropped writes.
+	Dropped int
+
+	// Err is the error of the context.
+	Err error
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("idempotency middleware shutdown: %v, %d queued record writes dropped", e.Err, e.Dropped)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// Shutdown stops the middleware from claiming new records and waits for the
+// requests holding one to finalize it, including the records stored by
+// `AsyncPersistence`. Requests arriving meanwhile get 503 Service
+// Unavailable. If ctx is done first, the records of the requests still
+// running are marked abandoned, so the requests waiting for them on other
+// instances take them over instead of waiting for records that will never
+// complete, and the queued background writes are dropped; ctx's error is
+// returned then, wrapped in a `ShutdownError` if writes were dropped. It is
+// meant to be called before
+// `echo.Echo.Shutdown`, with the same context. The managers of the
+// middleware returned by `With` are shut down concurrently.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	derived := m.derived
+	m.mu.Unlock()
+
+	errs := make([]error, len(derived))
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(derived))
+
+	for i, d := range derived {
+		go func(i int, d *Manager) {
+			defer wg.Done()
+
+			errs[i] = d.Shutdown(ctx)
+		}(i, d)
+	}
+
+	err := m.shutdown(ctx)
+	wg.Wait()
+
+	for _, dErr := range errs {
+		if err == nil {
+			err = dErr
+		}
+	}
+
+	return err
+}
+
+// shutdown is `Shutdown` of the manager itself.
+func (m *Manager) shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+
+	if len(m.active) > 0 && m.idle == nil {
+		m.idle = make(chan struct{})
+	}
+
+	idle := m.idle
+	m.mu.Unlock()
+
+	if idle != nil {
+		select {
+		case <-idle:
+
+		case <-ctx.Done():
+			err := m.abandonActive(ctx)
+
+			// The records of the dropped writes were abandoned above, as
+			// their requests are tracked until the writes complete.
+			if m.writes != nil {
+				if dropped := m.writes.drop(); dropped > 0 {
+					err = &ShutdownError{Dropped: dropped, Err: err}
+				}
+			}
+
+			return err
+		}
+	}
+
+	if m.writes != nil {
+		m.writes.close()
+	}
+
+	return nil
+}
+
+// abandonActive marks the records of the requests still running abandoned,
+// and returns the error of ctx.
+func (m *Manager) abandonActive(ctx context.Context) error {
+	m.mu.Lock()
+	states := make([]*requestState, 0, len(m.active))
+	for state := range m.active {
+		states = append(states, state)
+	}
+	m.mu.Unlock()
+
+	writeCtx, cancel := writeContext(ctx, m.config)
+	defer cancel()
+
+	for _, state := range states {
+		if err := abandonRecord(writeCtx, m.config, state); err != nil {
+			m.config.emit(EventStoreError, state.reqKey, 0, err)
+		}
+	}
+
+	return ctx.Err()
+}
+
+// shuttingDown responds 503 Service Unavailable once `Shutdown` was called.
+func (m *Manager) shuttingDown() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closing {
+		return echo.NewHTTPError(http.StatusServiceUnavailable).SetInternal(ErrShuttingDown)
+	}
+
+	return nil
+}
+
+// track registers the request holding a record until the returned func is
+// called, so `Shutdown` waits for it. Once `Shutdown` was called, the
+// request isn't registered and gets 503 Service Unavailable instead; the
+// check and the registration share the lock, so `Shutdown` never misses a
+// request that passed the check.
+func (m *Manager) track(state *requestState) (func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closing {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable).SetInternal(ErrShuttingDown)
+	}
+
+	m.active[state] = struct{}{}
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		delete(m.active, state)
+
+		if len(m.active) == 0 && m.idle != nil {
+			close(m.idle)
+			m.idle = nil
+		}
+	}, nil
+}
+
+// abandonRecord marks the record of a running request abandoned, and
+// releases its claimed keys, unless it completed meanwhile or the request
+// doesn't own it anymore. The heartbeat
+// of the request stops renewing the record, and the request fails to
+// finalize it, as it lost the ownership.
+func abandonRecord(ctx context.Context, config IdempotencyConfig, state *requestState) error {
+	reqData, err := config.Store.Get(ctx, state.reqKey)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	reqRec := ReqRecord{}
+	if err := config.Codec.Unmarshal(reqData, &reqRec); err != nil {
+		return err
+	}
+
+	if reqRec.Done || reqRec.Owner != state.owner {
+		return nil
+	}
+
+	abandonedAt := time.Now().Add(-time.Millisecond)
+
+	abandoned, err := config.Codec.Marshal(ReqRecord{LeaseExpiresAt: &abandonedAt})
+	if err != nil {
+		return err
+	}
+
+	swapped, err := config.Store.CompareAndSwap(ctx, state.reqKey, reqData, abandoned, KeepTTL)
+	if err != nil || !swapped {
+		return err
+	}
+
+	state.mu.Lock()
+	claimedKeys := append([]string(nil), state.claimedKeys...)
+	state.mu.Unlock()
+
+	if len(claimedKeys) > 0 {
+		if err := config.Store.Delete(ctx, claimedKeys...); err != nil {
+			return err
+		}
+	}
+
+	if notifier, ok := config.Store.(Notifier); ok {
+		_ = notifier.Notify(ctx, state.reqKey)
+	}
+
+	return nil
+}
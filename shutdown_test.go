@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// shutdownClaim shuts the manager down once the request passed the
+// shutdown check, before it claims the key.
+type shutdownClaim struct {
+	m *Manager
+}
+
+func (s shutdownClaim) Claim(ctx context.Context, store Store, reqKey string, placeholder []byte, ttl time.Duration) (func(), bool, error) {
+	if err := s.m.Shutdown(ctx); err != nil {
+		return nil, false, err
+	}
+
+	return StoreClaim{}.Claim(ctx, store, reqKey, placeholder, ttl)
+}
+
+func TestShutdownDuringClaim(t *testing.T) {
+	claim := &shutdownClaim{}
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DisableScope: true, ClaimStrategy: claim})
+	claim.m = m
+
+	h := m.Middleware()(func(c echo.Context) error {
+		t.Fatal("handler executed after Shutdown returned")
+
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", "key")
+
+	var he *echo.HTTPError
+	if err := h(echo.New().NewContext(req, httptest.NewRecorder())); !errors.As(err, &he) || he.Code != http.StatusServiceUnavailable || !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("got %v, want 503 Service Unavailable", err)
+	}
+
+	// The claimed record is released for the other instances.
+	reqRec, err := m.Lookup(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reqRec.Done || reqRec.LeaseExpiresAt == nil || reqRec.LeaseExpiresAt.After(time.Now()) {
+		t.Fatalf("got record %+v, want an abandoned one", reqRec)
+	}
+}
+
+// stallingStore stalls the first final write of a record until released.
+type stallingStore struct {
+	Store
+	stalls  int32
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (s *stallingStore) CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error) {
+	if atomic.AddInt32(&s.stalls, 1) == 1 {
+		close(s.stalled)
+		<-s.release
+	}
+
+	return s.Store.CompareAndSwap(ctx, key, old, new, ttl)
+}
+
+func TestShutdownDropsQueuedWrites(t *testing.T) {
+	store := &stallingStore{Store: NewMemoryStore(0), stalled: make(chan struct{}), release: make(chan struct{})}
+	defer close(store.release)
+
+	var (
+		mu      sync.Mutex
+		dropped []string
+	)
+
+	m := NewManager(IdempotencyConfig{
+		Store:            store,
+		DisableScope:     true,
+		AsyncPersistence: true,
+		AsyncWorkers:     1,
+		AsyncQueueSize:   4,
+		OnPersistError: func(key string, err error) {
+			if errors.Is(err, ErrShuttingDown) {
+				mu.Lock()
+				dropped = append(dropped, key)
+				mu.Unlock()
+			}
+		},
+	})
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	})
+
+	send := func(key string) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("%s: got status %d, want 201", key, rec.Code)
+		}
+	}
+
+	// The worker stalls on the first write, the others stay queued.
+	send("a")
+	<-store.stalled
+	send("b")
+	send("c")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := m.Shutdown(ctx)
+
+	var shutdownErr *ShutdownError
+	if !errors.As(err, &shutdownErr) || shutdownErr.Dropped != 2 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the 2 queued writes dropped", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(dropped) != 2 || dropped[0] != "b" || dropped[1] != "c" {
+		t.Fatalf("got dropped keys %q, want b and c", dropped)
+	}
+
+	// The records of the dropped writes are abandoned.
+	for _, key := range dropped {
+		reqRec, err := m.Lookup(context.Background(), key)
+		if err != nil || reqRec.Done || reqRec.LeaseExpiresAt == nil || reqRec.LeaseExpiresAt.After(time.Now()) {
+			t.Fatalf("%s: got record %+v, %v, want an abandoned one", key, reqRec, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// SnapshotEntry is a completed record exported by `Manager.Snapshot`.
+type SnapshotEntry struct {
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Record    ReqRecord `json:"record"`
+}
+
+// Snapshot writes the completed records of the store to the writer as a
+// stream of JSON encoded `SnapshotEntry` values. In-flight records are left
+// out since their owner won't complete them in the target store.
+func (m *Manager) Snapshot(ctx context.Context, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+
+	err := m.config.Store.Scan(ctx, m.config.recordPrefix(), func(keys []string) error {
+		for _, k := range keys {
+			entry, ok, err := m.snapshotEntry(ctx, k)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				continue
+			}
+
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+
+			n++
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+// Preload reads a snapshot written by `Snapshot` and stores its records that
+// haven't expired yet, so duplicates of requests served by another instance
+// are replayed right after startup. Existing records are kept as is.
+func (m *Manager) Preload(ctx context.Context, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	n := 0
+
+	for {
+		entry := SnapshotEntry{}
+		if err := dec.Decode(&entry); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+
+			return n, err
+		}
+
+		ttl := time.Until(entry.ExpiresAt)
+		if ttl < time.Millisecond {
+			continue
+		}
+
+		reqData, err := m.config.Codec.Marshal(entry.Record)
+		if err != nil {
+			return n, err
+		}
+
+		setOK, err := m.config.Store.SetNX(ctx, entry.Key, reqData, ttl)
+		if err != nil {
+			return n, err
+		}
+
+		if setOK {
+			n++
+		}
+	}
+}
+
+func (m *Manager) snapshotEntry(ctx context.Context, key string) (SnapshotEntry, bool, error) {
+	entry := SnapshotEntry{Key: key}
+
+	reqRec, err := getRecord(ctx, m.config.Store, m.config.Codec, key)
+	if errors.Is(err, ErrRecordLost) {
+		return entry, false, nil
+	}
+
+	if err != nil {
+		return entry, false, err
+	}
+
+	if !reqRec.Done {
+		return entry, false, nil
+	}
+
+	ttl, err := m.config.Store.TTL(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return entry, false, nil
+	}
+
+	if err != nil {
+		return entry, false, err
+	}
+
+	if ttl <= 0 {
+		return entry, false, nil
+	}
+
+	reqRec.ResponseBody, err = readBody(ctx, m.config.Store, reqRec)
+	if errors.Is(err, ErrRecordLost) {
+		return entry, false, nil
+	}
+
+	if err != nil {
+		return entry, false, err
+	}
+
+	reqRec.BodyEncoding = ""
+	reqRec.BodyChunks = nil
+
+	entry.Record = reqRec
+	entry.ExpiresAt = time.Now().Add(ttl)
+
+	return entry, true, nil
+}
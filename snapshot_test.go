@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSnapshotPreload(t *testing.T) {
+	ctx := context.Background()
+	source := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DisableScope: true, CompressionThreshold: 1})
+
+	sendSource := newReplayEcho(source, func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created "+c.Request().Header.Get("X-Idempotency-Key"))
+	})
+
+	sendSource("a")
+	sendSource("b")
+
+	// The in-flight records are left out.
+	setRecord(t, source.config.Store, source.config.recordKey("pending"), ReqRecord{Owner: "owner"})
+
+	snapshot := new(bytes.Buffer)
+	if n, err := source.Snapshot(ctx, snapshot); err != nil || n != 2 {
+		t.Fatalf("snapshot: got %d, %v, want 2 records", n, err)
+	}
+
+	// The bodies are exported decoded.
+	for _, line := range strings.Split(strings.TrimSpace(snapshot.String()), "\n") {
+		entry := SnapshotEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+
+		if entry.Record.BodyEncoding != "" || !strings.HasPrefix(string(entry.Record.ResponseBody), "created ") || time.Until(entry.ExpiresAt) <= 0 {
+			t.Fatalf("got entry %+v", entry)
+		}
+	}
+
+	target := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DisableScope: true})
+
+	// The existing records are kept.
+	setRecord(t, target.config.Store, target.config.recordKey("b"), ReqRecord{Done: true, ResponseCode: http.StatusAccepted})
+
+	if n, err := target.Preload(ctx, bytes.NewReader(snapshot.Bytes())); err != nil || n != 1 {
+		t.Fatalf("preload: got %d, %v, want 1 record", n, err)
+	}
+
+	executed := 0
+	sendTarget := newReplayEcho(target, func(c echo.Context) error {
+		executed++
+
+		return c.String(http.StatusCreated, "executed")
+	})
+
+	if rec := sendTarget("a"); rec.Body.String() != "created a" || rec.Header().Get("Idempotency-Replayed") != "true" {
+		t.Fatalf("preloaded record: got body %q, headers %v, want the replay", rec.Body.String(), rec.Header())
+	}
+
+	if rec := sendTarget("b"); rec.Code != http.StatusAccepted {
+		t.Fatalf("existing record: got status %d, want it kept", rec.Code)
+	}
+
+	if executed != 0 {
+		t.Fatalf("handler executed %d times, want the records replayed", executed)
+	}
+}
+
+func TestPreloadExpired(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0)})
+
+	snapshot := new(bytes.Buffer)
+	enc := json.NewEncoder(snapshot)
+	_ = enc.Encode(SnapshotEntry{Key: "expired", ExpiresAt: time.Now().Add(-time.Second), Record: ReqRecord{Done: true}})
+	_ = enc.Encode(SnapshotEntry{Key: "valid", ExpiresAt: time.Now().Add(time.Minute), Record: ReqRecord{Done: true}})
+
+	if n, err := m.Preload(context.Background(), snapshot); err != nil || n != 1 {
+		t.Fatalf("got %d, %v, want the record not expired", n, err)
+	}
+
+	if _, err := m.config.Store.Get(context.Background(), "expired"); err != ErrNotFound {
+		t.Fatalf("expired record: got %v, want ErrNotFound", err)
+	}
+
+	if _, err := m.Preload(context.Background(), strings.NewReader("{")); err == nil {
+		t.Fatal("malformed snapshot: got no error")
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// storable reports whether the responses with the status code are stored
+// for replay.
+func storable(config IdempotencyConfig, status int) bool {
+	if config.StoreOnStatusCodes != nil && !containsStatus(config.StoreOnStatusCodes, status) {
+		return false
+	}
+
+	if config.SkipOnStatusCodes == nil {
+		return status < http.StatusInternalServerError
+	}
+
+	return !containsStatus(config.SkipOnStatusCodes, status)
+}
+
+// rejected reports whether the responses with the status code are stored
+// as short-lived rejected records.
+func rejected(config IdempotencyConfig, status int) bool {
+	if config.RejectedTTL <= 0 {
+		return false
+	}
+
+	if config.RejectedStatusCodes == nil {
+		return status >= http.StatusBadRequest && status < http.StatusInternalServerError
+	}
+
+	return containsStatus(config.RejectedStatusCodes, status)
+}
+
+// errorStatus returns the status code the echo error handler responds to the
+// handler error with.
+func errorStatus(err error) int {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code
+	}
+
+	return http.StatusInternalServerError
+}
+
+func containsStatus(codes []int, status int) bool {
+	for _, c := range codes {
+		if c == status {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRejectedTTL(t *testing.T) {
+	store := NewMemoryStore(0)
+	m := NewManager(IdempotencyConfig{Store: store, DisableScope: true, TTL: time.Hour, RejectedTTL: 100 * time.Millisecond, StoreOnStatusCodes: []int{http.StatusCreated}})
+
+	executed := 0
+	send := newReplayEcho(m, func(c echo.Context) error {
+		executed++
+
+		if c.Request().Header.Get("X-Idempotency-Key") == "bad" {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid order")
+		}
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	send("bad")
+
+	// The rejection is stored regardless of StoreOnStatusCodes, shortly.
+	if rec := send("bad"); rec.Code != http.StatusBadRequest || rec.Header().Get("Idempotency-Replayed") != "true" {
+		t.Fatalf("got status %d, headers %v, want the replayed rejection", rec.Code, rec.Header())
+	}
+
+	if ttl, err := store.TTL(context.Background(), m.config.recordKey("bad")); err != nil || ttl > 100*time.Millisecond {
+		t.Fatalf("got TTL %v, %v, want at most RejectedTTL", ttl, err)
+	}
+
+	send("good")
+
+	if ttl, err := store.TTL(context.Background(), m.config.recordKey("good")); err != nil || ttl <= time.Minute {
+		t.Fatalf("got TTL %v, %v of an accepted request, want TTL", ttl, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if rec := send("bad"); rec.Code != http.StatusBadRequest || rec.Header().Get("Idempotency-Replayed") != "" {
+		t.Fatalf("got status %d, headers %v, want the handler executed again", rec.Code, rec.Header())
+	}
+
+	if executed != 3 {
+		t.Fatalf("handler executed %d times, want 3", executed)
+	}
+}
+
+func TestRejectedStatusCodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		config IdempotencyConfig
+		status int
+		want   bool
+	}{
+		{"disabled", IdempotencyConfig{}, http.StatusBadRequest, false},
+		{"client error", IdempotencyConfig{RejectedTTL: time.Second}, http.StatusUnprocessableEntity, true},
+		{"success", IdempotencyConfig{RejectedTTL: time.Second}, http.StatusCreated, false},
+		{"server error", IdempotencyConfig{RejectedTTL: time.Second}, http.StatusInternalServerError, false},
+		{"listed", IdempotencyConfig{RejectedTTL: time.Second, RejectedStatusCodes: []int{http.StatusConflict}}, http.StatusConflict, true},
+		{"unlisted", IdempotencyConfig{RejectedTTL: time.Second, RejectedStatusCodes: []int{http.StatusConflict}}, http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		if got := rejected(tt.config, tt.status); got != tt.want {
+			t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// KeepTTL makes `Store.Set` retain the current TTL of the key.
+const KeepTTL time.Duration = -1
+
+var (
+	// ErrNotFound is returned by the stores when the key doesn't exist.
+	ErrNotFound = errors.New("key not found")
+
+	// ErrOutOfMemory is wrapped by the errors of the stores refusing writes
+	// because they reached their memory limit.
+	ErrOutOfMemory = errors.New("store is out of memory")
+)
+
+// Notifier is implemented by the stores able to wake up the requests waiting
+// for a record to be done, see `NotifyWait`.
+type Notifier interface {
+	// Notify wakes up the subscribers of the key.
+	Notify(ctx context.Context, key string) error
+
+	// Subscribe returns a channel receiving a value when the key is
+	// notified. The returned func cancels the subscription.
+	Subscribe(ctx context.Context, key string) (<-chan struct{}, func(), error)
+}
+
+// TTLExtender is implemented by the stores able to extend the TTL of a key
+// in a single round trip.
+type TTLExtender interface {
+	// ExtendTTL sets the TTL of the key unless it expires later, or returns
+	// `ErrNotFound`.
+	ExtendTTL(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// Store persists the idempotency records. Implementations must be safe for
+// concurrent use; the atomicity of `SetNX` and `SetNXMulti` is what keeps
+// concurrent requests with the same key from executing the handler twice.
+// They must not retain the values passed to them, which the middleware may
+// reuse. The `store/storetest` package tests this contract.
+// Stores may also implement `Notifier`; see `StoreLocker` to use a store as
+// a `Locker`.
+type Store interface {
+	// Get returns the value of the key or `ErrNotFound`.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set stores the value of the key; a `KeepTTL` ttl retains the current
+	// TTL of the key.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// SetNX stores the value only if the key doesn't exist and reports
+	// whether it was stored.
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+
+	// SetNXMulti stores the value to all keys only if none of them exist
+	// and reports whether they were stored.
+	SetNXMulti(ctx context.Context, keys []string, value []byte, ttl time.Duration) (bool, error)
+
+	// CompareAndSwap stores the new value only if the key holds the old
+	// value and reports whether it was stored; a `KeepTTL` ttl retains the
+	// current TTL of the key.
+	CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error)
+
+	// Lock stores the owner token under the key only if the key doesn't
+	// exist, with the ttl, and reports whether the lock was acquired.
+	Lock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+
+	// Unlock deletes the key only if it holds the owner token and reports
+	// whether it was deleted, so an expired lock acquired by another owner
+	// meanwhile is never released.
+	Unlock(ctx context.Context, key, owner string) (bool, error)
+
+	// Delete deletes the keys, ignoring the missing ones.
+	Delete(ctx context.Context, keys ...string) error
+
+	// TTL returns the remaining TTL of the key, zero if the key doesn't
+	// expire, or `ErrNotFound`.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+
+	// Expire sets the TTL of the key.
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+
+	// AddMembers adds the members to the set stored under the key.
+	AddMembers(ctx context.Context, key string, members ...string) error
+
+	// Members returns the members of the set stored under the key.
+	Members(ctx context.Context, key string) ([]string, error)
+
+	// Scan calls fn with batches of the keys starting with the prefix.
+	Scan(ctx context.Context, prefix string, fn func(keys []string) error) error
+}
@@ -0,0 +1,8 @@
+module github.com/mgurevin/echo-idempotency/store/etcdlock
+
+go 1.18
+
+require (
+	github.com/mgurevin/echo-idempotency v0.1.0
+	go.etcd.io/etcd/client/v3 v3.5.4
+)
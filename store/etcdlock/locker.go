@@ -0,0 +1,76 @@
+// Package etcdlock implements the idempotency `Locker` with the etcd lock
+// recipe, `concurrency.Mutex`, for serializing the requests having the same
+// key with `middleware.LockClaim`.
+package etcdlock
+
+import (
+	"context"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+// DefaultPrefix is the key prefix of the locks.
+const DefaultPrefix = "/idempotency/locks/"
+
+// unlockTimeout bounds the release of a lock, which doesn't depend on the
+// context of the request anymore.
+const unlockTimeout = 5 * time.Second
+
+// Locker is a `middleware.Locker` backed by etcd. The locks are attached to
+// the lease of the session of the locker, kept alive while the process
+// runs, so the locks of a crashed process are released once its lease
+// expires.
+type Locker struct {
+	// Prefix is the key prefix of the locks, e.g. to separate the locks of
+	// the applications sharing the etcd cluster.
+	// Optional. Default value `DefaultPrefix`.
+	Prefix string
+
+	session *concurrency.Session
+}
+
+var _ middleware.Locker = (*Locker)(nil)
+
+// NewLocker returns a `Locker` using the client, with a session created with
+// the options, e.g. `concurrency.WithTTL`.
+func NewLocker(client *clientv3.Client, opts ...concurrency.SessionOption) (*Locker, error) {
+	session, err := concurrency.NewSession(client, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Locker{Prefix: DefaultPrefix, session: session}, nil
+}
+
+// Lock implements `middleware.Locker`. It fails with
+// `concurrency.ErrSessionExpired` once the lease of the session is lost.
+func (l *Locker) Lock(ctx context.Context, name string) (func(), error) {
+	prefix := l.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	mutex := concurrency.NewMutex(l.session, prefix+name)
+	if err := mutex.Lock(ctx); err != nil {
+		return nil, err
+	}
+
+	unlock := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+		defer cancel()
+
+		_ = mutex.Unlock(ctx)
+	}
+
+	return unlock, nil
+}
+
+// Close releases the locks held by the locker by revoking the lease of its
+// session. The client isn't closed.
+func (l *Locker) Close() error {
+	return l.session.Close()
+}
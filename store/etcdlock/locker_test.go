@@ -0,0 +1,103 @@
+package etcdlock_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/mgurevin/echo-idempotency/store/etcdlock"
+)
+
+// newLocker returns a locker of its own session, against the etcd cluster of
+// the `ETCD_ENDPOINTS`, e.g. "localhost:2379".
+func newLocker(t *testing.T) *etcdlock.Locker {
+	t.Helper()
+
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("ETCD_ENDPOINTS is not set")
+	}
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: strings.Split(endpoints, ","), DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	locker, err := etcdlock.NewLocker(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locker.Prefix = "/idempotency-test/" + t.Name() + "/"
+	t.Cleanup(func() { locker.Close() })
+
+	return locker
+}
+
+func TestLockExclusion(t *testing.T) {
+	first, second := newLocker(t), newLocker(t)
+
+	unlock, err := first.Lock(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sessions of the lockers are like the ones of two processes.
+	second.Prefix = first.Prefix
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if _, err := second.Lock(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lock held by another session: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if unlock, err := second.Lock(context.Background(), "other"); err != nil {
+		t.Fatalf("lock of another name: %v", err)
+	} else {
+		unlock()
+	}
+
+	unlock()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	unlock, err = second.Lock(ctx, "key")
+	if err != nil {
+		t.Fatalf("lock once released: %v", err)
+	}
+
+	unlock()
+}
+
+func TestCloseReleasesLocks(t *testing.T) {
+	first, second := newLocker(t), newLocker(t)
+	second.Prefix = first.Prefix
+
+	if _, err := first.Lock(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the locker is like the lease of a crashed process expiring.
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	unlock, err := second.Lock(ctx, "key")
+	if err != nil {
+		t.Fatalf("lock of a closed locker: %v", err)
+	}
+
+	unlock()
+}
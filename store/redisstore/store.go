@@ -0,0 +1,359 @@
+// Package redisstore implements the idempotency `Store` on top of a minimal
+// Redis client, so the adapters of the Redis client libraries, e.g. the
+// `store/redisv8` and `store/redisv9` modules, share the same logic.
+package redisstore
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+// Client is the subset of the Redis commands used by `Store`. The adapters
+// of the client libraries implement it.
+//
+// Get returns `middleware.ErrNotFound` when the key doesn't exist. Errors
+// replied by Redis for the OOM condition should be wrapped with
+// `OutOfMemory`.
+type Client interface {
+	// Get returns the value of the key.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set sets the value of the key. A `middleware.KeepTTL` ttl retains the
+	// current TTL of the key.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// SetNX sets the value of the key unless it exists.
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+
+	// PTTL returns the TTL of the key, or -2 if the key doesn't exist and -1
+	// if it doesn't expire, like go-redis does.
+	PTTL(ctx context.Context, key string) (time.Duration, error)
+
+	// PExpire sets the TTL of the key.
+	PExpire(ctx context.Context, key string, ttl time.Duration) error
+
+	// Eval runs the script returning an integer.
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (int64, error)
+
+	// Del deletes the keys, which may live on different cluster slots.
+	Del(ctx context.Context, keys ...string) error
+
+	// SAdd adds the members to the set.
+	SAdd(ctx context.Context, key string, members ...string) error
+
+	// SMembers returns the members of the set.
+	SMembers(ctx context.Context, key string) ([]string, error)
+
+	// Scan calls fn with batches of the keys matching the glob, on all the
+	// masters of a cluster. fn is never called concurrently.
+	Scan(ctx context.Context, match string, count int64, fn func(keys []string) error) error
+
+	// Publish posts a message to the channel.
+	Publish(ctx context.Context, channel string) error
+
+	// Subscribe opens a Pub/Sub connection without subscriptions.
+	Subscribe(ctx context.Context) PubSub
+}
+
+// PubSub is a Pub/Sub connection of a `Client`.
+type PubSub interface {
+	Subscribe(ctx context.Context, channels ...string) error
+	Unsubscribe(ctx context.Context, channels ...string) error
+
+	// Listen calls fn with the channel of each message received, until the
+	// connection is closed.
+	Listen(fn func(channel string))
+
+	Close() error
+}
+
+// scanCount is the SCAN batch size used by `Store.Scan`.
+const scanCount = 100
+
+// setNXMultiScript sets the value to all keys only if none of them exist.
+const setNXMultiScript = `
+for _, k in ipairs(KEYS) do
+	if redis.call("EXISTS", k) == 1 then
+		return 0
+	end
+end
+for _, k in ipairs(KEYS) do
+	redis.call("SET", k, ARGV[1], "PX", ARGV[2])
+end
+return 1
+`
+
+// compareAndSwapScript sets the new value only if the key holds the old one.
+const compareAndSwapScript = `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2], "KEEPTTL")
+end
+return 1
+`
+
+// unlockScript deletes the key only if it holds the owner token.
+const unlockScript = `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("DEL", KEYS[1])
+`
+
+// extendTTLScript sets the TTL of the key unless it expires later.
+const extendTTLScript = `
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl == -2 then
+	return -2
+end
+if ttl >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("PEXPIRE", KEYS[1], ARGV[1])
+return 1
+`
+
+// globEscaper escapes the special characters of the Redis glob patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// Store is a `middleware.Store` backed by Redis. It implements
+// `middleware.Notifier` with Redis Pub/Sub over a single connection shared
+// by all subscribers.
+//
+// With a Redis Cluster client, multi-key deletes are pipelined per key and
+// scans visit all masters. Set `middleware.IdempotencyConfig.HashTags`, so
+// the keys of a record share its slot; `middleware.ClaimKeys` isn't
+// supported then.
+type Store struct {
+	client Client
+
+	mu     sync.Mutex
+	pubsub PubSub
+	subs   map[string]map[chan struct{}]struct{}
+}
+
+// NewStore returns a `Store` using the client.
+func NewStore(client Client) *Store {
+	return &Store{client: client}
+}
+
+// Get implements `middleware.Store`.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.client.Get(ctx, key)
+}
+
+// Set implements `middleware.Store`.
+func (s *Store) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, key, value, ttl)
+}
+
+// SetNX implements `middleware.Store`.
+func (s *Store) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, key, value, ttl)
+}
+
+// SetNXMulti implements `middleware.Store`.
+func (s *Store) SetNXMulti(ctx context.Context, keys []string, value []byte, ttl time.Duration) (bool, error) {
+	setOK, err := s.client.Eval(ctx, setNXMultiScript, keys, value, ttl.Milliseconds())
+
+	return setOK == 1, err
+}
+
+// CompareAndSwap implements `middleware.Store`.
+func (s *Store) CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error) {
+	if ttl == middleware.KeepTTL {
+		ttl = 0
+	}
+
+	swapped, err := s.client.Eval(ctx, compareAndSwapScript, []string{key}, old, new, ttl.Milliseconds())
+
+	return swapped == 1, err
+}
+
+// Lock implements `middleware.Store`.
+func (s *Store) Lock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, key, []byte(owner), ttl)
+}
+
+// Unlock implements `middleware.Store`.
+func (s *Store) Unlock(ctx context.Context, key, owner string) (bool, error) {
+	unlocked, err := s.client.Eval(ctx, unlockScript, []string{key}, owner)
+
+	return unlocked == 1, err
+}
+
+// Delete implements `middleware.Store`.
+func (s *Store) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return s.client.Del(ctx, keys...)
+}
+
+// TTL implements `middleware.Store`.
+func (s *Store) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := s.client.PTTL(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	// PTTL reports -2 when the key doesn't exist and -1 when it doesn't expire.
+	switch ttl {
+	case -2:
+		return 0, middleware.ErrNotFound
+
+	case -1:
+		return 0, nil
+	}
+
+	return ttl, nil
+}
+
+// Expire implements `middleware.Store`.
+func (s *Store) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return s.client.PExpire(ctx, key, ttl)
+}
+
+// ExtendTTL implements `middleware.TTLExtender`.
+func (s *Store) ExtendTTL(ctx context.Context, key string, ttl time.Duration) error {
+	extended, err := s.client.Eval(ctx, extendTTLScript, []string{key}, ttl.Milliseconds())
+	if err != nil {
+		return err
+	}
+
+	if extended == -2 {
+		return middleware.ErrNotFound
+	}
+
+	return nil
+}
+
+// AddMembers implements `middleware.Store`.
+func (s *Store) AddMembers(ctx context.Context, key string, members ...string) error {
+	return s.client.SAdd(ctx, key, members...)
+}
+
+// Members implements `middleware.Store`.
+func (s *Store) Members(ctx context.Context, key string) ([]string, error) {
+	return s.client.SMembers(ctx, key)
+}
+
+// Scan implements `middleware.Store`.
+func (s *Store) Scan(ctx context.Context, prefix string, fn func(keys []string) error) error {
+	return s.client.Scan(ctx, globEscaper.Replace(prefix)+"*", scanCount, fn)
+}
+
+// Notify implements `middleware.Notifier`.
+func (s *Store) Notify(ctx context.Context, key string) error {
+	return s.client.Publish(ctx, notifyChannel(key))
+}
+
+// Subscribe implements `middleware.Notifier`.
+func (s *Store) Subscribe(ctx context.Context, key string) (<-chan struct{}, func(), error) {
+	channel := notifyChannel(key)
+	notified := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pubsub == nil {
+		s.pubsub = s.client.Subscribe(context.Background())
+		s.subs = make(map[string]map[chan struct{}]struct{})
+
+		go s.pubsub.Listen(s.dispatch)
+	}
+
+	if len(s.subs[channel]) == 0 {
+		if err := s.pubsub.Subscribe(ctx, channel); err != nil {
+			return nil, nil, err
+		}
+
+		s.subs[channel] = make(map[chan struct{}]struct{})
+	}
+
+	s.subs[channel][notified] = struct{}{}
+
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.subs[channel], notified)
+
+		if len(s.subs[channel]) == 0 && s.pubsub != nil {
+			delete(s.subs, channel)
+
+			_ = s.pubsub.Unsubscribe(context.Background(), channel)
+		}
+	}
+
+	return notified, cancel, nil
+}
+
+// Close releases the Pub/Sub connection of the store. It doesn't close the
+// client.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pubsub == nil {
+		return nil
+	}
+
+	err := s.pubsub.Close()
+	s.pubsub = nil
+	s.subs = nil
+
+	return err
+}
+
+// dispatch delivers a Pub/Sub message to the local subscribers.
+func (s *Store) dispatch(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for notified := range s.subs[channel] {
+		select {
+		case notified <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notifyChannel returns the Pub/Sub channel of the key.
+func notifyChannel(key string) string {
+	return "ntf::" + key
+}
+
+// OutOfMemory wraps an OOM error replied by Redis, so it matches
+// `middleware.ErrOutOfMemory`.
+func OutOfMemory(err error) error {
+	return &storeError{kind: middleware.ErrOutOfMemory, err: err}
+}
+
+// storeError wraps a Redis error so it matches a `middleware.Store` error
+// sentinel.
+type storeError struct {
+	kind error
+	err  error
+}
+
+func (e *storeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *storeError) Unwrap() error {
+	return e.err
+}
+
+func (e *storeError) Is(target error) bool {
+	return target == e.kind
+}
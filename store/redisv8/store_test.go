@@ -0,0 +1,36 @@
+package redisv8_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+	"github.com/mgurevin/echo-idempotency/store/redisv8"
+	"github.com/mgurevin/echo-idempotency/store/storetest"
+)
+
+// TestConformance runs against the Redis server of the `REDIS_URL`, e.g.
+// "redis://localhost:6379/0".
+func TestConformance(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := redis.NewClient(opts)
+	t.Cleanup(func() { client.Close() })
+
+	storetest.Run(t, func(tb testing.TB) middleware.Store {
+		store := redisv8.NewStore(client)
+		tb.Cleanup(func() { store.Close() })
+
+		return store
+	})
+}
@@ -0,0 +1,213 @@
+// Package redisv9 implements the idempotency `Store` with go-redis v9.
+package redisv9
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+	"github.com/mgurevin/echo-idempotency/store/redisstore"
+)
+
+// Rediser is the subset of the go-redis client used by `Store`. It is
+// satisfied by `redis.UniversalClient`, i.e. the single node, Sentinel
+// (failover) and Cluster clients.
+type Rediser interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	PTTL(ctx context.Context, key string) *redis.DurationCmd
+	PExpire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+	SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	SMembers(ctx context.Context, key string) *redis.StringSliceCmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+var _ Rediser = redis.UniversalClient(nil)
+
+// redisCluster is implemented by `redis.ClusterClient`.
+type redisCluster interface {
+	ForEachMaster(ctx context.Context, fn func(ctx context.Context, client *redis.Client) error) error
+	Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+}
+
+// Store is a `middleware.Store` backed by Redis, see `redisstore.Store`.
+type Store = redisstore.Store
+
+// NewStore returns a `Store` using the client.
+func NewStore(client Rediser) *Store {
+	return redisstore.NewStore(adapter{client})
+}
+
+// adapter implements `redisstore.Client` with go-redis v9.
+type adapter struct {
+	client Rediser
+}
+
+func (a adapter) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := a.client.Get(ctx, key).Bytes()
+
+	return value, redisError(err)
+}
+
+func (a adapter) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl == middleware.KeepTTL {
+		ttl = redis.KeepTTL
+	}
+
+	return redisError(a.client.Set(ctx, key, value, ttl).Err())
+}
+
+func (a adapter) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	setOK, err := a.client.SetNX(ctx, key, value, ttl).Result()
+
+	return setOK, redisError(err)
+}
+
+func (a adapter) PTTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := a.client.PTTL(ctx, key).Result()
+
+	return ttl, redisError(err)
+}
+
+func (a adapter) PExpire(ctx context.Context, key string, ttl time.Duration) error {
+	return redisError(a.client.PExpire(ctx, key, ttl).Err())
+}
+
+func (a adapter) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (int64, error) {
+	result, err := a.client.Eval(ctx, script, keys, args...).Int64()
+
+	return result, redisError(err)
+}
+
+func (a adapter) Del(ctx context.Context, keys ...string) error {
+	// The keys of a cluster may live on different slots; the pipeline
+	// sends the deletes to their nodes in one round trip each.
+	if cluster, ok := a.client.(redisCluster); ok && len(keys) > 1 {
+		_, err := cluster.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, k := range keys {
+				pipe.Del(ctx, k)
+			}
+
+			return nil
+		})
+
+		return redisError(err)
+	}
+
+	return redisError(a.client.Del(ctx, keys...).Err())
+}
+
+func (a adapter) SAdd(ctx context.Context, key string, members ...string) error {
+	values := make([]interface{}, len(members))
+	for i, m := range members {
+		values[i] = m
+	}
+
+	return redisError(a.client.SAdd(ctx, key, values...).Err())
+}
+
+func (a adapter) SMembers(ctx context.Context, key string) ([]string, error) {
+	members, err := a.client.SMembers(ctx, key).Result()
+
+	return members, redisError(err)
+}
+
+func (a adapter) Scan(ctx context.Context, match string, count int64, fn func(keys []string) error) error {
+	// The masters of a cluster are scanned concurrently; fn is not.
+	if cluster, ok := a.client.(redisCluster); ok {
+		mu := sync.Mutex{}
+
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return redisScan(ctx, client, match, count, func(keys []string) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				return fn(keys)
+			})
+		})
+	}
+
+	return redisScan(ctx, a.client, match, count, fn)
+}
+
+func (a adapter) Publish(ctx context.Context, channel string) error {
+	return redisError(a.client.Publish(ctx, channel, 1).Err())
+}
+
+func (a adapter) Subscribe(ctx context.Context) redisstore.PubSub {
+	return pubSub{a.client.Subscribe(ctx)}
+}
+
+// redisScan calls fn with batches of the keys of the node matching the glob.
+func redisScan(ctx context.Context, client Rediser, match string, count int64, fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, match, count).Result()
+		if err != nil {
+			return redisError(err)
+		}
+
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+
+		cursor = next
+	}
+}
+
+// pubSub implements `redisstore.PubSub` with go-redis v9.
+type pubSub struct {
+	pubsub *redis.PubSub
+}
+
+func (p pubSub) Subscribe(ctx context.Context, channels ...string) error {
+	return redisError(p.pubsub.Subscribe(ctx, channels...))
+}
+
+func (p pubSub) Unsubscribe(ctx context.Context, channels ...string) error {
+	return redisError(p.pubsub.Unsubscribe(ctx, channels...))
+}
+
+func (p pubSub) Listen(fn func(channel string)) {
+	for msg := range p.pubsub.Channel() {
+		fn(msg.Channel)
+	}
+}
+
+func (p pubSub) Close() error {
+	return p.pubsub.Close()
+}
+
+// redisError translates the Redis errors to the `middleware.Store` errors.
+func redisError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if err == redis.Nil {
+		return middleware.ErrNotFound
+	}
+
+	var rErr redis.Error
+	if errors.As(err, &rErr) && strings.HasPrefix(rErr.Error(), "OOM ") {
+		return redisstore.OutOfMemory(err)
+	}
+
+	return err
+}
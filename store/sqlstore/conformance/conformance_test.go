@@ -0,0 +1,51 @@
+package conformance_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+	"github.com/mgurevin/echo-idempotency/store/sqlstore"
+	"github.com/mgurevin/echo-idempotency/store/storetest"
+)
+
+// TestPostgres runs against the PostgreSQL database of the `POSTGRES_DSN`,
+// e.g. "postgres://localhost/idempotency?sslmode=disable".
+func TestPostgres(t *testing.T) {
+	testConformance(t, "postgres", os.Getenv("POSTGRES_DSN"), sqlstore.Postgres)
+}
+
+// TestMySQL runs against the MySQL database of the `MYSQL_DSN`, e.g.
+// "root@tcp(localhost:3306)/idempotency".
+func TestMySQL(t *testing.T) {
+	testConformance(t, "mysql", os.Getenv("MYSQL_DSN"), sqlstore.MySQL)
+}
+
+func testConformance(t *testing.T, driver, dsn string, dialect sqlstore.Dialect) {
+	if dsn == "" {
+		t.Skipf("the %s DSN is not set", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.PingContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	store := sqlstore.NewStore(db, dialect, "")
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.Run(t, func(tb testing.TB) middleware.Store { return store })
+}
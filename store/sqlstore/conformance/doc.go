@@ -0,0 +1,4 @@
+// Package conformance runs the store conformance suite against the SQL
+// databases supported by `sqlstore`. It is a module of its own, so the
+// database drivers its tests link don't become dependencies of the store.
+package conformance
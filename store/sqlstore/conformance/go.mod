@@ -0,0 +1,9 @@
+module github.com/mgurevin/echo-idempotency/store/sqlstore/conformance
+
+go 1.18
+
+require (
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/lib/pq v1.10.7
+	github.com/mgurevin/echo-idempotency v0.1.0
+)
@@ -0,0 +1,93 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+)
+
+// lockDriver is a SQL driver answering every query with a single row holding
+// its DSN, e.g. the result of GET_LOCK; "NULL" answers NULL.
+type lockDriver struct{}
+
+func (lockDriver) Open(dsn string) (driver.Conn, error) { return lockConn(dsn), nil }
+
+type lockConn string
+
+func (c lockConn) Prepare(string) (driver.Stmt, error) { return lockStmt(c), nil }
+func (lockConn) Close() error                          { return nil }
+func (lockConn) Begin() (driver.Tx, error)             { return lockTx{}, nil }
+
+type lockTx struct{}
+
+func (lockTx) Commit() error   { return nil }
+func (lockTx) Rollback() error { return nil }
+
+type lockStmt string
+
+func (lockStmt) Close() error                               { return nil }
+func (lockStmt) NumInput() int                              { return -1 }
+func (lockStmt) Exec([]driver.Value) (driver.Result, error) { return driver.ResultNoRows, nil }
+func (s lockStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &lockRows{value: string(s)}, nil
+}
+
+type lockRows struct {
+	value string
+	done  bool
+}
+
+func (*lockRows) Columns() []string { return []string{"lock"} }
+func (*lockRows) Close() error      { return nil }
+
+func (r *lockRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+
+	r.done = true
+
+	if r.value != "NULL" {
+		dest[0] = r.value
+	}
+
+	return nil
+}
+
+func init() {
+	sql.Register("sqlstore-lock", lockDriver{})
+}
+
+func TestMySQLLockResult(t *testing.T) {
+	tests := []struct {
+		result string
+		err    error
+	}{
+		{"1", nil},
+		{"0", errLockNotAcquired},
+		{"NULL", errLockNotAcquired},
+	}
+
+	for _, tt := range tests {
+		db, err := sql.Open("sqlstore-lock", tt.result)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ran := false
+		err = NewStore(db, MySQL, "").locked(context.Background(), []string{"key"}, func(*sql.Tx) error {
+			ran = true
+
+			return nil
+		})
+
+		if !errors.Is(err, tt.err) || ran != (tt.err == nil) {
+			t.Errorf("GET_LOCK returning %s: got error %v and ran %v, want %v", tt.result, err, ran, tt.err)
+		}
+
+		db.Close()
+	}
+}
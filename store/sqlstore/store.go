@@ -0,0 +1,585 @@
+// Package sqlstore implements the idempotency `Store` with a PostgreSQL or
+// MySQL table, for services keeping the idempotency records next to their
+// business data instead of in Redis.
+package sqlstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+// DefaultTable is the name of the records table used when none is given.
+// The members of the sets live in the table suffixed with "_members".
+const DefaultTable = "idempotency_records"
+
+// scanBatchSize is the number of keys read per query by `Store.Scan`.
+const scanBatchSize = 100
+
+// errLockNotAcquired is returned when the lock of a key can't be acquired.
+var errLockNotAcquired = errors.New("sqlstore: key lock not acquired")
+
+// likeEscaper escapes the special characters of the LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Dialect holds the SQL specific to a database.
+type Dialect struct {
+	name string
+
+	// numbered placeholders ($1) instead of question marks.
+	numbered bool
+
+	// lock and unlock statements of the key locks; an empty unlock
+	// statement means the lock is released with the transaction. A checked
+	// lock statement returns 1 once the lock is acquired.
+	lock    string
+	unlock  string
+	checked bool
+
+	// lockArg returns the lock argument of the key.
+	lockArg func(key string) interface{}
+
+	insertMember string
+	schema       []string
+}
+
+var (
+	// Postgres is the PostgreSQL `Dialect`, using transaction level
+	// advisory locks.
+	Postgres = Dialect{
+		name:     "postgres",
+		numbered: true,
+		lock:     "SELECT pg_advisory_xact_lock(?)",
+		lockArg:  func(key string) interface{} { return lockID(key) },
+
+		insertMember: "INSERT INTO %s_members (set_key, member) VALUES (?, ?) ON CONFLICT DO NOTHING",
+
+		schema: []string{
+			"CREATE TABLE IF NOT EXISTS %[1]s (record_key TEXT PRIMARY KEY, record_value BYTEA NOT NULL, expires_at BIGINT)",
+			"CREATE INDEX IF NOT EXISTS %[1]s_expires_at ON %[1]s (expires_at)",
+			"CREATE TABLE IF NOT EXISTS %[1]s_members (set_key TEXT NOT NULL, member TEXT NOT NULL, PRIMARY KEY (set_key, member))",
+		},
+	}
+
+	// MySQL is the MySQL `Dialect`, using named locks.
+	MySQL = Dialect{
+		name:    "mysql",
+		lock:    "SELECT GET_LOCK(?, -1)",
+		unlock:  "SELECT RELEASE_LOCK(?)",
+		checked: true,
+		// MySQL limits the lock names to 64 characters.
+		lockArg: func(key string) interface{} { return strconv.FormatUint(uint64(lockID(key)), 16) },
+
+		insertMember: "INSERT IGNORE INTO %s_members (set_key, member) VALUES (?, ?)",
+
+		schema: []string{
+			"CREATE TABLE IF NOT EXISTS %[1]s (record_key VARBINARY(1024) NOT NULL PRIMARY KEY, record_value LONGBLOB NOT NULL, expires_at BIGINT NULL, INDEX %[1]s_expires_at (expires_at))",
+			"CREATE TABLE IF NOT EXISTS %[1]s_members (set_key VARBINARY(1024) NOT NULL, member VARBINARY(1024) NOT NULL, PRIMARY KEY (set_key, member))",
+		},
+	}
+)
+
+// Store is a `middleware.Store` backed by a SQL table. The writes of a key
+// run in a transaction holding a lock of the key, i.e. a PostgreSQL advisory
+// lock or a MySQL named lock, which makes `SetNX` and `CompareAndSwap` atomic
+// across processes. Expired rows are ignored by the reads and deleted by
+// `Cleanup`. It doesn't implement `middleware.Notifier`; the waiting requests
+// poll the records.
+type Store struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+}
+
+// NewStore returns a `Store` keeping the records in the table, or in
+// `DefaultTable` if table is empty. See `Migrate` to create the tables.
+func NewStore(db *sql.DB, dialect Dialect, table string) *Store {
+	if table == "" {
+		table = DefaultTable
+	}
+
+	return &Store{db: db, dialect: dialect, table: table}
+}
+
+// Migrate creates the tables of the store unless they exist.
+func (s *Store) Migrate(ctx context.Context) error {
+	for _, stmt := range s.dialect.schema {
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf(stmt, s.table)); err != nil {
+			return fmt.Errorf("migrating %s idempotency store: %w", s.dialect.name, err)
+		}
+	}
+
+	return nil
+}
+
+// Cleanup deletes the expired rows; run it periodically.
+func (s *Store) Cleanup(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE expires_at <= ?"), now()); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM %[1]s_members WHERE set_key NOT IN (SELECT record_key FROM %[1]s)"))
+
+	return err
+}
+
+// Get implements `middleware.Store`.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := s.get(ctx, s.db, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// Set implements `middleware.Store`.
+func (s *Store) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.locked(ctx, []string{key}, func(tx *sql.Tx) error {
+		expiresAt := expiry(ttl)
+		if ttl == middleware.KeepTTL {
+			_, current, err := s.get(ctx, tx, key)
+			if err != nil && !errors.Is(err, middleware.ErrNotFound) {
+				return err
+			}
+
+			expiresAt = current
+		}
+
+		return s.put(ctx, tx, key, value, expiresAt)
+	})
+}
+
+// SetNX implements `middleware.Store`.
+func (s *Store) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.SetNXMulti(ctx, []string{key}, value, ttl)
+}
+
+// SetNXMulti implements `middleware.Store`.
+func (s *Store) SetNXMulti(ctx context.Context, keys []string, value []byte, ttl time.Duration) (bool, error) {
+	setOK := false
+
+	err := s.locked(ctx, keys, func(tx *sql.Tx) error {
+		for _, k := range keys {
+			_, _, err := s.get(ctx, tx, k)
+			if err == nil {
+				return nil
+			}
+
+			if !errors.Is(err, middleware.ErrNotFound) {
+				return err
+			}
+		}
+
+		for _, k := range keys {
+			if err := s.put(ctx, tx, k, value, expiry(ttl)); err != nil {
+				return err
+			}
+		}
+
+		setOK = true
+
+		return nil
+	})
+
+	return setOK, err
+}
+
+// CompareAndSwap implements `middleware.Store`.
+func (s *Store) CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error) {
+	swapped := false
+
+	err := s.locked(ctx, []string{key}, func(tx *sql.Tx) error {
+		value, current, err := s.get(ctx, tx, key)
+		if errors.Is(err, middleware.ErrNotFound) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(value, old) {
+			return nil
+		}
+
+		expiresAt := current
+		if ttl != middleware.KeepTTL {
+			expiresAt = expiry(ttl)
+		}
+
+		swapped = true
+
+		return s.put(ctx, tx, key, new, expiresAt)
+	})
+
+	return swapped, err
+}
+
+// Lock implements `middleware.Store`.
+func (s *Store) Lock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	return s.SetNX(ctx, key, []byte(owner), ttl)
+}
+
+// Unlock implements `middleware.Store`.
+func (s *Store) Unlock(ctx context.Context, key, owner string) (bool, error) {
+	unlocked := false
+
+	err := s.locked(ctx, []string{key}, func(tx *sql.Tx) error {
+		value, _, err := s.get(ctx, tx, key)
+		if errors.Is(err, middleware.ErrNotFound) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if string(value) != owner {
+			return nil
+		}
+
+		unlocked = true
+
+		return s.delete(ctx, tx, key)
+	})
+
+	return unlocked, err
+}
+
+// Delete implements `middleware.Store`.
+func (s *Store) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := s.delete(ctx, tx, k); err != nil {
+			_ = tx.Rollback()
+
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// TTL implements `middleware.Store`.
+func (s *Store) TTL(ctx context.Context, key string) (time.Duration, error) {
+	_, expiresAt, err := s.get(ctx, s.db, key)
+	if err != nil {
+		return 0, err
+	}
+
+	if !expiresAt.Valid {
+		return 0, nil
+	}
+
+	return time.Duration(expiresAt.Int64-now()) * time.Millisecond, nil
+}
+
+// Expire implements `middleware.Store`.
+func (s *Store) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	_, err := s.db.ExecContext(ctx, s.query("UPDATE %s SET expires_at = ? WHERE record_key = ? AND (expires_at IS NULL OR expires_at > ?)"), expiry(ttl), key, now())
+
+	return err
+}
+
+// ExtendTTL implements `middleware.TTLExtender`.
+func (s *Store) ExtendTTL(ctx context.Context, key string, ttl time.Duration) error {
+	expiresAt := expiry(ttl)
+
+	res, err := s.db.ExecContext(ctx, s.query("UPDATE %s SET expires_at = ? WHERE record_key = ? AND (expires_at IS NULL OR (expires_at > ? AND expires_at < ?))"), expiresAt, key, now(), expiresAt)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	// Either the key expires later or it doesn't exist.
+	_, _, err = s.get(ctx, s.db, key)
+
+	return err
+}
+
+// AddMembers implements `middleware.Store`. The set is a row of the records
+// table holding its expiration, with its members in the members table.
+func (s *Store) AddMembers(ctx context.Context, key string, members ...string) error {
+	return s.locked(ctx, []string{key}, func(tx *sql.Tx) error {
+		_, _, err := s.get(ctx, tx, key)
+		if errors.Is(err, middleware.ErrNotFound) {
+			err = s.put(ctx, tx, key, []byte{}, sql.NullInt64{})
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for _, m := range members {
+			if _, err := tx.ExecContext(ctx, s.query(s.dialect.insertMember), key, m); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Members implements `middleware.Store`.
+func (s *Store) Members(ctx context.Context, key string) ([]string, error) {
+	if _, _, err := s.get(ctx, s.db, key); err != nil {
+		if errors.Is(err, middleware.ErrNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.query("SELECT member FROM %s_members WHERE set_key = ?"), key)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var members []string
+	for rows.Next() {
+		var m string
+		if err := rows.Scan(&m); err != nil {
+			return nil, err
+		}
+
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+// Scan implements `middleware.Store`.
+func (s *Store) Scan(ctx context.Context, prefix string, fn func(keys []string) error) error {
+	pattern := likeEscaper.Replace(prefix) + "%"
+	after := ""
+
+	for {
+		keys, err := s.scanBatch(ctx, pattern, after)
+		if err != nil {
+			return err
+		}
+
+		if len(keys) == 0 {
+			return nil
+		}
+
+		if err := fn(keys); err != nil {
+			return err
+		}
+
+		if len(keys) < scanBatchSize {
+			return nil
+		}
+
+		after = keys[len(keys)-1]
+	}
+}
+
+func (s *Store) scanBatch(ctx context.Context, pattern, after string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.query("SELECT record_key FROM %s WHERE record_key LIKE ? AND record_key > ? AND (expires_at IS NULL OR expires_at > ?) ORDER BY record_key LIMIT ?"), pattern, after, now(), scanBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// get returns the value and the expiration of the key, or
+// `middleware.ErrNotFound` if it doesn't exist or expired.
+func (s *Store) get(ctx context.Context, q querier, key string) ([]byte, sql.NullInt64, error) {
+	var (
+		value     []byte
+		expiresAt sql.NullInt64
+	)
+
+	err := q.QueryRowContext(ctx, s.query("SELECT record_value, expires_at FROM %s WHERE record_key = ? AND (expires_at IS NULL OR expires_at > ?)"), key, now()).Scan(&value, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, expiresAt, middleware.ErrNotFound
+	}
+
+	return value, expiresAt, err
+}
+
+// put replaces the row of the key; the caller holds the lock of the key.
+func (s *Store) put(ctx context.Context, tx *sql.Tx, key string, value []byte, expiresAt sql.NullInt64) error {
+	if err := s.delete(ctx, tx, key); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, s.query("INSERT INTO %s (record_key, record_value, expires_at) VALUES (?, ?, ?)"), key, value, expiresAt)
+
+	return err
+}
+
+func (s *Store) delete(ctx context.Context, tx *sql.Tx, key string) error {
+	if _, err := tx.ExecContext(ctx, s.query("DELETE FROM %s WHERE record_key = ?"), key); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, s.query("DELETE FROM %s_members WHERE set_key = ?"), key)
+
+	return err
+}
+
+// locked runs fn in a transaction holding the locks of the keys. The locks
+// are acquired in order, so concurrent multi-key writes can't deadlock.
+func (s *Store) locked(ctx context.Context, keys []string, fn func(tx *sql.Tx) error) (err error) {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	var acquired []string
+	if s.dialect.unlock != "" {
+		defer func() {
+			for _, k := range acquired {
+				_, _ = conn.ExecContext(context.Background(), s.query(s.dialect.unlock), s.dialect.lockArg(s.table+"::"+k))
+			}
+		}()
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for i, k := range keys {
+		if i > 0 && k == keys[i-1] {
+			continue
+		}
+
+		if err := s.lock(ctx, tx, k); err != nil {
+			_ = tx.Rollback()
+
+			return err
+		}
+
+		acquired = append(acquired, k)
+	}
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lock acquires the lock of the key in the transaction.
+func (s *Store) lock(ctx context.Context, tx *sql.Tx, key string) error {
+	arg := s.dialect.lockArg(s.table + "::" + key)
+
+	if !s.dialect.checked {
+		_, err := tx.ExecContext(ctx, s.query(s.dialect.lock), arg)
+
+		return err
+	}
+
+	// MySQL GET_LOCK returns 0 on timeout and NULL on errors.
+	var locked sql.NullInt64
+	if err := tx.QueryRowContext(ctx, s.query(s.dialect.lock), arg).Scan(&locked); err != nil {
+		return err
+	}
+
+	if !locked.Valid || locked.Int64 != 1 {
+		return errLockNotAcquired
+	}
+
+	return nil
+}
+
+// query returns the statement with the table name and the placeholders of
+// the dialect.
+func (s *Store) query(stmt string) string {
+	if strings.Contains(stmt, "%") {
+		stmt = fmt.Sprintf(stmt, s.table)
+	}
+
+	if !s.dialect.numbered {
+		return stmt
+	}
+
+	b := strings.Builder{}
+	n := 0
+
+	for _, r := range stmt {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// expiry returns the expiration of a ttl in Unix milliseconds; NULL means no
+// expiration.
+func expiry(ttl time.Duration) sql.NullInt64 {
+	if ttl <= 0 {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: now() + ttl.Milliseconds(), Valid: true}
+}
+
+func now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// lockID hashes the key into the int64 key space of the advisory locks.
+func lockID(key string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+
+	return int64(h.Sum64())
+}
@@ -0,0 +1,120 @@
+package storetest
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+// Benchmark runs the benchmarks of the store operations on the hot path of
+// the middleware, and of the middleware using the store.
+func Benchmark(b *testing.B, newStore NewStore) {
+	benchmarks := []struct {
+		name string
+		fn   func(b *testing.B, store middleware.Store, key func(string) string)
+	}{
+		{"SetNX", benchSetNX},
+		{"Get", benchGet},
+		{"CompareAndSwap", benchCompareAndSwap},
+		{"MiddlewareFirst", benchMiddlewareFirst},
+		{"MiddlewareReplay", benchMiddlewareReplay},
+	}
+
+	for _, bb := range benchmarks {
+		bb := bb
+
+		b.Run(bb.name, func(b *testing.B) {
+			prefix := "storetest:" + runID + ":" + bb.name + ":" + strconv.Itoa(b.N) + ":"
+
+			b.ReportAllocs()
+			bb.fn(b, newStore(b), func(k string) string { return prefix + k })
+		})
+	}
+}
+
+func benchSetNX(b *testing.B, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+	value := []byte("value")
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := store.SetNX(ctx, key(strconv.Itoa(i)), value, time.Minute); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchGet(b *testing.B, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+	k := key("k")
+
+	if err := store.Set(ctx, k, make([]byte, 1024), time.Minute); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Get(ctx, k); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchCompareAndSwap(b *testing.B, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+	k := key("k")
+	values := [][]byte{[]byte("a"), []byte("b")}
+
+	if err := store.Set(ctx, k, values[0], time.Minute); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		swapped, err := store.CompareAndSwap(ctx, k, values[i%2], values[(i+1)%2], middleware.KeepTTL)
+		if err != nil || !swapped {
+			b.Fatal("CompareAndSwap failed", err)
+		}
+	}
+}
+
+// benchMiddlewareFirst measures the first executions, which claim and
+// finalize a record.
+func benchMiddlewareFirst(b *testing.B, store middleware.Store, key func(string) string) {
+	e, _ := newEcho(b, config(store, key), func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	})
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if rec := send(e, strconv.Itoa(i)); rec.Code != http.StatusCreated {
+			b.Fatal(rec.Code)
+		}
+	}
+}
+
+// benchMiddlewareReplay measures the replays of a stored record.
+func benchMiddlewareReplay(b *testing.B, store middleware.Store, key func(string) string) {
+	e, _ := newEcho(b, config(store, key), func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	})
+
+	send(e, "k")
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if rec := send(e, "k"); rec.Code != http.StatusCreated {
+			b.Fatal(rec.Code)
+		}
+	}
+}
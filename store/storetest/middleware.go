@@ -0,0 +1,125 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+// newEcho returns an echo instance running the middleware configured with
+// the store in front of the handler.
+func newEcho(t testing.TB, config middleware.IdempotencyConfig, h echo.HandlerFunc) (*echo.Echo, *middleware.Manager) {
+	m, err := config.ToManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", h)
+
+	return e, m
+}
+
+func send(e *echo.Echo, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("X-Idempotency-Key", key)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// config returns the middleware config keeping the keys of the test apart.
+func config(store middleware.Store, key func(string) string) middleware.IdempotencyConfig {
+	return middleware.IdempotencyConfig{
+		Store:             store,
+		KeyPrefix:         key(""),
+		DisableCoalescing: true,
+		WaitPollInterval:  10 * time.Millisecond,
+	}
+}
+
+// testFinalize checks that the concurrent duplicates of a request execute
+// the handler once and all get its response, i.e. the claim and the final
+// swap of the record are atomic.
+func testFinalize(t *testing.T, store middleware.Store, key func(string) string) {
+	var executions int32
+
+	e, _ := newEcho(t, config(store, key), func(c echo.Context) error {
+		n := atomic.AddInt32(&executions, 1)
+		time.Sleep(50 * time.Millisecond)
+
+		return c.String(http.StatusCreated, "execution "+strconv.Itoa(int(n)))
+	})
+
+	race(t, func(int) error {
+		rec := send(e, "k")
+		if rec.Code != http.StatusCreated || rec.Body.String() != "execution 1" {
+			return errors.New("unexpected response: " + strconv.Itoa(rec.Code) + " " + rec.Body.String())
+		}
+
+		return nil
+	})
+
+	if executions != 1 {
+		t.Fatalf("concurrent duplicates executed the handler %d times, want 1", executions)
+	}
+}
+
+// testTakeover checks that a record abandoned by its instance is taken over
+// by a duplicate on another instance, and that the late completion of the
+// abandoned request doesn't overwrite the record of the new owner.
+func testTakeover(t *testing.T, store middleware.Store, key func(string) string) {
+	started, unblock := make(chan struct{}), make(chan struct{})
+
+	first, firstManager := newEcho(t, config(store, key), func(c echo.Context) error {
+		close(started)
+		<-unblock
+
+		return c.String(http.StatusCreated, "first")
+	})
+
+	second, _ := newEcho(t, config(store, key), func(c echo.Context) error {
+		return c.String(http.StatusCreated, "second")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		send(first, "k")
+	}()
+
+	<-started
+
+	// Shutting the first instance down with an expired context abandons the
+	// record of its running request.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := firstManager.Shutdown(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Shutdown: got error %v, want context.Canceled", err)
+	}
+
+	if rec := send(second, "k"); rec.Body.String() != "second" {
+		t.Fatalf("duplicate of an abandoned record: got %q, want the response of a new execution", rec.Body.String())
+	}
+
+	close(unblock)
+	<-done
+
+	if rec := send(second, "k"); rec.Body.String() != "second" {
+		t.Fatalf("replay after the takeover: got %q, want the response of the new owner", rec.Body.String())
+	}
+}
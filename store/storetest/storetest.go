@@ -0,0 +1,571 @@
+// Package storetest provides the conformance tests every idempotency `Store`
+// implementation must pass, and benchmarks to compare them. Adapters call
+// `Run` and `Benchmark` from their own tests:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(tb testing.TB) middleware.Store { return newStore(tb) })
+//	}
+//
+//	func BenchmarkStore(b *testing.B) {
+//		storetest.Benchmark(b, func(tb testing.TB) middleware.Store { return newStore(tb) })
+//	}
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+// concurrency is the number of goroutines racing in the concurrency tests.
+const concurrency = 16
+
+// ttl is the expiration used by the expiry tests; stores must honor
+// expirations with a precision well below it.
+const ttl = 200 * time.Millisecond
+
+// NewStore returns the store under test. Stores shared between tests, e.g.
+// a Redis server, don't need to be emptied: the keys of each test are
+// unique to the run.
+type NewStore func(tb testing.TB) middleware.Store
+
+// runID makes the keys of the runs sharing a store unique.
+var runID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// Run runs the conformance tests of the store.
+func Run(t *testing.T, newStore NewStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store middleware.Store, key func(string) string)
+	}{
+		{"Get", testGet},
+		{"Set", testSet},
+		{"SetKeepTTL", testSetKeepTTL},
+		{"SetNX", testSetNX},
+		{"SetNXConcurrent", testSetNXConcurrent},
+		{"SetNXMulti", testSetNXMulti},
+		{"CompareAndSwap", testCompareAndSwap},
+		{"CompareAndSwapConcurrent", testCompareAndSwapConcurrent},
+		{"Lock", testLock},
+		{"Delete", testDelete},
+		{"TTL", testTTL},
+		{"Expire", testExpire},
+		{"Members", testMembers},
+		{"Scan", testScan},
+		{"TTLExtender", testTTLExtender},
+		{"Notifier", testNotifier},
+		{"Takeover", testTakeover},
+		{"Finalize", testFinalize},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			prefix := "storetest:" + runID + ":" + tt.name + ":"
+
+			tt.fn(t, newStore(t), func(k string) string { return prefix + k })
+		})
+	}
+}
+
+func testGet(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, key("missing")); !errors.Is(err, middleware.ErrNotFound) {
+		t.Fatalf("Get of a missing key: got error %v, want ErrNotFound", err)
+	}
+}
+
+func testSet(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	value := []byte("value")
+	if err := store.Set(ctx, key("k"), value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The middleware recycles the buffers it passes to the store.
+	copy(value, "XXXXX")
+
+	expectValue(t, store, key("k"), "value")
+
+	if err := store.Set(ctx, key("k"), []byte("other"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, store, key("k"), "other")
+
+	if err := store.Set(ctx, key("empty"), []byte{}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, store, key("empty"), "")
+}
+
+func testSetKeepTTL(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	if err := store.Set(ctx, key("k"), []byte("a"), ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Set(ctx, key("k"), []byte("b"), middleware.KeepTTL); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, store, key("k"), "b")
+	expectTTL(t, store, key("k"), ttl)
+
+	time.Sleep(ttl + ttl/2)
+
+	expectMissing(t, store, key("k"))
+}
+
+func testSetNX(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	stored, err := store.SetNX(ctx, key("k"), []byte("first"), time.Minute)
+	if err != nil || !stored {
+		t.Fatalf("SetNX of a missing key: got %v, %v, want true", stored, err)
+	}
+
+	stored, err = store.SetNX(ctx, key("k"), []byte("second"), time.Minute)
+	if err != nil || stored {
+		t.Fatalf("SetNX of an existing key: got %v, %v, want false", stored, err)
+	}
+
+	expectValue(t, store, key("k"), "first")
+
+	if _, err := store.SetNX(ctx, key("expiring"), []byte("a"), ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(ttl + ttl/2)
+
+	stored, err = store.SetNX(ctx, key("expiring"), []byte("b"), time.Minute)
+	if err != nil || !stored {
+		t.Fatalf("SetNX of an expired key: got %v, %v, want true", stored, err)
+	}
+}
+
+func testSetNXConcurrent(t *testing.T, store middleware.Store, key func(string) string) {
+	var winners int32
+
+	race(t, func(i int) error {
+		stored, err := store.SetNX(context.Background(), key("k"), []byte(strconv.Itoa(i)), time.Minute)
+		if stored {
+			atomic.AddInt32(&winners, 1)
+		}
+
+		return err
+	})
+
+	if winners != 1 {
+		t.Fatalf("concurrent SetNX: %d succeeded, want 1", winners)
+	}
+}
+
+func testSetNXMulti(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	stored, err := store.SetNXMulti(ctx, []string{key("a"), key("b")}, []byte("v"), time.Minute)
+	if err != nil || !stored {
+		t.Fatalf("SetNXMulti of missing keys: got %v, %v, want true", stored, err)
+	}
+
+	expectValue(t, store, key("a"), "v")
+	expectValue(t, store, key("b"), "v")
+
+	stored, err = store.SetNXMulti(ctx, []string{key("c"), key("b")}, []byte("w"), time.Minute)
+	if err != nil || stored {
+		t.Fatalf("SetNXMulti with an existing key: got %v, %v, want false", stored, err)
+	}
+
+	expectMissing(t, store, key("c"))
+	expectValue(t, store, key("b"), "v")
+}
+
+func testCompareAndSwap(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	swapped, err := store.CompareAndSwap(ctx, key("missing"), []byte("a"), []byte("b"), time.Minute)
+	if err != nil || swapped {
+		t.Fatalf("CompareAndSwap of a missing key: got %v, %v, want false", swapped, err)
+	}
+
+	expectMissing(t, store, key("missing"))
+
+	if err := store.Set(ctx, key("k"), []byte("a"), ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	swapped, err = store.CompareAndSwap(ctx, key("k"), []byte("x"), []byte("b"), time.Minute)
+	if err != nil || swapped {
+		t.Fatalf("CompareAndSwap with another value: got %v, %v, want false", swapped, err)
+	}
+
+	expectValue(t, store, key("k"), "a")
+
+	swapped, err = store.CompareAndSwap(ctx, key("k"), []byte("a"), []byte("b"), middleware.KeepTTL)
+	if err != nil || !swapped {
+		t.Fatalf("CompareAndSwap with the value: got %v, %v, want true", swapped, err)
+	}
+
+	expectValue(t, store, key("k"), "b")
+	expectTTL(t, store, key("k"), ttl)
+
+	swapped, err = store.CompareAndSwap(ctx, key("k"), []byte("b"), []byte("c"), time.Minute)
+	if err != nil || !swapped {
+		t.Fatalf("CompareAndSwap with a new TTL: got %v, %v, want true", swapped, err)
+	}
+
+	expectTTL(t, store, key("k"), time.Minute)
+}
+
+func testCompareAndSwapConcurrent(t *testing.T, store middleware.Store, key func(string) string) {
+	if err := store.Set(context.Background(), key("k"), []byte("old"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	var winners int32
+
+	race(t, func(i int) error {
+		swapped, err := store.CompareAndSwap(context.Background(), key("k"), []byte("old"), []byte(strconv.Itoa(i)), middleware.KeepTTL)
+		if swapped {
+			atomic.AddInt32(&winners, 1)
+		}
+
+		return err
+	})
+
+	if winners != 1 {
+		t.Fatalf("concurrent CompareAndSwap: %d succeeded, want 1", winners)
+	}
+}
+
+func testLock(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	locked, err := store.Lock(ctx, key("l"), "owner-a", ttl)
+	if err != nil || !locked {
+		t.Fatalf("Lock of a free lock: got %v, %v, want true", locked, err)
+	}
+
+	locked, err = store.Lock(ctx, key("l"), "owner-b", ttl)
+	if err != nil || locked {
+		t.Fatalf("Lock of a held lock: got %v, %v, want false", locked, err)
+	}
+
+	unlocked, err := store.Unlock(ctx, key("l"), "owner-b")
+	if err != nil || unlocked {
+		t.Fatalf("Unlock by another owner: got %v, %v, want false", unlocked, err)
+	}
+
+	unlocked, err = store.Unlock(ctx, key("l"), "owner-a")
+	if err != nil || !unlocked {
+		t.Fatalf("Unlock by the owner: got %v, %v, want true", unlocked, err)
+	}
+
+	if _, err := store.Lock(ctx, key("expiring"), "owner-a", ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(ttl + ttl/2)
+
+	locked, err = store.Lock(ctx, key("expiring"), "owner-b", ttl)
+	if err != nil || !locked {
+		t.Fatalf("Lock of an expired lock: got %v, %v, want true", locked, err)
+	}
+
+	// The expired owner must not release the lock of the new one.
+	unlocked, err = store.Unlock(ctx, key("expiring"), "owner-a")
+	if err != nil || unlocked {
+		t.Fatalf("Unlock by the expired owner: got %v, %v, want false", unlocked, err)
+	}
+}
+
+func testDelete(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	for _, k := range []string{"a", "b"} {
+		if err := store.Set(ctx, key(k), []byte("v"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Delete(ctx, key("a"), key("b"), key("missing")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMissing(t, store, key("a"))
+	expectMissing(t, store, key("b"))
+}
+
+func testTTL(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	if _, err := store.TTL(ctx, key("missing")); !errors.Is(err, middleware.ErrNotFound) {
+		t.Fatalf("TTL of a missing key: got error %v, want ErrNotFound", err)
+	}
+
+	if err := store.Set(ctx, key("persistent"), []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, err := store.TTL(ctx, key("persistent")); err != nil || d != 0 {
+		t.Fatalf("TTL of a key without expiration: got %v, %v, want 0", d, err)
+	}
+
+	if err := store.Set(ctx, key("k"), []byte("v"), ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTTL(t, store, key("k"), ttl)
+
+	time.Sleep(ttl + ttl/2)
+
+	expectMissing(t, store, key("k"))
+}
+
+func testExpire(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	if err := store.Set(ctx, key("k"), []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Expire(ctx, key("k"), ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTTL(t, store, key("k"), ttl)
+
+	time.Sleep(ttl + ttl/2)
+
+	expectMissing(t, store, key("k"))
+}
+
+func testMembers(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	if members, err := store.Members(ctx, key("missing")); err != nil || len(members) != 0 {
+		t.Fatalf("Members of a missing set: got %v, %v, want none", members, err)
+	}
+
+	if err := store.AddMembers(ctx, key("s"), "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.AddMembers(ctx, key("s"), "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := store.Members(ctx, key("s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(members)
+
+	if !equal(members, []string{"a", "b", "c"}) {
+		t.Fatalf("Members: got %v, want [a b c]", members)
+	}
+}
+
+func testScan(t *testing.T, store middleware.Store, key func(string) string) {
+	ctx := context.Background()
+
+	var want []string
+	for i := 0; i < 250; i++ {
+		k := key("in:" + strconv.Itoa(i))
+		want = append(want, k)
+
+		if err := store.Set(ctx, k, []byte("v"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Set(ctx, key("out"), []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err := store.Scan(ctx, key("in:"), func(keys []string) error {
+		got = append(got, keys...)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(got)
+	sort.Strings(want)
+
+	// Stores may return a key more than once, e.g. Redis during a rehash.
+	got = dedup(got)
+
+	if !equal(got, want) {
+		t.Fatalf("Scan: got %d keys, want %d", len(got), len(want))
+	}
+
+	stop := errors.New("stop")
+	if err := store.Scan(ctx, key("in:"), func([]string) error { return stop }); !errors.Is(err, stop) {
+		t.Fatalf("Scan: got error %v, want the error of fn", err)
+	}
+}
+
+func testTTLExtender(t *testing.T, store middleware.Store, key func(string) string) {
+	extender, ok := store.(middleware.TTLExtender)
+	if !ok {
+		t.Skip("store doesn't implement TTLExtender")
+	}
+
+	ctx := context.Background()
+
+	if err := extender.ExtendTTL(ctx, key("missing"), time.Minute); !errors.Is(err, middleware.ErrNotFound) {
+		t.Fatalf("ExtendTTL of a missing key: got error %v, want ErrNotFound", err)
+	}
+
+	if err := store.Set(ctx, key("k"), []byte("v"), ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extender.ExtendTTL(ctx, key("k"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTTL(t, store, key("k"), time.Minute)
+
+	// A shorter TTL doesn't shorten the expiration.
+	if err := extender.ExtendTTL(ctx, key("k"), ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTTL(t, store, key("k"), time.Minute)
+}
+
+func testNotifier(t *testing.T, store middleware.Store, key func(string) string) {
+	notifier, ok := store.(middleware.Notifier)
+	if !ok {
+		t.Skip("store doesn't implement Notifier")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ch, unsubscribe, err := notifier.Subscribe(ctx, key("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unsubscribe()
+
+	if err := notifier.Notify(ctx, key("k")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ch:
+
+	case <-ctx.Done():
+		t.Fatal("Notify didn't wake up the subscriber")
+	}
+}
+
+// race runs fn concurrently, starting all goroutines at once.
+func race(t *testing.T, fn func(i int) error) {
+	start := make(chan struct{})
+	errs := make(chan error, concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			<-start
+			errs <- fn(i)
+		}(i)
+	}
+
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectValue(t *testing.T, store middleware.Store, key, want string) {
+	t.Helper()
+
+	got, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get %s: %v", key, err)
+	}
+
+	if !bytes.Equal(got, []byte(want)) {
+		t.Fatalf("Get %s: got %q, want %q", key, got, want)
+	}
+}
+
+func expectMissing(t *testing.T, store middleware.Store, key string) {
+	t.Helper()
+
+	if _, err := store.Get(context.Background(), key); !errors.Is(err, middleware.ErrNotFound) {
+		t.Fatalf("Get %s: got error %v, want ErrNotFound", key, err)
+	}
+}
+
+// expectTTL checks that the key expires within max, but not right away.
+func expectTTL(t *testing.T, store middleware.Store, key string, max time.Duration) {
+	t.Helper()
+
+	d, err := store.TTL(context.Background(), key)
+	if err != nil {
+		t.Fatalf("TTL %s: %v", key, err)
+	}
+
+	if d <= max/2 || d > max {
+		t.Fatalf("TTL %s: got %v, want up to %v", key, d, max)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func dedup(sorted []string) []string {
+	out := sorted[:0]
+	for i, s := range sorted {
+		if i == 0 || s != sorted[i-1] {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrReplayThrottled is the internal error of the responses sent when a
+// record is replayed more often than `ReplayInterval` or `ReplayLimit`
+// allows.
+var ErrReplayThrottled = errors.New("idempotency record replayed too often")
+
+// replayLimitAttempts bounds the attempts to count a replay of a key whose
+// counter is updated concurrently.
+const replayLimitAttempts = 10
+
+// throttleKey returns the store key that marks a recent replay of the record.
+func (config IdempotencyConfig) throttleKey(reqKey string) string {
+	return config.derivedKey("thr", reqKey)
+}
+
+// throttleReplay allows at most one replay of the record per
+// `ReplayInterval`. Throttled requests get 429 Too Many Requests with a
+// Retry-After header.
+func throttleReplay(config IdempotencyConfig, c echo.Context, reqKey string) error {
+	if config.ReplayInterval <= 0 {
+		return nil
+	}
+
+	ctx := c.Request().Context()
+	thrKey := config.throttleKey(reqKey)
+
+	setOK, err := config.Store.SetNX(ctx, thrKey, []byte{1}, config.ReplayInterval)
+	if err != nil {
+		return err
+	}
+
+	if setOK {
+		return nil
+	}
+
+	wait, err := config.Store.TTL(ctx, thrKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if wait <= 0 {
+		wait = config.ReplayInterval
+	}
+
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+
+	return echo.NewHTTPError(http.StatusTooManyRequests).SetInternal(ErrReplayThrottled)
+}
+
+// replayCountKey returns the store key counting the replays of the record.
+func (config IdempotencyConfig) replayCountKey(reqKey string) string {
+	return config.derivedKey("rpl", reqKey)
+}
+
+// limitReplays allows at most `ReplayLimit` replays of the record per
+// `ReplayLimitWindow`. The counter is updated with compare-and-swap; a
+// counter too contended to be updated counts as exhausted.
+func limitReplays(config IdempotencyConfig, c echo.Context, reqKey string) error {
+	if config.ReplayLimit <= 0 {
+		return nil
+	}
+
+	ctx := c.Request().Context()
+	cntKey := config.replayCountKey(reqKey)
+
+	for i := 0; i < replayLimitAttempts; i++ {
+		count, err := config.Store.Get(ctx, cntKey)
+		if errors.Is(err, ErrNotFound) {
+			setOK, err := config.Store.SetNX(ctx, cntKey, []byte("1"), config.ReplayLimitWindow)
+			if err != nil || setOK {
+				return err
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		n, err := strconv.Atoi(string(count))
+		if err != nil {
+			return err
+		}
+
+		if n >= config.ReplayLimit {
+			break
+		}
+
+		swapped, err := config.Store.CompareAndSwap(ctx, cntKey, count, []byte(strconv.Itoa(n+1)), KeepTTL)
+		if err != nil || swapped {
+			return err
+		}
+	}
+
+	wait, err := config.Store.TTL(ctx, cntKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if wait <= 0 {
+		wait = config.ReplayLimitWindow
+	}
+
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+
+	return echo.NewHTTPError(http.StatusTooManyRequests).SetInternal(ErrReplayThrottled)
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newThrottleEcho(t *testing.T, config IdempotencyConfig) *echo.Echo {
+	t.Helper()
+
+	config.Store = NewMemoryStore(0)
+
+	mw, err := config.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(mw)
+	e.POST("/", func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	})
+
+	return e
+}
+
+func sendThrottled(e *echo.Echo, body string) int {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("X-Idempotency-Key", "key")
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec.Code
+}
+
+func TestThrottleReplayOnlyReplays(t *testing.T) {
+	e := newThrottleEcho(t, IdempotencyConfig{ReplayInterval: time.Hour})
+
+	for i, tt := range []struct {
+		body string
+		want int
+	}{
+		{"body", http.StatusCreated},
+		{"other body", http.StatusUnprocessableEntity},
+		{"body", http.StatusCreated},
+		{"body", http.StatusTooManyRequests},
+	} {
+		if got := sendThrottled(e, tt.body); got != tt.want {
+			t.Fatalf("request #%d: got status %d, want %d", i, got, tt.want)
+		}
+	}
+}
+
+func TestLimitReplaysOnlyReplays(t *testing.T) {
+	e := newThrottleEcho(t, IdempotencyConfig{ReplayLimit: 1})
+
+	for i, tt := range []struct {
+		body string
+		want int
+	}{
+		{"body", http.StatusCreated},
+		{"other body", http.StatusUnprocessableEntity},
+		{"body", http.StatusCreated},
+		{"body", http.StatusTooManyRequests},
+	} {
+		if got := sendThrottled(e, tt.body); got != tt.want {
+			t.Fatalf("request #%d: got status %d, want %d", i, got, tt.want)
+		}
+	}
+}
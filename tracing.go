@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts the spans of the middleware. It mirrors the subset of the
+// OpenTelemetry tracing API used by the middleware; the OpenTelemetry
+// adapter ships in the `tracing/otel` module, so the package doesn't depend
+// on OpenTelemetry:
+//
+//	import idempotencyotel "github.com/mgurevin/echo-idempotency/tracing/otel"
+//
+//	config.Tracer = idempotencyotel.NewTracer(otel.Tracer("github.com/mgurevin/echo-idempotency"))
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a `Tracer`.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	AddEvent(name string, attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute is a key-value pair describing a span or a span event.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attr returns an `Attribute`.
+func Attr(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute)    {}
+func (noopSpan) AddEvent(string, ...Attribute) {}
+func (noopSpan) RecordError(error)             {}
+func (noopSpan) End()                          {}
+
+// startSpan starts a span with the `Tracer` of the config, if any.
+func (config IdempotencyConfig) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if config.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+
+	return config.Tracer.Start(ctx, name)
+}
+
+// keyHash returns the hashed idempotency key used in the span attributes, so
+// the traces don't expose the keys.
+func keyHash(key string) string {
+	return SHA256KeyNormalizer(key)[:16]
+}
+
+// waitEvent records the time a request waited for a concurrent request.
+func waitEvent(span Span, d time.Duration) {
+	span.AddEvent("waited for concurrent request", Attr("idempotency.wait_ms", d.Milliseconds()))
+}
+
+// traceStore returns the store wrapped with spans around its operations.
+// Stores implementing `Notifier` stay `Notifier`s. The wrapper is always a
+// `TTLExtender`, forwarding to the store when it implements it.
+func traceStore(store Store, tracer Tracer) Store {
+	traced := &tracedStore{store: store, tracer: tracer}
+	if notifier, ok := store.(Notifier); ok {
+		return &tracedNotifierStore{tracedStore: traced, notifier: notifier}
+	}
+
+	return traced
+}
+
+type tracedStore struct {
+	store  Store
+	tracer Tracer
+}
+
+func (s *tracedStore) start(ctx context.Context, op, key string) (context.Context, Span) {
+	ctx, span := s.tracer.Start(ctx, "idempotency.store."+op)
+	if key != "" {
+		span.SetAttributes(Attr("idempotency.store_key_hash", keyHash(key)))
+	}
+
+	return ctx, span
+}
+
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	span.End()
+}
+
+func (s *tracedStore) Get(ctx context.Context, key string) (value []byte, err error) {
+	ctx, span := s.start(ctx, "get", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.Get(ctx, key)
+}
+
+func (s *tracedStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) (err error) {
+	ctx, span := s.start(ctx, "set", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.Set(ctx, key, value, ttl)
+}
+
+func (s *tracedStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (ok bool, err error) {
+	ctx, span := s.start(ctx, "setnx", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.SetNX(ctx, key, value, ttl)
+}
+
+func (s *tracedStore) SetNXMulti(ctx context.Context, keys []string, value []byte, ttl time.Duration) (ok bool, err error) {
+	ctx, span := s.start(ctx, "setnx_multi", "")
+	defer func() { endSpan(span, err) }()
+
+	return s.store.SetNXMulti(ctx, keys, value, ttl)
+}
+
+func (s *tracedStore) CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (ok bool, err error) {
+	ctx, span := s.start(ctx, "compare_and_swap", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.CompareAndSwap(ctx, key, old, new, ttl)
+}
+
+func (s *tracedStore) Lock(ctx context.Context, key, owner string, ttl time.Duration) (ok bool, err error) {
+	ctx, span := s.start(ctx, "lock", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.Lock(ctx, key, owner, ttl)
+}
+
+func (s *tracedStore) Unlock(ctx context.Context, key, owner string) (ok bool, err error) {
+	ctx, span := s.start(ctx, "unlock", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.Unlock(ctx, key, owner)
+}
+
+func (s *tracedStore) Delete(ctx context.Context, keys ...string) (err error) {
+	ctx, span := s.start(ctx, "delete", "")
+	defer func() { endSpan(span, err) }()
+
+	return s.store.Delete(ctx, keys...)
+}
+
+func (s *tracedStore) TTL(ctx context.Context, key string) (ttl time.Duration, err error) {
+	ctx, span := s.start(ctx, "ttl", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.TTL(ctx, key)
+}
+
+func (s *tracedStore) Expire(ctx context.Context, key string, ttl time.Duration) (err error) {
+	ctx, span := s.start(ctx, "expire", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.Expire(ctx, key, ttl)
+}
+
+func (s *tracedStore) AddMembers(ctx context.Context, key string, members ...string) (err error) {
+	ctx, span := s.start(ctx, "add_members", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.AddMembers(ctx, key, members...)
+}
+
+func (s *tracedStore) Members(ctx context.Context, key string) (members []string, err error) {
+	ctx, span := s.start(ctx, "members", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.Members(ctx, key)
+}
+
+func (s *tracedStore) Scan(ctx context.Context, prefix string, fn func(keys []string) error) (err error) {
+	ctx, span := s.start(ctx, "scan", prefix)
+	defer func() { endSpan(span, err) }()
+
+	return s.store.Scan(ctx, prefix, fn)
+}
+
+func (s *tracedStore) ExtendTTL(ctx context.Context, key string, ttl time.Duration) (err error) {
+	ctx, span := s.start(ctx, "extend_ttl", key)
+	defer func() { endSpan(span, err) }()
+
+	if extender, ok := s.store.(TTLExtender); ok {
+		return extender.ExtendTTL(ctx, key, ttl)
+	}
+
+	return expireLater(ctx, s.store, key, ttl)
+}
+
+type tracedNotifierStore struct {
+	*tracedStore
+	notifier Notifier
+}
+
+func (s *tracedNotifierStore) Notify(ctx context.Context, key string) (err error) {
+	ctx, span := s.start(ctx, "notify", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.notifier.Notify(ctx, key)
+}
+
+func (s *tracedNotifierStore) Subscribe(ctx context.Context, key string) (notified <-chan struct{}, cancel func(), err error) {
+	ctx, span := s.start(ctx, "subscribe", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.notifier.Subscribe(ctx, key)
+}
@@ -0,0 +1,11 @@
+module github.com/mgurevin/echo-idempotency/tracing/otel
+
+go 1.18
+
+require (
+	github.com/labstack/echo/v4 v4.7.2
+	github.com/mgurevin/echo-idempotency v0.1.0
+	go.opentelemetry.io/otel v1.10.0
+	go.opentelemetry.io/otel/sdk v1.10.0
+	go.opentelemetry.io/otel/trace v1.10.0
+)
@@ -0,0 +1,90 @@
+// Package otel implements the idempotency `Tracer` with OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+// NewTracer returns a `middleware.Tracer` starting the spans with the tracer,
+// e.g. `otel.Tracer("github.com/mgurevin/echo-idempotency")`.
+func NewTracer(tracer trace.Tracer) middleware.Tracer {
+	return otelTracer{tracer: tracer}
+}
+
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func (t otelTracer) Start(ctx context.Context, name string) (context.Context, middleware.Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+
+	return ctx, otelSpan{span: span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttributes(attrs ...middleware.Attribute) {
+	s.span.SetAttributes(keyValues(attrs)...)
+}
+
+func (s otelSpan) AddEvent(name string, attrs ...middleware.Attribute) {
+	s.span.AddEvent(name, trace.WithAttributes(keyValues(attrs)...))
+}
+
+// RecordError records the error as an event and sets the status of the span.
+func (s otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
+
+// keyValues converts the attributes to the OpenTelemetry ones.
+func keyValues(attrs []middleware.Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		kvs = append(kvs, keyValue(attr))
+	}
+
+	return kvs
+}
+
+// keyValue converts the attribute. The values of the types OpenTelemetry
+// doesn't support are formatted as strings.
+func keyValue(attr middleware.Attribute) attribute.KeyValue {
+	key := attribute.Key(attr.Key)
+
+	switch value := attr.Value.(type) {
+	case string:
+		return key.String(value)
+
+	case bool:
+		return key.Bool(value)
+
+	case int:
+		return key.Int(value)
+
+	case int64:
+		return key.Int64(value)
+
+	case float64:
+		return key.Float64(value)
+
+	case []string:
+		return key.StringSlice(value)
+
+	default:
+		return key.String(fmt.Sprint(value))
+	}
+}
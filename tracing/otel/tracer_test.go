@@ -0,0 +1,124 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	middleware "github.com/mgurevin/echo-idempotency"
+)
+
+func newRecorder(t *testing.T) (*tracetest.SpanRecorder, middleware.Tracer) {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+
+	return recorder, NewTracer(provider.Tracer("test"))
+}
+
+func TestSpan(t *testing.T) {
+	recorder, tracer := newRecorder(t)
+
+	_, span := tracer.Start(context.Background(), "span")
+	span.SetAttributes(middleware.Attr("string", "value"), middleware.Attr("int", 1), middleware.Attr("int64", int64(2)), middleware.Attr("duration", time.Second))
+	span.AddEvent("event", middleware.Attr("bool", true))
+	span.RecordError(errors.New("failed"))
+	span.End()
+
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d ended spans, want 1", len(ended))
+	}
+
+	got := ended[0]
+	if got.Name() != "span" {
+		t.Fatalf("got span %q, want %q", got.Name(), "span")
+	}
+
+	want := []attribute.KeyValue{
+		attribute.String("string", "value"),
+		attribute.Int("int", 1),
+		attribute.Int64("int64", 2),
+		attribute.String("duration", "1s"),
+	}
+
+	attrs := got.Attributes()
+	if len(attrs) != len(want) {
+		t.Fatalf("got attributes %v, want %v", attrs, want)
+	}
+
+	for i := range want {
+		if attrs[i] != want[i] {
+			t.Fatalf("got attribute %v, want %v", attrs[i], want[i])
+		}
+	}
+
+	events := got.Events()
+	if len(events) != 2 || events[0].Name != "event" || events[0].Attributes[0] != attribute.Bool("bool", true) {
+		t.Fatalf("got events %+v, want the event and the error", events)
+	}
+
+	if got.Status().Code != codes.Error || got.Status().Description != "failed" {
+		t.Fatalf("got status %+v, want the error", got.Status())
+	}
+}
+
+func TestMiddlewareSpans(t *testing.T) {
+	recorder, tracer := newRecorder(t)
+
+	mw, err := middleware.IdempotencyConfig{Store: middleware.NewMemoryStore(0), Tracer: tracer}.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(mw)
+	e.POST("/", func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", "key")
+
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	requests, stores := 0, 0
+	replayed := false
+	for _, span := range recorder.Ended() {
+		switch {
+		case span.Name() == "idempotency":
+			requests++
+
+			for _, event := range span.Events() {
+				if event.Name == "replayed from cache" {
+					replayed = len(event.Attributes) == 1 && event.Attributes[0] == attribute.Int("http.status_code", http.StatusCreated)
+				}
+			}
+
+		case strings.HasPrefix(span.Name(), "idempotency.store."):
+			stores++
+
+			if span.Parent().SpanID() == [8]byte{} {
+				t.Fatalf("store span %q without a parent", span.Name())
+			}
+		}
+	}
+
+	if requests != 2 || stores == 0 || !replayed {
+		t.Fatalf("got %d request spans, %d store spans, replay event %v", requests, stores, replayed)
+	}
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.spans = append(t.spans, name)
+
+	return ctx, noopSpan{}
+}
+
+// extenderStore counts the calls of its `TTLExtender` implementation.
+type extenderStore struct {
+	Store
+	extended int
+}
+
+func (s *extenderStore) ExtendTTL(ctx context.Context, key string, ttl time.Duration) error {
+	s.extended++
+
+	return expireLater(ctx, s.Store, key, ttl)
+}
+
+func TestTraceStoreOptionalInterfaces(t *testing.T) {
+	ctx := context.Background()
+	inner := &extenderStore{Store: NewMemoryStore(0)}
+	tracer := &recordingTracer{}
+
+	traced := traceStore(inner, tracer)
+
+	if _, ok := traceStore(NewMemoryStore(0), tracer).(Notifier); !ok {
+		t.Fatal("the traced store of a Notifier isn't a Notifier")
+	}
+
+	if err := traced.Set(ctx, "key", []byte("value"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extendTTL(ctx, traced, "key", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if inner.extended != 1 {
+		t.Fatalf("ExtendTTL of the inner store called %d times, want 1", inner.extended)
+	}
+
+	if ttl, _ := traced.TTL(ctx, "key"); ttl <= time.Second {
+		t.Fatalf("got TTL %v after extending it to a minute", ttl)
+	}
+
+	if err := extendTTL(ctx, traceStore(NewMemoryStore(0), tracer), "missing", time.Minute); err != ErrRecordLost {
+		t.Fatalf("extending a missing key without TTLExtender: got %v, want ErrRecordLost", err)
+	}
+
+	found := false
+	for _, name := range tracer.spans {
+		found = found || name == "idempotency.store.extend_ttl"
+	}
+
+	if !found {
+		t.Fatalf("no extend_ttl span in %q", tracer.spans)
+	}
+}
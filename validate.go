@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// ErrKeyMissing is the internal error of the responses sent when a
+	// required key is missing.
+	ErrKeyMissing = errors.New("idempotency key is missing")
+
+	// ErrKeyTooLong is the internal error of the responses sent when the key
+	// exceeds `MaxKeyLength`.
+	ErrKeyTooLong = errors.New("idempotency key is too long")
+
+	// ErrKeyFormat is the internal error of the responses sent when the key
+	// doesn't match `KeyPattern`.
+	ErrKeyFormat = errors.New("idempotency key has an invalid format")
+)
+
+// UUIDKeyPattern is a `KeyPattern` accepting only UUIDs.
+var UUIDKeyPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// KeyError is the message of the 400 Bad Request responses sent for invalid
+// idempotency keys.
+type KeyError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// keyRequired reports whether the request must carry an idempotency key.
+func keyRequired(config IdempotencyConfig, c echo.Context) bool {
+	if config.RequireKeyFunc != nil {
+		return config.RequireKeyFunc(c)
+	}
+
+	return config.RequireKey
+}
+
+// validateKey checks the idempotency key against `MaxKeyLength` and
+// `KeyPattern`.
+func validateKey(config IdempotencyConfig, key string) error {
+	if config.MaxKeyLength > 0 && len(key) > config.MaxKeyLength {
+		return config.keyError("idempotency_key_too_long", ErrKeyTooLong)
+	}
+
+	if config.KeyPattern != nil && !config.KeyPattern.MatchString(key) {
+		return config.keyError("idempotency_key_invalid_format", ErrKeyFormat)
+	}
+
+	return nil
+}
+
+// keyError returns the error of an invalid key, as problem details in the
+// `StrictRFC` mode.
+func (config IdempotencyConfig) keyError(code string, err error) error {
+	if config.StrictRFC {
+		return invalidKeyProblem(err)
+	}
+
+	return keyError(code, err)
+}
+
+func keyError(code string, err error) error {
+	return echo.NewHTTPError(http.StatusBadRequest, KeyError{Code: code, Message: err.Error()}).SetInternal(err)
+}
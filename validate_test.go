@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// sendKey sends a POST request with the idempotency key, if any, to the
+// middleware of the config.
+func sendKey(t *testing.T, config IdempotencyConfig, key string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	mw, err := config.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(mw)
+	e.POST("/", func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	if key != "" {
+		req.Header.Set("X-Idempotency-Key", key)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestValidateKey(t *testing.T) {
+	uuid := "123e4567-e89b-12d3-a456-426614174000"
+
+	tests := []struct {
+		name   string
+		config IdempotencyConfig
+		key    string
+		status int
+		code   string
+	}{
+		{"default length", IdempotencyConfig{}, strings.Repeat("k", 255), http.StatusCreated, ""},
+		{"too long by default", IdempotencyConfig{}, strings.Repeat("k", 256), http.StatusBadRequest, "idempotency_key_too_long"},
+		{"too long", IdempotencyConfig{MaxKeyLength: 8}, "123456789", http.StatusBadRequest, "idempotency_key_too_long"},
+		{"length unlimited", IdempotencyConfig{MaxKeyLength: -1}, strings.Repeat("k", 1024), http.StatusCreated, ""},
+		{"pattern", IdempotencyConfig{KeyPattern: UUIDKeyPattern}, uuid, http.StatusCreated, ""},
+		{"pattern mismatch", IdempotencyConfig{KeyPattern: UUIDKeyPattern}, "not-a-uuid", http.StatusBadRequest, "idempotency_key_invalid_format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Store = NewMemoryStore(0)
+
+			rec := sendKey(t, tt.config, tt.key)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.status)
+			}
+
+			if tt.code == "" {
+				return
+			}
+
+			var body KeyError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+
+			if body.Code != tt.code {
+				t.Fatalf("got error %+v, want code %q", body, tt.code)
+			}
+		})
+	}
+}
+
+func TestValidateKeyInternalErrors(t *testing.T) {
+	config := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), MaxKeyLength: 4, KeyPattern: UUIDKeyPattern}).config
+
+	for key, want := range map[string]error{"12345": ErrKeyTooLong, "1234": ErrKeyFormat} {
+		var httpErr *echo.HTTPError
+		if err := validateKey(config, key); !errors.As(err, &httpErr) || httpErr.Internal != want {
+			t.Fatalf("key %q: got %v, want %v", key, err, want)
+		}
+	}
+}
+
+func TestRequireKey(t *testing.T) {
+	onlyOrders := func(c echo.Context) bool {
+		return c.Request().Header.Get("X-Orders") != ""
+	}
+
+	customErr := echo.NewHTTPError(http.StatusPreconditionRequired)
+
+	tests := []struct {
+		name   string
+		config IdempotencyConfig
+		status int
+	}{
+		{"optional", IdempotencyConfig{}, http.StatusCreated},
+		{"required", IdempotencyConfig{RequireKey: true}, http.StatusBadRequest},
+		{"custom error", IdempotencyConfig{RequireKey: true, MissingKeyError: customErr}, http.StatusPreconditionRequired},
+
+		// RequireKeyFunc takes precedence over RequireKey.
+		{"not required by the func", IdempotencyConfig{RequireKey: true, RequireKeyFunc: onlyOrders}, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Store = NewMemoryStore(0)
+
+			if rec := sendKey(t, tt.config, ""); rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+
+	var body KeyError
+	rec := sendKey(t, IdempotencyConfig{Store: NewMemoryStore(0), RequireKey: true}, "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != "idempotency_key_missing" {
+		t.Fatalf("got body %q, want the idempotency_key_missing error", rec.Body.String())
+	}
+
+	if rec := sendKey(t, IdempotencyConfig{Store: NewMemoryStore(0), RequireKey: true}, "key"); rec.Code != http.StatusCreated {
+		t.Fatalf("required key present: got status %d, want 201", rec.Code)
+	}
+}
+
+func TestRequireKeyFunc(t *testing.T) {
+	mw, err := IdempotencyConfig{Store: NewMemoryStore(0), RequireKeyFunc: func(c echo.Context) bool {
+		return c.Path() == "/orders"
+	}}.ToMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(mw)
+
+	h := func(c echo.Context) error {
+		return c.String(http.StatusCreated, "created")
+	}
+
+	e.POST("/orders", h)
+	e.POST("/events", h)
+
+	for path, want := range map[string]int{"/orders": http.StatusBadRequest, "/events": http.StatusCreated} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader("body")))
+
+		if rec.Code != want {
+			t.Fatalf("%s without a key: got status %d, want %d", path, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// ErrConflict is the internal error of the responses sent when a
+	// concurrent request holds the key.
+	ErrConflict = errors.New("idempotency key is in use by a concurrent request")
+
+	// ErrWaitTimeout is the internal error of the responses sent when the
+	// concurrent request holding the key doesn't complete within `MaxWait`.
+	ErrWaitTimeout = errors.New("timed out waiting for the concurrent request")
+)
+
+// ConcurrentRequestPolicy defines how a request is handled while a concurrent
+// request holding the same key is in-flight.
+type ConcurrentRequestPolicy int
+
+const (
+	// ConcurrentWait waits for the concurrent request with the `WaitStrategy`
+	// and replays its response.
+	ConcurrentWait ConcurrentRequestPolicy = iota
+
+	// ConcurrentReject responds 409 Conflict immediately.
+	ConcurrentReject
+
+	// ConcurrentRetryAfter responds `RetryAfterStatus` with a Retry-After
+	// header immediately.
+	ConcurrentRetryAfter
+)
+
+// WaitStrategy defines how a request waits for the completion of the record
+// claimed by a concurrent request with the same key.
+type WaitStrategy interface {
+	// Wait blocks until the record stored under the key is done, or
+	// abandoned by its owner, and returns it decoded by the codec.
+	Wait(ctx context.Context, store Store, codec Codec, reqKey string) (ReqRecord, error)
+}
+
+// PollingWait is a `WaitStrategy` that reads the record periodically until
+// it is done.
+type PollingWait struct {
+	// Interval is the delay between two reads of the record.
+	// Optional. Default value 500 milliseconds.
+	Interval time.Duration
+
+	// MaxInterval enables the exponential backoff: the delay doubles with
+	// jitter after each read, up to MaxInterval.
+	// Optional. Default value 0 (constant Interval).
+	MaxInterval time.Duration
+}
+
+// Wait implements `WaitStrategy`.
+func (w *PollingWait) Wait(ctx context.Context, store Store, codec Codec, reqKey string) (ReqRecord, error) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+
+	backoff := &pollBackoff{interval: interval, max: w.MaxInterval}
+
+	for {
+		reqRec, err := getRecord(ctx, store, codec, reqKey)
+		if err != nil {
+			return reqRec, err
+		}
+
+		if reqRec.Done || reqRec.abandoned(time.Now()) {
+			return reqRec, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return reqRec, ctx.Err()
+
+		case <-time.After(backoff.next()):
+			continue
+		}
+	}
+}
+
+// NotifyWait is a `WaitStrategy` that is woken up as soon as the record is
+// done when the store implements `Notifier`. It keeps reading the record
+// periodically as a fallback for missed notifications and for the stores
+// that can't notify.
+type NotifyWait struct {
+	// FallbackInterval is the delay between two reads of the record when
+	// no notification arrives.
+	// Optional. Default value 500 milliseconds.
+	FallbackInterval time.Duration
+
+	// MaxFallbackInterval enables the exponential backoff of the fallback
+	// reads: the delay doubles with jitter after each read, up to
+	// MaxFallbackInterval.
+	// Optional. Default value 0 (constant FallbackInterval).
+	MaxFallbackInterval time.Duration
+}
+
+// Wait implements `WaitStrategy`.
+func (w *NotifyWait) Wait(ctx context.Context, store Store, codec Codec, reqKey string) (ReqRecord, error) {
+	notifier, ok := store.(Notifier)
+	if !ok {
+		return (&PollingWait{Interval: w.FallbackInterval, MaxInterval: w.MaxFallbackInterval}).Wait(ctx, store, codec, reqKey)
+	}
+
+	interval := w.FallbackInterval
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+
+	backoff := &pollBackoff{interval: interval, max: w.MaxFallbackInterval}
+
+	notified, cancel, err := notifier.Subscribe(ctx, reqKey)
+	if err != nil {
+		return ReqRecord{}, err
+	}
+
+	defer cancel()
+
+	for {
+		reqRec, err := getRecord(ctx, store, codec, reqKey)
+		if err != nil {
+			return reqRec, err
+		}
+
+		if reqRec.Done || reqRec.abandoned(time.Now()) {
+			return reqRec, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return reqRec, ctx.Err()
+
+		case <-notified:
+			continue
+
+		case <-time.After(backoff.next()):
+			continue
+		}
+	}
+}
+
+// pollBackoff computes the delays between the reads of a record: a constant
+// interval, or an exponential backoff with jitter up to max when max is
+// larger than the interval.
+type pollBackoff struct {
+	interval time.Duration
+	max      time.Duration
+}
+
+// next returns the delay before the next read.
+func (b *pollBackoff) next() time.Duration {
+	if b.max <= b.interval {
+		return b.interval
+	}
+
+	d := b.interval
+	b.interval *= 2
+	if b.interval > b.max {
+		b.interval = b.max
+	}
+
+	// Spread the reads of the requests waiting for the same record.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// ConflictWait is a `WaitStrategy` that doesn't wait; it replays the record
+// if it is already done and responds 409 Conflict otherwise.
+type ConflictWait struct{}
+
+// Wait implements `WaitStrategy`.
+func (ConflictWait) Wait(ctx context.Context, store Store, codec Codec, reqKey string) (ReqRecord, error) {
+	reqRec, err := getRecord(ctx, store, codec, reqKey)
+	if err != nil {
+		return reqRec, err
+	}
+
+	if !reqRec.Done && !reqRec.abandoned(time.Now()) {
+		return reqRec, echo.NewHTTPError(http.StatusConflict).SetInternal(ErrConflict)
+	}
+
+	return reqRec, nil
+}
+
+// getRecord reads the record stored under the key. It returns
+// `ErrRecordLost` if the key doesn't exist.
+func getRecord(ctx context.Context, store Store, codec Codec, reqKey string) (ReqRecord, error) {
+	reqRec := ReqRecord{}
+
+	reqData, err := store.Get(ctx, reqKey)
+	if errors.Is(err, ErrNotFound) {
+		return reqRec, ErrRecordLost
+	}
+
+	if err != nil {
+		return reqRec, err
+	}
+
+	if err := codec.Unmarshal(reqData, &reqRec); err != nil {
+		return reqRec, err
+	}
+
+	reqRec.raw = reqData
+
+	return reqRec, nil
+}
+
+// wait waits for the record of a concurrent request with the same key
+// according to the `ConcurrentRequestPolicy`, sharing the wait with the
+// other requests of the flight group waiting for the key.
+func wait(config IdempotencyConfig, flights *flightGroup, c echo.Context, reqKey string) (ReqRecord, error) {
+	ctx := c.Request().Context()
+
+	switch config.ConcurrentRequestPolicy {
+	case ConcurrentReject:
+		reqRec, err := ConflictWait{}.Wait(ctx, config.Store, config.Codec, reqKey)
+		if errors.Is(err, ErrConflict) && config.StrictRFC {
+			return reqRec, conflictProblem
+		}
+
+		return reqRec, err
+
+	case ConcurrentRetryAfter:
+		reqRec, err := ConflictWait{}.Wait(ctx, config.Store, config.Codec, reqKey)
+		if errors.Is(err, ErrConflict) {
+			c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(config.RetryAfter.Seconds()))))
+
+			return reqRec, echo.NewHTTPError(config.RetryAfterStatus).SetInternal(ErrConflict)
+		}
+
+		return reqRec, err
+	}
+
+	if config.MaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.MaxWait)
+		defer cancel()
+	}
+
+	reqRec, err := flights.wait(ctx, reqKey, func(ctx context.Context) (ReqRecord, error) {
+		return config.WaitStrategy.Wait(ctx, config.Store, config.Codec, reqKey)
+	})
+	if errors.Is(err, context.DeadlineExceeded) && c.Request().Context().Err() == nil {
+		return reqRec, echo.NewHTTPError(config.WaitTimeoutStatus).SetInternal(ErrWaitTimeout)
+	}
+
+	return reqRec, err
+}
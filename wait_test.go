@@ -0,0 +1,318 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// countingWait counts the waits of the strategy it wraps.
+type countingWait struct {
+	WaitStrategy
+	waits int32
+}
+
+func (w *countingWait) Wait(ctx context.Context, store Store, codec Codec, reqKey string) (ReqRecord, error) {
+	atomic.AddInt32(&w.waits, 1)
+
+	return w.WaitStrategy.Wait(ctx, store, codec, reqKey)
+}
+
+// setRecord stores the record under the key with the JSON codec.
+func setRecord(t *testing.T, store Store, reqKey string, reqRec ReqRecord) {
+	t.Helper()
+
+	if err := store.Set(context.Background(), reqKey, encodeRecord(t, reqRec), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// encodeRecord encodes the record with the JSON codec.
+func encodeRecord(t *testing.T, reqRec ReqRecord) []byte {
+	t.Helper()
+
+	reqData, err := JSONCodec{}.Marshal(reqRec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reqData
+}
+
+func TestWaitStrategyConfig(t *testing.T) {
+	strategy := &countingWait{WaitStrategy: &PollingWait{Interval: 10 * time.Millisecond}}
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DisableScope: true, WaitStrategy: strategy})
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	executed := int32(0)
+
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		if atomic.AddInt32(&executed, 1) == 1 {
+			close(started)
+			<-finish
+		}
+
+		return c.String(http.StatusCreated, "created")
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", "key")
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		first <- send()
+	}()
+
+	<-started
+
+	waited := make(chan *httptest.ResponseRecorder)
+	go func() {
+		waited <- send()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(finish)
+
+	if rec := <-first; rec.Code != http.StatusCreated {
+		t.Fatalf("first request: got status %d, want 201", rec.Code)
+	}
+
+	rec := <-waited
+	if rec.Code != http.StatusCreated || rec.Body.String() != "created" || rec.Header().Get("Idempotency-Replayed") != "true" {
+		t.Fatalf("waiting request: got status %d, body %q, headers %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	if executed != 1 || strategy.waits != 1 {
+		t.Fatalf("got %d executions and %d waits, want 1 and 1", executed, strategy.waits)
+	}
+}
+
+func TestPollingWait(t *testing.T) {
+	store := NewMemoryStore(0)
+	setRecord(t, store, "key", ReqRecord{Owner: "owner"})
+
+	done := encodeRecord(t, ReqRecord{Done: true, ResponseCode: http.StatusCreated})
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		_ = store.Set(context.Background(), "key", done, time.Minute)
+	}()
+
+	reqRec, err := (&PollingWait{Interval: 5 * time.Millisecond}).Wait(context.Background(), store, JSONCodec{}, "key")
+	if err != nil || !reqRec.Done || reqRec.ResponseCode != http.StatusCreated {
+		t.Fatalf("got %+v, %v, want the done record", reqRec, err)
+	}
+
+	// The record abandoned by its owner is returned for a takeover.
+	leaseExpiresAt := time.Now().Add(20 * time.Millisecond)
+	setRecord(t, store, "abandoned", ReqRecord{Owner: "owner", LeaseExpiresAt: &leaseExpiresAt})
+
+	reqRec, err = (&PollingWait{Interval: 5 * time.Millisecond}).Wait(context.Background(), store, JSONCodec{}, "abandoned")
+	if err != nil || reqRec.Done || !reqRec.abandoned(time.Now()) {
+		t.Fatalf("got %+v, %v, want the abandoned record", reqRec, err)
+	}
+
+	setRecord(t, store, "pending", ReqRecord{Owner: "owner"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	if _, err := (&PollingWait{Interval: 5 * time.Millisecond}).Wait(ctx, store, JSONCodec{}, "pending"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("pending record: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if _, err := (&PollingWait{}).Wait(context.Background(), store, JSONCodec{}, "missing"); err != ErrRecordLost {
+		t.Fatalf("missing record: got %v, want ErrRecordLost", err)
+	}
+}
+
+func TestConflictWait(t *testing.T) {
+	store := NewMemoryStore(0)
+	setRecord(t, store, "pending", ReqRecord{Owner: "owner"})
+	setRecord(t, store, "done", ReqRecord{Done: true, ResponseCode: http.StatusCreated})
+
+	_, err := ConflictWait{}.Wait(context.Background(), store, JSONCodec{}, "pending")
+
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusConflict || httpErr.Internal != ErrConflict {
+		t.Fatalf("pending record: got %v, want 409 with ErrConflict", err)
+	}
+
+	if reqRec, err := (ConflictWait{}).Wait(context.Background(), store, JSONCodec{}, "done"); err != nil || !reqRec.Done {
+		t.Fatalf("done record: got %+v, %v", reqRec, err)
+	}
+}
+
+func TestPollBackoff(t *testing.T) {
+	backoff := &pollBackoff{interval: 10 * time.Millisecond, max: 80 * time.Millisecond}
+
+	// The delays double with jitter, within [d/2, d], up to the max.
+	for _, d := range []time.Duration{10, 20, 40, 80, 80, 80} {
+		d *= time.Millisecond
+
+		if got := backoff.next(); got < d/2 || got > d {
+			t.Fatalf("got delay %v, want within [%v, %v]", got, d/2, d)
+		}
+	}
+
+	constant := &pollBackoff{interval: 10 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		if got := constant.next(); got != 10*time.Millisecond {
+			t.Fatalf("without a max: got delay %v, want the interval", got)
+		}
+	}
+}
+
+func TestWaitPollIntervalConfig(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), WaitPollInterval: 20 * time.Millisecond, WaitPollMaxInterval: time.Second})
+
+	strategy, ok := m.config.WaitStrategy.(*NotifyWait)
+	if !ok || strategy.FallbackInterval != 20*time.Millisecond || strategy.MaxFallbackInterval != time.Second {
+		t.Fatalf("got wait strategy %+v, want a NotifyWait with the intervals of the config", m.config.WaitStrategy)
+	}
+
+	m = NewManager(IdempotencyConfig{Store: NewMemoryStore(0)})
+
+	strategy, ok = m.config.WaitStrategy.(*NotifyWait)
+	if !ok || strategy.FallbackInterval != DefaultIdempotencyConfig.WaitPollInterval || strategy.MaxFallbackInterval != DefaultIdempotencyConfig.WaitPollMaxInterval {
+		t.Fatalf("got default wait strategy %+v", m.config.WaitStrategy)
+	}
+}
+
+func TestPollingWaitBackoff(t *testing.T) {
+	store := &countingGetStore{Store: NewMemoryStore(0)}
+	setRecord(t, store, "pending", ReqRecord{Owner: "owner"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	_, _ = (&PollingWait{Interval: 10 * time.Millisecond, MaxInterval: 80 * time.Millisecond}).Wait(ctx, store, JSONCodec{}, "pending")
+
+	// Reading every 10ms makes 30 reads; backing off makes 10 at most, with
+	// the shortest delays of the jitter.
+	if gets := atomic.LoadInt32(&store.gets); gets > 12 {
+		t.Fatalf("got %d reads in 300ms, want the delays backed off", gets)
+	}
+}
+
+// countingGetStore counts the reads of the records.
+type countingGetStore struct {
+	Store
+	gets int32
+}
+
+func (s *countingGetStore) Get(ctx context.Context, key string) ([]byte, error) {
+	atomic.AddInt32(&s.gets, 1)
+
+	return s.Store.Get(ctx, key)
+}
+
+func TestNotifyWait(t *testing.T) {
+	store := NewMemoryStore(0)
+	setRecord(t, store, "key", ReqRecord{Owner: "owner"})
+
+	done := encodeRecord(t, ReqRecord{Done: true, ResponseCode: http.StatusCreated})
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		_ = store.Set(context.Background(), "key", done, time.Minute)
+		_ = store.Notify(context.Background(), "key")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// The notification wakes the wait up long before the fallback read.
+	reqRec, err := (&NotifyWait{FallbackInterval: time.Hour}).Wait(ctx, store, JSONCodec{}, "key")
+	if err != nil || !reqRec.Done {
+		t.Fatalf("got %+v, %v, want the done record", reqRec, err)
+	}
+}
+
+func TestNotifyWaitWithoutNotifier(t *testing.T) {
+	// The embedding hides the `Notifier` of the memory store.
+	store := struct{ Store }{NewMemoryStore(0)}
+	setRecord(t, store, "key", ReqRecord{Owner: "owner"})
+
+	done := encodeRecord(t, ReqRecord{Done: true, ResponseCode: http.StatusCreated})
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		_ = store.Set(context.Background(), "key", done, time.Minute)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reqRec, err := (&NotifyWait{FallbackInterval: 5 * time.Millisecond}).Wait(ctx, store, JSONCodec{}, "key")
+	if err != nil || !reqRec.Done {
+		t.Fatalf("got %+v, %v, want the done record read by polling", reqRec, err)
+	}
+}
+
+func TestCompletionNotifiesInstances(t *testing.T) {
+	store := NewMemoryStore(0)
+
+	started, finish := make(chan struct{}), make(chan struct{})
+
+	// The instances share the store; the waiting one doesn't poll in time.
+	newEcho := func(block bool) *echo.Echo {
+		m := NewManager(IdempotencyConfig{Store: store, DisableScope: true, WaitPollInterval: time.Hour, WaitPollMaxInterval: time.Hour})
+
+		e := echo.New()
+		e.Use(m.Middleware())
+		e.POST("/", func(c echo.Context) error {
+			if block {
+				close(started)
+				<-finish
+			}
+
+			return c.String(http.StatusCreated, "created")
+		})
+
+		return e
+	}
+
+	first, second := newEcho(true), newEcho(false)
+
+	send := func(e *echo.Echo) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		req.Header.Set("X-Idempotency-Key", "key")
+
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req.WithContext(ctx))
+
+		return rec
+	}
+
+	go send(first)
+	<-started
+
+	waited := make(chan *httptest.ResponseRecorder)
+	go func() {
+		waited <- send(second)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(finish)
+
+	if rec := <-waited; rec.Code != http.StatusCreated || rec.Header().Get("Idempotency-Replayed") != "true" {
+		t.Fatalf("waiting instance: got status %d, headers %v, want the notified replay", rec.Code, rec.Header())
+	}
+}
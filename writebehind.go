@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"sync"
+)
+
+// writeBehind is the pool of goroutines storing the completed records in
+// the background, see `AsyncPersistence`.
+type writeBehind struct {
+	tasks  chan writeTask
+	wg     sync.WaitGroup
+	mu     sync.RWMutex
+	closed bool
+}
+
+// writeTask is a queued write; dropped is called instead of run when the
+// queue is dropped.
+type writeTask struct {
+	run     func()
+	dropped func()
+}
+
+func newWriteBehind(workers, queueSize int) *writeBehind {
+	w := &writeBehind{tasks: make(chan writeTask, queueSize)}
+
+	w.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go w.work()
+	}
+
+	return w
+}
+
+func (w *writeBehind) work() {
+	defer w.wg.Done()
+
+	for task := range w.tasks {
+		task.run()
+	}
+}
+
+// enqueue queues the write for a worker. It returns false when the queue is
+// full or closed, so the caller writes synchronously instead. The dropped
+// func is called if the queue is dropped before a worker ran the write.
+func (w *writeBehind) enqueue(run, dropped func()) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return false
+	}
+
+	select {
+	case w.tasks <- writeTask{run: run, dropped: dropped}:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// close stops the workers once they ran the queued writes.
+func (w *writeBehind) close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.tasks)
+	}
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
+
+// drop closes the queue, without waiting for the workers, and drops the
+// writes no worker started yet. It returns the number of the dropped writes.
+func (w *writeBehind) drop() int {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.tasks)
+	}
+	w.mu.Unlock()
+
+	dropped := 0
+	for task := range w.tasks {
+		task.dropped()
+		dropped++
+	}
+
+	return dropped
+}
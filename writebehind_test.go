@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestAsyncPersistenceKeepsBodies(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), AsyncPersistence: true})
+
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+
+			if info, ok := FromContext(c); ok && info.Record != nil {
+				if got := string(info.Record.ResponseBody); got != "body of "+info.Key {
+					t.Errorf("context record of %s: got body %q", info.Key, got)
+				}
+			}
+
+			return err
+		}
+	})
+	e.Use(m.Middleware())
+	e.POST("/", func(c echo.Context) error {
+		return c.String(http.StatusCreated, "body of "+c.Request().Header.Get("X-Idempotency-Key"))
+	})
+
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(key))
+		req.Header.Set("X-Idempotency-Key", key)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+
+		go func(key string) {
+			defer wg.Done()
+
+			send(key)
+		}(strconv.Itoa(i))
+	}
+
+	wg.Wait()
+
+	for i := 0; i < 200; i++ {
+		key := strconv.Itoa(i)
+		if rec := send(key); rec.Body.String() != "body of "+key {
+			t.Fatalf("replay of %s: got body %q", key, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// maxPooledBuffer is the capacity beyond which the body buffers aren't
+// recycled, so a few large responses don't pin their memory.
+const maxPooledBuffer = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	return buf
+}
+
+// putBuffer recycles the buffer; its contents must not be used afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+
+	bufferPool.Put(buf)
+}
+
+// bodyDumpResponseWriter copies the response body of the handler while
+// writing it to the client.
+type bodyDumpResponseWriter struct {
+	http.ResponseWriter
+	body     *bytes.Buffer
+	limit    int64
+	policy   OversizePolicy
+	oversize bool
+	hijacked bool
+	skipped  bool
+}
+
+func (w *bodyDumpResponseWriter) WriteHeader(code int) {
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *bodyDumpResponseWriter) Write(b []byte) (int, error) {
+	if err := w.dump(b); err != nil {
+		return 0, err
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying writer, for `http.ResponseController`.
+func (w *bodyDumpResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// skip stops copying the body, as it won't be stored.
+func (w *bodyDumpResponseWriter) skip() {
+	w.skipped = true
+	w.body.Reset()
+}
+
+// dump copies the chunk of the body, applying the size limit.
+func (w *bodyDumpResponseWriter) dump(b []byte) error {
+	if w.skipped {
+		return nil
+	}
+
+	if w.oversize && w.policy == OversizeError {
+		return ErrResponseTooLarge
+	}
+
+	if w.oversize {
+		return nil
+	}
+
+	if w.limit > 0 && int64(w.body.Len()+len(b)) > w.limit {
+		w.oversize = true
+
+		switch w.policy {
+		case OversizeError:
+			return ErrResponseTooLarge
+
+		case OversizeTruncate:
+			w.body.Write(b[:w.limit-int64(w.body.Len())])
+
+		default:
+			w.body.Reset()
+		}
+
+		return nil
+	}
+
+	w.body.Write(b)
+
+	return nil
+}
+
+func (w *bodyDumpResponseWriter) flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w *bodyDumpResponseWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.policy == OversizeError && !w.skipped {
+		return nil, nil, ErrResponseNotReplayable
+	}
+
+	w.hijacked = true
+
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (w *bodyDumpResponseWriter) push(target string, opts *http.PushOptions) error {
+	return w.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// readFrom copies the body through the `io.ReaderFrom` of the underlying
+// writer. Once the body isn't dumped anymore, the reader is passed as is, so
+// e.g. sendfile is used for the rest of a large file.
+func (w *bodyDumpResponseWriter) readFrom(src io.Reader) (int64, error) {
+	rf := w.ResponseWriter.(io.ReaderFrom)
+	if w.skipped || (w.oversize && w.policy != OversizeError) {
+		return rf.ReadFrom(src)
+	}
+
+	return rf.ReadFrom(io.TeeReader(src, dumpWriter{w}))
+}
+
+type dumpWriter struct{ w *bodyDumpResponseWriter }
+
+func (d dumpWriter) Write(b []byte) (int, error) {
+	if err := d.w.dump(b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+type flusher struct{ w *bodyDumpResponseWriter }
+
+func (f flusher) Flush() { f.w.flush() }
+
+type hijacker struct{ w *bodyDumpResponseWriter }
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) { return h.w.hijack() }
+
+type pusher struct{ w *bodyDumpResponseWriter }
+
+func (p pusher) Push(target string, opts *http.PushOptions) error { return p.w.push(target, opts) }
+
+type readerFrom struct{ w *bodyDumpResponseWriter }
+
+func (r readerFrom) ReadFrom(src io.Reader) (int64, error) { return r.w.readFrom(src) }
+
+// wrap returns the writer exposing only the optional interfaces the
+// underlying writer implements, so the handlers' interface assertions keep
+// answering truthfully.
+func (w *bodyDumpResponseWriter) wrap() http.ResponseWriter {
+	const (
+		canFlush = 1 << iota
+		canHijack
+		canPush
+		canReadFrom
+	)
+
+	var supports int
+	if _, ok := w.ResponseWriter.(http.Flusher); ok {
+		supports |= canFlush
+	}
+
+	if _, ok := w.ResponseWriter.(http.Hijacker); ok {
+		supports |= canHijack
+	}
+
+	if _, ok := w.ResponseWriter.(http.Pusher); ok {
+		supports |= canPush
+	}
+
+	if _, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		supports |= canReadFrom
+	}
+
+	f, h, p, r := flusher{w}, hijacker{w}, pusher{w}, readerFrom{w}
+
+	switch supports {
+	case 0:
+		return w
+
+	case canFlush:
+		return struct {
+			*bodyDumpResponseWriter
+			flusher
+		}{w, f}
+
+	case canHijack:
+		return struct {
+			*bodyDumpResponseWriter
+			hijacker
+		}{w, h}
+
+	case canFlush | canHijack:
+		return struct {
+			*bodyDumpResponseWriter
+			flusher
+			hijacker
+		}{w, f, h}
+
+	case canPush:
+		return struct {
+			*bodyDumpResponseWriter
+			pusher
+		}{w, p}
+
+	case canFlush | canPush:
+		return struct {
+			*bodyDumpResponseWriter
+			flusher
+			pusher
+		}{w, f, p}
+
+	case canHijack | canPush:
+		return struct {
+			*bodyDumpResponseWriter
+			hijacker
+			pusher
+		}{w, h, p}
+
+	case canFlush | canHijack | canPush:
+		return struct {
+			*bodyDumpResponseWriter
+			flusher
+			hijacker
+			pusher
+		}{w, f, h, p}
+
+	case canReadFrom:
+		return struct {
+			*bodyDumpResponseWriter
+			readerFrom
+		}{w, r}
+
+	case canFlush | canReadFrom:
+		return struct {
+			*bodyDumpResponseWriter
+			flusher
+			readerFrom
+		}{w, f, r}
+
+	case canHijack | canReadFrom:
+		return struct {
+			*bodyDumpResponseWriter
+			hijacker
+			readerFrom
+		}{w, h, r}
+
+	case canFlush | canHijack | canReadFrom:
+		return struct {
+			*bodyDumpResponseWriter
+			flusher
+			hijacker
+			readerFrom
+		}{w, f, h, r}
+
+	case canPush | canReadFrom:
+		return struct {
+			*bodyDumpResponseWriter
+			pusher
+			readerFrom
+		}{w, p, r}
+
+	case canFlush | canPush | canReadFrom:
+		return struct {
+			*bodyDumpResponseWriter
+			flusher
+			pusher
+			readerFrom
+		}{w, f, p, r}
+
+	case canHijack | canPush | canReadFrom:
+		return struct {
+			*bodyDumpResponseWriter
+			hijacker
+			pusher
+			readerFrom
+		}{w, h, p, r}
+
+	default:
+		return struct {
+			*bodyDumpResponseWriter
+			flusher
+			hijacker
+			pusher
+			readerFrom
+		}{w, f, h, p, r}
+	}
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// plainWriter hides the optional interfaces of the recorder.
+type plainWriter struct{ http.ResponseWriter }
+
+// readerFromWriter is a flushing recorder implementing `io.ReaderFrom`.
+type readerFromWriter struct{ *httptest.ResponseRecorder }
+
+func (w readerFromWriter) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+// fullWriter implements all the optional interfaces.
+type fullWriter struct{ readerFromWriter }
+
+func (fullWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	server, client := net.Pipe()
+	client.Close()
+
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func (fullWriter) Push(string, *http.PushOptions) error { return nil }
+
+func TestWrapInterfaces(t *testing.T) {
+	tests := []struct {
+		name                          string
+		writer                        http.ResponseWriter
+		flush, hijack, push, readFrom bool
+	}{
+		{"plain", plainWriter{httptest.NewRecorder()}, false, false, false, false},
+		{"flusher", httptest.NewRecorder(), true, false, false, false},
+		{"flusher and reader from", readerFromWriter{httptest.NewRecorder()}, true, false, false, true},
+		{"all", fullWriter{readerFromWriter{httptest.NewRecorder()}}, true, true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bodyDumpResponseWriter{ResponseWriter: tt.writer, body: new(bytes.Buffer)}
+			wrapped := w.wrap()
+
+			_, flush := wrapped.(http.Flusher)
+			_, hijack := wrapped.(http.Hijacker)
+			_, push := wrapped.(http.Pusher)
+			_, readFrom := wrapped.(io.ReaderFrom)
+
+			if flush != tt.flush || hijack != tt.hijack || push != tt.push || readFrom != tt.readFrom {
+				t.Fatalf("got Flusher %v, Hijacker %v, Pusher %v, ReaderFrom %v", flush, hijack, push, readFrom)
+			}
+
+			if unwrapper, ok := wrapped.(interface{ Unwrap() http.ResponseWriter }); !ok || unwrapper.Unwrap() != tt.writer {
+				t.Fatal("the wrapped writer doesn't unwrap to the underlying one")
+			}
+		})
+	}
+}
+
+func TestWrapReadFromDumps(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &bodyDumpResponseWriter{ResponseWriter: readerFromWriter{rec}, body: new(bytes.Buffer)}
+
+	if _, err := w.wrap().(io.ReaderFrom).ReadFrom(strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.body.String() != "body" || rec.Body.String() != "body" {
+		t.Fatalf("got dumped %q and sent %q, want the body", w.body.String(), rec.Body.String())
+	}
+}
+
+func TestWrapHijackOversizeError(t *testing.T) {
+	w := &bodyDumpResponseWriter{ResponseWriter: fullWriter{readerFromWriter{httptest.NewRecorder()}}, body: new(bytes.Buffer), policy: OversizeError}
+
+	if _, _, err := w.wrap().(http.Hijacker).Hijack(); !errors.Is(err, ErrResponseNotReplayable) {
+		t.Fatalf("got %v, want ErrResponseNotReplayable", err)
+	}
+
+	w.policy = OversizeSkipStorage
+
+	conn, _, err := w.wrap().(http.Hijacker).Hijack()
+	if err != nil || !w.hijacked {
+		t.Fatalf("got %v, hijacked %v, want the connection", err, w.hijacked)
+	}
+
+	conn.Close()
+}
+
+func TestFlushedResponseReplay(t *testing.T) {
+	m := NewManager(IdempotencyConfig{Store: NewMemoryStore(0), DisableScope: true})
+
+	flushed := false
+	send := newReplayEcho(m, func(c echo.Context) error {
+		c.Response().WriteHeader(http.StatusCreated)
+
+		for _, chunk := range []string{"a", "b", "c"} {
+			if _, err := c.Response().Write([]byte(chunk)); err != nil {
+				return err
+			}
+
+			c.Response().Flush()
+		}
+
+		_, flushed = c.Response().Writer.(http.Flusher)
+
+		return nil
+	})
+
+	send("key")
+
+	rec := send("key")
+	if !flushed || rec.Header().Get("Idempotency-Replayed") != "true" || rec.Body.String() != "abc" {
+		t.Fatalf("got Flusher %v, headers %v, body %q, want the replay of the flushed body", flushed, rec.Header(), rec.Body.String())
+	}
+}